@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// AttrValue is a typed attribute value, for PlaceAttr. Values are
+// stored encoded so that the keys for an attribute sort in order of
+// value. The encoding starts with a letter for the type, so values of
+// each type sort together:
+//
+//	IntAttr    i, then the value with its sign bit flipped as 16
+//	           big-endian hex digits
+//	FloatAttr  f, then the IEEE 754 bits as 16 big-endian hex digits,
+//	           with all bits of negative values flipped, or just the
+//	           sign bit of others
+//	TimeAttr   t, then the UTC time as 2006-01-02T15:04:05.000000000Z
+//	StringAttr s, then the string itself
+type AttrValue struct {
+	enc string
+}
+
+// IntAttr returns an integer value.
+func IntAttr(v int64) AttrValue {
+	return AttrValue{fmt.Sprintf("i%016x", uint64(v)^1<<63)}
+}
+
+// FloatAttr returns a floating-point value.
+func FloatAttr(v float64) AttrValue {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return AttrValue{fmt.Sprintf("f%016x", bits)}
+}
+
+// TimeAttr returns a time value, to the nanosecond.
+func TimeAttr(v time.Time) AttrValue {
+	return AttrValue{"t" + v.UTC().Format("2006-01-02T15:04:05.000000000Z")}
+}
+
+// StringAttr returns a string value.
+func StringAttr(v string) AttrValue {
+	return AttrValue{"s" + v}
+}
+
+// String returns v as it is encoded in the index.
+func (v AttrValue) String() string {
+	return v.enc
+}
+
+var errBadAttr = errors.New("db: attribute names may not be empty")
+
+// PlaceAttr notes that a blob has the named attribute with value.
+// A blob may have several values for an attribute.
+func (d *DB) PlaceAttr(ref, name string, value AttrValue) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if name == "" {
+		return errBadAttr
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(attr, name, value.enc, ref), nil, nil)
+}
+
+// AttrRange streams the blobs with a value of the named attribute
+// from lo through hi inclusive, in order of value. lo and hi should be
+// of the same type.
+func (d *DB) AttrRange(name string, lo, hi AttrValue) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(context.Background(), ch, 3, &util.Range{
+		Start: pack(attr, name, lo.enc, ""),
+		Limit: pack(attr, name, hi.enc, limit),
+	}, true)
+	return ch
+}
+
+// PlaceTag notes that a blob has value for the named tag, such as the
+// "model" of the camera that took a photo. Tags are string attributes,
+// so may also be read with AttrRange. Placing a tag again is harmless.
+func (d *DB) PlaceTag(ref, name, value string) error {
+	return d.PlaceAttr(ref, name, StringAttr(value))
+}
+
+// ListByTag streams, in ref order, the blobs with exactly value for
+// the named tag.
+func (d *DB) ListByTag(name, value string) <-chan string {
+	v := StringAttr(value)
+	return d.AttrRange(name, v, v)
+}
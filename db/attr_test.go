@@ -0,0 +1,46 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	d := newTestDB(t)
+	for _, tag := range []struct{ blob, name, value string }{
+		{"a", "model", "Canon EOS 5D"},
+		{"b", "model", "Canon EOS 5D"},
+		{"c", "model", "Canon EOS 5D Mark II"},
+		{"d", "make", "Canon EOS 5D"},
+		// Placing again is harmless
+		{"a", "model", "Canon EOS 5D"},
+	} {
+		if err := d.PlaceTag(ref(tag.blob), tag.name, tag.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name, value string
+		want        []string
+	}{
+		{"model", "Canon EOS 5D", refs("a", "b")},
+		{"model", "Canon EOS 5D Mark II", refs("c")},
+		{"make", "Canon EOS 5D", refs("d")},
+		{"model", "Canon", []string{}},
+		{"lens", "Canon EOS 5D", []string{}},
+	} {
+		if got := collect(d.ListByTag(c.name, c.value)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ListByTag(%s, %q) = %q, want %q", c.name, c.value, got, c.want)
+		}
+	}
+	// tags are string attributes, streamed by AttrRange in order of value
+	got := sorted(d.AttrRange("model", StringAttr("Canon"), StringAttr("Canon EOS 5D Mark II")))
+	if want := refs("a", "b", "c"); !reflect.DeepEqual(got, want) {
+		t.Errorf("AttrRange(model) = %q, want %q", got, want)
+	}
+
+	if err := d.PlaceTag(ref("a"), "", "x"); err != errBadAttr {
+		t.Errorf("PlaceTag with no name = %v, want errBadAttr", err)
+	}
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Operations reported in AuditEvents.
+const (
+	AuditPlace  = "place"
+	AuditDelete = "delete"
+	AuditForget = "forget"
+)
+
+// AuditEvent describes a mutation of the index, for Options.Audit.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Ref  string    `json:"ref"`
+	// Location is set for AuditPlace.
+	Location string `json:"location,omitempty"`
+}
+
+// AuditLog returns an audit sink appending each event to w as a line
+// of JSON. Errors writing to w are logged, not returned to the writer
+// of the index.
+func AuditLog(w io.Writer) func(AuditEvent) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(e); err != nil {
+			errorLog.Printf("audit: %s", err)
+		}
+	}
+}
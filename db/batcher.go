@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ErrBatcherClosed is returned by a Batcher that has been closed.
+var ErrBatcherClosed = errors.New("db: batcher is closed")
+
+// Batcher coalesces PlaceBlob calls into larger writes, for streaming
+// producers. Entries are written once maxOps have been added, or
+// maxInterval after the first unwritten one was, whichever is sooner;
+// until then they aren't visible in the index. A Batcher is safe for
+// concurrent use.
+type Batcher struct {
+	d           *DB
+	maxOps      int
+	maxInterval time.Duration
+
+	mu      sync.Mutex
+	b       *leveldb.Batch
+	staged  *stagedPlaces
+	entries []PlaceEntry
+	timer   *time.Timer
+	closed  bool
+	// err is the error of a flush that no caller has seen yet.
+	err error
+}
+
+// NewBatcher returns a Batcher writing to d. maxInterval 0 disables
+// the time limit.
+func (d *DB) NewBatcher(maxOps int, maxInterval time.Duration) *Batcher {
+	return &Batcher{
+		d:           d,
+		maxOps:      maxOps,
+		maxInterval: maxInterval,
+		b:           new(leveldb.Batch),
+		staged:      newStagedPlaces(),
+	}
+}
+
+// Add stages e to be written as by PlaceBlob. It returns the error of
+// any write since the previous call, including automatic ones.
+func (bt *Batcher) Add(e PlaceEntry) error {
+	if bt.d.readOnly {
+		return ErrReadOnly
+	}
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if bt.closed {
+		return ErrBatcherClosed
+	}
+	if err := bt.takeErr(); err != nil {
+		return err
+	}
+	if err := bt.d.normalizeEntry(&e); err != nil {
+		return err
+	}
+	// Placing a blob reads its previous entry, so it can't be staged
+	// twice.
+	if bt.staged.has(e.Ref) {
+		if err := bt.flush(); err != nil {
+			return err
+		}
+	}
+	if err := bt.d.stage(context.Background(), bt.b, e, bt.staged); err != nil {
+		return err
+	}
+	bt.entries = append(bt.entries, e)
+	if len(bt.entries) >= bt.maxOps {
+		return bt.flush()
+	}
+	if bt.timer == nil && bt.maxInterval > 0 {
+		bt.timer = time.AfterFunc(bt.maxInterval, bt.flushTimer)
+	}
+	return nil
+}
+
+// Flush writes every staged entry.
+func (bt *Batcher) Flush() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if err := bt.takeErr(); err != nil {
+		return err
+	}
+	return bt.flush()
+}
+
+// Close writes every staged entry, after which Add fails. Closing a
+// closed Batcher does nothing.
+func (bt *Batcher) Close() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if bt.closed {
+		return nil
+	}
+	bt.closed = true
+	if err := bt.takeErr(); err != nil {
+		return err
+	}
+	return bt.flush()
+}
+
+func (bt *Batcher) flushTimer() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if err := bt.flush(); err != nil && bt.err == nil {
+		bt.err = err
+	}
+}
+
+func (bt *Batcher) takeErr() error {
+	err := bt.err
+	bt.err = nil
+	return err
+}
+
+// flush writes the staged entries. bt.mu must be held.
+func (bt *Batcher) flush() error {
+	if bt.timer != nil {
+		bt.timer.Stop()
+		bt.timer = nil
+	}
+	if len(bt.entries) == 0 {
+		return nil
+	}
+	size := len(bt.b.Dump())
+	err := bt.d.db.Write(bt.b, bt.d.placeOptions())
+	entries := bt.entries
+	bt.b.Reset()
+	bt.staged = newStagedPlaces()
+	bt.entries = nil
+	if err != nil {
+		return err
+	}
+	bt.d.placed(entries, size)
+	return nil
+}
+
+// Defaults for Options.BatchSize and Options.BatchBytes.
+const (
+	defaultBatchSize  = 1000
+	defaultBatchBytes = 4 * opt.MiB
+)
+
+// BatchPlace Places entries as PlaceBlob would, but writing many in
+// each batch, bounded by Options.BatchSize and Options.BatchBytes, so
+// that each batch becomes visible in the index as it is written.
+// Rather than looking up each dependency as its entry is staged, which
+// costs a random read apiece, BatchPlace looks up the distinct
+// dependencies of each batch in a single ordered pass just before
+// writing it, noting those that aren't found in the same batch. With
+// MissingDeferred or MissingNone it skips the pass, as Place would.
+func (d *DB) BatchPlace(entries []PlaceEntry) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	size, bytes := d.batchSize, d.batchBytes
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if bytes <= 0 {
+		bytes = defaultBatchBytes
+	}
+	b := new(leveldb.Batch)
+	staged := newStagedPlaces()
+	staged.deferMissing = true
+	var pending []PlaceEntry
+	// dependents holds the pending refs depending on each dependency.
+	dependents := make(map[string][]string)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if d.missingPolicy == MissingInline {
+			if err := d.stageMissing(b, dependents, staged); err != nil {
+				return err
+			}
+		}
+		n := len(b.Dump())
+		if err := d.db.Write(b, d.placeOptions()); err != nil {
+			return err
+		}
+		d.placed(pending, n)
+		b.Reset()
+		staged = newStagedPlaces()
+		staged.deferMissing = true
+		pending = pending[:0]
+		dependents = make(map[string][]string)
+		return nil
+	}
+	for _, e := range entries {
+		if err := d.normalizeEntry(&e); err != nil {
+			return err
+		}
+		// Placing a blob reads its previous entry, so it can't be
+		// staged twice.
+		if staged.has(e.Ref) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if err := d.stage(context.Background(), b, e, staged); err != nil {
+			return err
+		}
+		pending = append(pending, e)
+		for _, dep := range e.Dependencies {
+			dependents[dep] = append(dependents[dep], e.Ref)
+		}
+		if len(pending) >= size || len(b.Dump()) >= bytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// stageMissing adds to b a missing entry for each of the values of
+// dependents under each of its keys that is neither found nor in
+// staged, looking them up in order.
+func (d *DB) stageMissing(b *leveldb.Batch, dependents map[string][]string, staged *stagedPlaces) error {
+	deps := make([]string, 0, len(dependents))
+	for dep := range dependents {
+		if !staged.has(dep) {
+			deps = append(deps, dep)
+		}
+	}
+	sort.Strings(deps)
+	for _, dep := range deps {
+		ok, err := d.db.Has(pack(found, dep), nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		for _, ref := range dependents[dep] {
+			b.Put(pack(missing, dep, ref), nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newAuditedDB returns an empty index whose audited Places are
+// counted by the returned func.
+func newAuditedDB(t *testing.T) (*DB, func() int) {
+	var mu sync.Mutex
+	placed := 0
+	d, err := NewWithOptions(t.TempDir(), Options{Audit: func(e AuditEvent) {
+		if e.Op == AuditPlace {
+			mu.Lock()
+			placed++
+			mu.Unlock()
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return placed
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	d, placed := newAuditedDB(t)
+	d.TrackWriteRate(time.Minute)
+	bt := d.NewBatcher(3, 0)
+	add := func(name string) {
+		t.Helper()
+		if err := bt.Add(PlaceEntry{Ref: ref(name), Location: "loc " + name, Size: -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a")
+	add("b")
+	if ok, _ := d.Has(ref("a")); ok || placed() != 0 {
+		t.Errorf("entries written before maxOps")
+	}
+	add("c")
+	if ok, _ := d.Has(ref("a")); !ok || placed() != 3 {
+		t.Errorf("entries not written at maxOps: %d audited", placed())
+	}
+	if p, _ := d.WriteRate(); p <= 0 {
+		t.Errorf("WriteRate = %v after a flush, want positive", p)
+	}
+	add("d")
+	// a blob staged twice flushes the first
+	add("d")
+	if placed() != 4 {
+		t.Errorf("%d audited after restaging, want 4", placed())
+	}
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+	if placed() != 5 {
+		t.Errorf("%d audited after Close, want 5", placed())
+	}
+	if err := bt.Add(PlaceEntry{Ref: ref("e")}); err != ErrBatcherClosed {
+		t.Errorf("Add after Close = %v, want ErrBatcherClosed", err)
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	d, placed := newAuditedDB(t)
+	bt := d.NewBatcher(1000, 10*time.Millisecond)
+	defer bt.Close()
+	for i := 0; i < 5; i++ {
+		if err := bt.Add(PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: "loc", Size: -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); placed() < 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 5 entries written after maxInterval", placed())
+		}
+	}
+}
+
+func TestBatchPlaceMissing(t *testing.T) {
+	// each batch's missing entries must be visible once its Places are
+	var d *DB
+	var errs []string
+	d, err := NewWithOptions(t.TempDir(), Options{BatchSize: 2, Audit: func(e AuditEvent) {
+		if e.Ref != ref("p") {
+			return
+		}
+		if got, _ := d.MissingDependents(ref("m")); !reflect.DeepEqual(got, refs("p")) {
+			errs = append(errs, fmt.Sprintf("missing entry of m = %q when p was written", got))
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	entries := []PlaceEntry{
+		// p depends on a, found in the same batch, b, found in the
+		// next, and m, never found
+		{Ref: ref("p"), Location: "loc", Size: -1, Dependencies: []string{ref("a"), ref("b"), ref("m")}},
+		{Ref: ref("a"), Location: "loc", Size: -1},
+		{Ref: ref("b"), Location: "loc", Size: -1},
+	}
+	if err := d.BatchPlace(entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range errs {
+		t.Error(e)
+	}
+	var missing []string
+	for m := range d.MissingWithParents() {
+		missing = append(missing, m.Ref)
+	}
+	if want := refs("m"); !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %q, want just m", missing)
+	}
+}
+
+// BenchmarkBatchPlace measures BatchPlace of batches of blobs each
+// depending on one found blob and one missing.
+func BenchmarkBatchPlace(b *testing.B) {
+	d := newTestDB(b)
+	if err := d.Place(ref("found"), "loc", "", nil); err != nil {
+		b.Fatal(err)
+	}
+	entries := make([]PlaceEntry, 0, defaultBatchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entries = append(entries, PlaceEntry{
+			Ref:          ref(fmt.Sprint(i)),
+			Location:     "loc",
+			Size:         -1,
+			Dependencies: []string{ref("found"), ref(fmt.Sprint("missing", i))},
+		})
+		if len(entries) == cap(entries) || i == b.N-1 {
+			if err := d.BatchPlace(entries); err != nil {
+				b.Fatal(err)
+			}
+			entries = entries[:0]
+		}
+	}
+}
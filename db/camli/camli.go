@@ -0,0 +1,31 @@
+// Package camli adapts Camlistore types to the db package, so that db
+// itself needn't depend on Camlistore.
+package camli
+
+import (
+	"fmt"
+	"io"
+
+	"camlistore.org/pkg/blob"
+
+	"github.com/dichro/cameloff/db"
+)
+
+type fetcher struct {
+	bs blob.Fetcher
+}
+
+// NewFetcher returns a db.Fetcher reading from a Camlistore blob
+// fetcher, such as any blobserver.Storage.
+func NewFetcher(bs blob.Fetcher) db.Fetcher {
+	return fetcher{bs}
+}
+
+func (f fetcher) Fetch(ref string) (io.ReadCloser, int64, error) {
+	br, ok := blob.Parse(ref)
+	if !ok {
+		return nil, 0, fmt.Errorf("%q: unparseable blob ref", ref)
+	}
+	body, size, err := f.bs.Fetch(br)
+	return body, int64(size), err
+}
@@ -0,0 +1,54 @@
+package camli
+
+import (
+	"camlistore.org/pkg/blob"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// Parse streams the refs from in, such as from one of the db.DB
+// streaming methods, as blob.Refs. Refs that fail to parse are skipped
+// and, if malformed is not nil, passed to it, eg. to be counted. The
+// returned channel is closed once in is.
+func Parse(in <-chan string, malformed func(ref string)) <-chan blob.Ref {
+	ch := make(chan blob.Ref)
+	go func() {
+		defer close(ch)
+		for ref := range in {
+			br, ok := blob.Parse(ref)
+			if !ok {
+				if malformed != nil {
+					malformed(ref)
+				}
+				continue
+			}
+			ch <- br
+		}
+	}()
+	return ch
+}
+
+// List is db.DB.List, parsed as for Parse.
+func List(d *db.DB, ct string, malformed func(ref string)) <-chan blob.Ref {
+	return Parse(d.List(ct), malformed)
+}
+
+// ListMIME is db.DB.ListMIME, parsed as for Parse.
+func ListMIME(d *db.DB, mt string, malformed func(ref string)) <-chan blob.Ref {
+	return Parse(d.ListMIME(mt), malformed)
+}
+
+// ListExtension is db.DB.ListExtension, parsed as for Parse.
+func ListExtension(d *db.DB, ext string, malformed func(ref string)) <-chan blob.Ref {
+	return Parse(d.ListExtension(ext), malformed)
+}
+
+// Missing is db.DB.Missing, parsed as for Parse.
+func Missing(d *db.DB, malformed func(ref string)) <-chan blob.Ref {
+	return Parse(d.Missing(), malformed)
+}
+
+// RangeFound is db.DB.RangeFound, parsed as for Parse.
+func RangeFound(d *db.DB, startRef, endRef string, malformed func(ref string)) <-chan blob.Ref {
+	return Parse(d.RangeFound(startRef, endRef), malformed)
+}
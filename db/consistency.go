@@ -0,0 +1,67 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// AuditMissingParentConsistency streams, as '|'-separated keys, the
+// entries of the missing and parent indexes that disagree with the
+// found index: missing|dep|ref entries whose dep is found, which Place
+// should have deleted, and parent|dep|ref entries whose dep is neither
+// found nor noted missing for ref. The latter are expected for blobs
+// Placed with MissingDeferred or MissingNone until ResolveMissing is
+// run.
+//
+// The audit reads a snapshot of the index, so concurrent writes can't
+// be reported as disagreements.
+func (d *DB) AuditMissingParentConsistency() (<-chan string, error) {
+	r, release, err := d.frozen()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		defer release()
+		r.auditMissingParent(ch)
+	}()
+	return ch, nil
+}
+
+func (d *DB) auditMissingParent(ch chan<- string) {
+	p := d.newProgress()
+	defer p.done()
+	for _, prefix := range []string{missing, parent} {
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(prefix, start),
+			Limit: pack(prefix, limit),
+		}, nil)
+		for it.Next() {
+			p.tick()
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			dep, ref := parts[1], parts[2]
+			depFound, _ := d.db.Has(pack(found, dep), nil)
+			switch {
+			case prefix == missing && depFound:
+			case prefix == parent && !depFound:
+				if ok, _ := d.db.Has(pack(missing, dep, ref), nil); ok {
+					continue
+				}
+			default:
+				continue
+			}
+			ch <- strings.Join(parts, "|")
+		}
+		err := it.Error()
+		it.Release()
+		if err != nil {
+			errorLog.Printf("db: AuditMissingParentConsistency: %s", err)
+			return
+		}
+	}
+}
@@ -2,184 +2,2412 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// tracer is a no-op unless the application installs an OpenTelemetry
+// TracerProvider.
+var tracer = otel.Tracer("github.com/dichro/cameloff/db")
+
 type DB struct {
-	db *leveldb.DB
+	db *handle
+
+	// options are those the index was opened with, for Reopen.
+	options *opt.Options
+
+	// recentMu guards recentSeq, the sequence number of the next
+	// entry in the ring of recently placed blobs; or 0 if it hasn't
+	// been loaded yet.
+	recentMu  sync.Mutex
+	recentSeq uint64
+
+	// rate holds the *rateCounter measuring Place calls, once
+	// TrackWriteRate is called.
+	rate atomic.Value
+
+	// progress is called every progressEvery entries of long scans
+	// if not nil.
+	progress      func(scanned uint64)
+	progressEvery uint64
+
+	// audit receives mutations if not nil.
+	audit func(AuditEvent)
+
+	// readOnly is set by NewRO.
+	readOnly bool
+
+	// format is the KeyFormat of the index, accessed atomically. It is
+	// below KeyFormat only for an older index opened by NewRO.
+	format int32
+
+	// sync is non-zero if SetSync(true) was last called.
+	sync int32
+
+	// compressFound, missingPolicy, strictRefs, batchSize and
+	// batchBytes are set from Options.
+	compressFound bool
+	missingPolicy MissingPolicy
+	strictRefs    bool
+	batchSize     int
+	batchBytes    int
+}
+
+// ErrReadOnly is returned by methods that would modify an index opened
+// with NewRO.
+var ErrReadOnly = errors.New("db: index is read-only")
+
+// ErrNotExist is returned by NewRO when there is no index at its path:
+// the directory is missing or empty.
+var ErrNotExist = errors.New("db: no index at path")
+
+// Options configure an index opened with NewWithOptions. The zero
+// value gives the defaults used by New.
+type Options struct {
+	// Audit, if not nil, is called with every Place and Delete once
+	// it has been written. It is called synchronously, so it should
+	// be quick; see AuditLog.
+	Audit func(AuditEvent)
+
+	// WriteBuffer is the size in bytes of leveldb's in-memory write
+	// buffer, or 0 for leveldb's default of 4MiB. Up to twice this is
+	// held in memory while a full buffer is flushed; a larger buffer
+	// means fewer, larger compactions.
+	WriteBuffer int
+
+	// BlockCache is the size in bytes of leveldb's cache of
+	// uncompressed blocks, or 0 for leveldb's default of 8MiB. Warm
+	// fills at most this much.
+	BlockCache int
+
+	// BloomBits, if positive, adds a bloom filter of this many bits
+	// per key to each table, such as 10 for a 1% false positive
+	// rate, so that the lookups of blobs that aren't indexed, such as
+	// the missing dependencies looked up by Place, rarely read a
+	// block. Tables written before it was set are read without one.
+	BloomBits int
+
+	// CompressFound snappy-compresses each found value that it
+	// shrinks. leveldb already compresses whole blocks, and a value
+	// with a single location doesn't shrink, so this only helps
+	// blobs with several locations; eg, 215 bytes for a blob with
+	// five becomes 64. Values are readable whether or not this is
+	// set.
+	CompressFound bool
+
+	// Missing is how Place notes dependencies that aren't found.
+	Missing MissingPolicy
+
+	// StrictRefs makes Place and friends reject blob refs that aren't
+	// a known hash with a digest of the right length. Refs are
+	// lowercased either way.
+	StrictRefs bool
+
+	// BatchSize and BatchBytes bound the writes of BatchPlace: each
+	// holds at most BatchSize entries, and is written once its
+	// encoding reaches BatchBytes. 0 means 1000 entries and 4MiB, a
+	// batch that fits leveldb's default write buffer.
+	BatchSize, BatchBytes int
+}
+
+// MissingPolicy is how Place notes dependencies that aren't found.
+type MissingPolicy int
+
+const (
+	// MissingInline looks up each dependency as it's Placed, so that
+	// Missing is always up to date.
+	MissingInline MissingPolicy = iota
+	// MissingDeferred skips the lookups, for bulk loads; call
+	// ResolveMissing once loading is done.
+	MissingDeferred
+	// MissingNone doesn't note missing dependencies at all, so Missing
+	// and the methods built on it know only those noted before.
+	MissingNone
+)
+
+func New(path string) (*DB, error) {
+	return NewWithOptions(path, Options{})
+}
+
+// NewWithOptions is New, configured by opts.
+func NewWithOptions(path string, opts Options) (*DB, error) {
+	return open(path, opts, leveldbOptions(opts))
+}
+
+// leveldbOptions returns the leveldb options configured by opts.
+func leveldbOptions(opts Options) *opt.Options {
+	o := &opt.Options{
+		WriteBuffer:        opts.WriteBuffer,
+		BlockCacheCapacity: opts.BlockCache,
+	}
+	if opts.BloomBits > 0 {
+		o.Filter = filter.NewBloomFilter(opts.BloomBits)
+	}
+	return o
+}
+
+func open(path string, opts Options, o *opt.Options) (*DB, error) {
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(db, opts, o)
+}
+
+// wrap returns a DB using db, which was opened with o.
+func wrap(db *leveldb.DB, opts Options, o *opt.Options) (*DB, error) {
+	d := &DB{
+		db:            newHandle(db),
+		options:       o,
+		audit:         opts.Audit,
+		compressFound: opts.CompressFound,
+		missingPolicy: opts.Missing,
+		strictRefs:    opts.StrictRefs,
+		batchSize:     opts.BatchSize,
+		batchBytes:    opts.BatchBytes,
+	}
+	if err := d.checkFormat(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// bulkWriteBuffer is the write buffer used by BulkLoad.
+const bulkWriteBuffer = 256 * opt.MiB
+
+// BulkLoad opens an index for a large initial build, such as a first
+// scan or Import. It uses a 256MiB write buffer, so may hold 512MiB in
+// memory, and lets many more tables accumulate before slowing writes
+// to wait for compaction; leveldb has no way to defer compaction
+// entirely. Call Finish once loading is done.
+func BulkLoad(path string) (*DB, error) {
+	return open(path, Options{}, &opt.Options{
+		WriteBuffer:            bulkWriteBuffer,
+		WriteL0SlowdownTrigger: 64,
+		WriteL0PauseTrigger:    128,
+	})
+}
+
+// Finish compacts the whole index, such as after BulkLoad, so that
+// later reads needn't search the tables left by the load.
+func (d *DB) Finish() error {
+	return d.Compact()
+}
+
+// Compact compacts the whole index, reclaiming the space of deleted
+// entries, such as after many Forgets, and merging its tables so that
+// reads search fewer of them.
+func (d *DB) Compact() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.db.CompactRange(util.Range{})
+}
+
+// indexRange returns the range of the keys of the named index.
+func indexRange(prefix string) util.Range {
+	// the last pointer's key is just its prefix, which other prefixes,
+	// such as lastverified, may start with.
+	return util.Range{Start: []byte(prefix), Limit: pack(prefix, limit)}
+}
+
+// ApproximateSize returns the approximate space on disk taken by the
+// named index, such as "parent" or "mime", as leveldb estimates it from
+// its table files: entries yet to be compacted out of its log aren't
+// counted.
+func (d *DB) ApproximateSize(prefix string) (uint64, error) {
+	if _, ok := keySpecs[prefix]; !ok {
+		return 0, fmt.Errorf("db: unknown index %q", prefix)
+	}
+	sizes, err := d.db.SizeOf([]util.Range{indexRange(prefix)})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sizes.Sum()), nil
+}
+
+// Sizes is ApproximateSize for every index, by name.
+func (d *DB) Sizes() (map[string]uint64, error) {
+	prefixes := make([]string, 0, len(keySpecs))
+	rngs := make([]util.Range, 0, len(keySpecs))
+	for prefix := range keySpecs {
+		prefixes = append(prefixes, prefix)
+		rngs = append(rngs, indexRange(prefix))
+	}
+	sizes, err := d.db.SizeOf(rngs)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]uint64, len(prefixes))
+	for i, prefix := range prefixes {
+		m[prefix] = uint64(sizes[i])
+	}
+	return m, nil
+}
+
+// CompactMissing compacts just the missing index, such as after
+// ResolveMissing has deleted many of its entries, reclaiming their
+// space without the cost of compacting the whole index.
+func (d *DB) CompactMissing() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.db.CompactRange(util.Range{
+		Start: pack(missing, start),
+		Limit: pack(missing, limit),
+	})
+}
+
+// NewRO opens the existing index at path read-only. It returns
+// ErrNotExist if there is none, and passes through other errors
+// opening it, such as of a corrupt index.
+func NewRO(path string) (*DB, error) {
+	return NewROWithOptions(path, Options{})
+}
+
+// NewROWithOptions is NewRO, configured by the options of opts that
+// apply to reads: BlockCache, BloomBits, whose filters are only read
+// from tables written with the same BloomBits, and StrictRefs.
+func NewROWithOptions(path string, opts Options) (*DB, error) {
+	o := leveldbOptions(opts)
+	o.WriteBuffer = 0
+	o.ErrorIfMissing, o.ReadOnly = true, true
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		if isEmptyIndex(path) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	d := &DB{db: newHandle(db), options: o, readOnly: true, strictRefs: opts.StrictRefs}
+	if err := d.checkFormat(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// isEmptyIndex reports whether there's no index at path: the directory
+// doesn't exist, or has no files but those leveldb creates on failing
+// to open it.
+func isEmptyIndex(path string) bool {
+	fis, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	for _, fi := range fis {
+		if n := fi.Name(); n != "LOCK" && n != "LOG" {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// number of entries in the ring of recently placed blobs
+	recentSize = 1024
+
+	// bounds for iterators
+	start = "\x00"
+	limit = "\xff"
+)
+
+// ReadOnly reports whether the index was opened with NewRO.
+func (d *DB) ReadOnly() bool {
+	return d.readOnly
+}
+
+func (d *DB) PlaceMIME(ref, mime string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(mimeType, mime, ref), nil, nil)
+}
+
+// PlaceExtension notes the file name extension of a file blob. The
+// extension is lowercased, and any leading dot dropped.
+func (d *DB) PlaceExtension(ref, ext string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(extension, normalizeExt(ext), ref), nil, nil)
+}
+
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// Place notes the presence of a blob at a particular location.
+//
+// Place and the other write methods are safe to call from several
+// goroutines, and each writes atomically, but concurrent writes about
+// the same blob may lose one another's changes: Placing a blob reads
+// its record to add to it, such as its duplicate locations.
+func (d *DB) Place(ref, location, ct string, dependencies []string) error {
+	return d.PlaceContext(context.Background(), ref, location, ct, dependencies)
+}
+
+// PlaceContext is Place, abandoning the write if ctx is cancelled
+// before it is committed.
+func (d *DB) PlaceContext(ctx context.Context, ref, location, ct string, dependencies []string) error {
+	return d.place(ctx, PlaceEntry{
+		Ref:          ref,
+		Location:     location,
+		Type:         ct,
+		Dependencies: dependencies,
+		Size:         -1,
+	})
+}
+
+// PlaceEntry describes a blob for PlaceBlob.
+type PlaceEntry struct {
+	Ref string
+	// Location is where the blob is stored, or "" if that isn't
+	// known, which leaves any location the index already has.
+	Location string
+	// Type is the blob's camliType, or "" for data blobs.
+	Type         string
+	Dependencies []string
+	// Size is the blob's length in bytes, or -1 if unknown.
+	Size int64
+	// SkipLast leaves the last location untouched, for concurrent
+	// bulk loads that call SetLast once they're done.
+	SkipLast bool
+	// Source, if not "", names the crawler placing the blob, for
+	// RefsFromSource. A blob may have several sources.
+	Source string
+}
+
+// PlaceBlob is Place, additionally recording everything else known
+// about the blob.
+func (d *DB) PlaceBlob(e PlaceEntry) error {
+	return d.place(context.Background(), e)
+}
+
+func (d *DB) place(ctx context.Context, e PlaceEntry) (err error) {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ctx, span := tracer.Start(ctx, "db.Place")
+	span.SetAttributes(attribute.String("ref", e.Ref), attribute.Int("dependencies", len(e.Dependencies)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	if err = d.normalizeEntry(&e); err != nil {
+		return
+	}
+	b := new(leveldb.Batch)
+	if err = d.stage(ctx, b, e, nil); err != nil {
+		return
+	}
+	size := len(b.Dump())
+	span.SetAttributes(attribute.Int("size", size))
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = d.db.Write(b, d.placeOptions()); err != nil {
+		return
+	}
+	d.placed([]PlaceEntry{e}, size)
+	return
+}
+
+// placed notes that entries were just written, in size bytes of
+// batches, for WriteRate and the audit func.
+func (d *DB) placed(entries []PlaceEntry, size int) {
+	now := time.Now()
+	if r := d.writeRate(); r != nil {
+		r.add(now, len(entries), size)
+	}
+	if d.audit != nil {
+		for _, e := range entries {
+			d.audit(AuditEvent{Time: now, Op: AuditPlace, Ref: e.Ref, Location: e.Location})
+		}
+	}
+}
+
+// normalizeEntry normalizes the refs of e.
+func (d *DB) normalizeEntry(e *PlaceEntry) (err error) {
+	if e.Ref, err = d.normalizeRef(e.Ref); err != nil {
+		return err
+	}
+	deps := make([]string, len(e.Dependencies))
+	for i, dep := range e.Dependencies {
+		if deps[i], err = d.normalizeRef(dep); err != nil {
+			return err
+		}
+	}
+	e.Dependencies = deps
+	return nil
+}
+
+// stage adds to b the writes that Place makes for e. staged, if not
+// nil, describes the entries already staged in b, which mustn't
+// include e.Ref.
+func (d *DB) stage(ctx context.Context, b *leveldb.Batch, e PlaceEntry, staged *stagedPlaces) error {
+	rec := foundRecord{Location: e.Location, First: e.Location, Size: e.Size, Indexed: time.Now()}
+	if prev, err := d.getFound(e.Ref); err == nil {
+		if rec.Location == "" {
+			rec.Location = prev.Location
+		}
+		if prev.Location != rec.Location {
+			b.Delete(pack(located, prev.Location, e.Ref))
+		}
+		rec.First = prev.First
+		rec.Duplicates = prev.duplicatesAfter(rec.Location)
+		if rec.Size < 0 {
+			rec.Size = prev.Size
+		}
+	}
+	b.Put(pack(found, e.Ref), d.foundValue(rec))
+	if rec.Location != "" {
+		b.Put(pack(located, rec.Location, e.Ref), nil)
+	}
+	b.Delete(pack(tombstone, e.Ref))
+	if !e.SkipLast && e.Location != "" {
+		b.Put(pack(last), []byte(e.Location))
+	}
+	seq := d.nextRecent()
+	b.Put(pack(recent, fmt.Sprintf("%04d", seq%recentSize)), pack(strconv.FormatUint(seq, 10), e.Ref))
+	if e.Type != "" {
+		b.Put(pack(camliType, e.Type, e.Ref), nil)
+	}
+	if e.Source != "" {
+		b.Put(pack(source, e.Source, e.Ref), nil)
+	}
+	for _, dep := range e.Dependencies {
+		b.Put(pack(parent, dep, e.Ref), nil)
+		b.Put(pack(child, e.Ref, dep), nil)
+		if d.missingPolicy != MissingInline || staged.deferring() || staged.has(dep) {
+			continue
+		}
+		if ok, _ := d.db.Has(pack(found, dep), nil); !ok {
+			k := pack(missing, dep, e.Ref)
+			b.Put(k, nil)
+			staged.addMissing(dep, k)
+		}
+	}
+	// No blob is usually waiting on e.Ref. The missing entries for it
+	// are keyed by their dependents too, so there's no single key for
+	// Has to check; the first Next of this range is that check, and
+	// the loop is skipped when it finds nothing.
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(missing, e.Ref, start),
+		Limit: pack(missing, e.Ref, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.Delete(it.Key())
+	}
+	if err := it.Error(); err != nil {
+		errorLog.Printf("db: Place %s: %s", e.Ref, err)
+	}
+	staged.add(e.Ref, b)
+	return nil
+}
+
+// stagedPlaces describes the entries staged in a batch, whose writes
+// aren't yet visible in the index.
+type stagedPlaces struct {
+	refs map[string]bool
+	// missing holds the missing entries staged for each dependency.
+	missing map[string][][]byte
+	// deferMissing skips looking up dependencies as they're staged,
+	// for callers that look them up afterwards.
+	deferMissing bool
+}
+
+func newStagedPlaces() *stagedPlaces {
+	return &stagedPlaces{refs: map[string]bool{}, missing: map[string][][]byte{}}
+}
+
+func (s *stagedPlaces) deferring() bool {
+	return s != nil && s.deferMissing
+}
+
+func (s *stagedPlaces) has(ref string) bool {
+	return s != nil && s.refs[ref]
+}
+
+func (s *stagedPlaces) addMissing(dep string, k []byte) {
+	if s != nil {
+		s.missing[dep] = append(s.missing[dep], k)
+	}
+}
+
+// add notes that ref was staged in b, where it's no longer missing.
+func (s *stagedPlaces) add(ref string, b *leveldb.Batch) {
+	if s == nil {
+		return
+	}
+	s.refs[ref] = true
+	for _, k := range s.missing[ref] {
+		b.Delete(k)
+	}
+	delete(s.missing, ref)
+}
+
+// nextRecent returns the next sequence number for the ring of recently
+// placed blobs.
+func (d *DB) nextRecent() uint64 {
+	d.recentMu.Lock()
+	defer d.recentMu.Unlock()
+	if d.recentSeq == 0 {
+		entries, _ := d.recentEntries()
+		d.recentSeq = 1
+		if len(entries) > 0 {
+			d.recentSeq = entries[0].seq + 1
+		}
+	}
+	seq := d.recentSeq
+	d.recentSeq++
+	return seq
+}
+
+type recentEntry struct {
+	seq uint64
+	ref string
+}
+
+// recentEntries returns the ring of recently placed blobs, most recent
+// first.
+func (d *DB) recentEntries() ([]recentEntry, error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(recent, start),
+		Limit: pack(recent, limit),
+	}, nil)
+	defer it.Release()
+	var entries []recentEntry
+	for it.Next() {
+		parts := unpack(it.Value())
+		seq, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		entries = append(entries, recentEntry{seq, parts[1]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq > entries[j].seq })
+	return entries, it.Error()
+}
+
+// Recent returns up to n of the most recently placed blobs, most
+// recent first. Only the last 1024 are remembered.
+func (d *DB) Recent(n int) ([]string, error) {
+	entries, err := d.recentEntries()
+	if n < len(entries) {
+		entries = entries[:n]
+	}
+	refs := make([]string, len(entries))
+	for i, e := range entries {
+		refs[i] = e.ref
+	}
+	return refs, err
+}
+
+// Delete removes a blob from the index, noting it as missing for every
+// blob that depends on it, and leaving a tombstone for ExportSince. It
+// returns the number of such dependents. The edges to the blob's own
+// dependencies remain; Forget removes those too.
+func (d *DB) Delete(ref string) (blocked int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if ref, err = d.normalizeRef(ref); err != nil {
+		return 0, err
+	}
+	b := new(leveldb.Batch)
+	if f, err := d.getFound(ref); err == nil {
+		b.Delete(pack(located, f.Location, ref))
+	}
+	b.Delete(pack(found, ref))
+	b.Put(pack(tombstone, ref), []byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+	if err := d.unverify(b, ref); err != nil {
+		return 0, err
+	}
+	for _, prefix := range []string{camliType, mimeType} {
+		for _, kind := range d.kinds(prefix) {
+			k := pack(prefix, kind, ref)
+			if ok, _ := d.db.Has(k, nil); ok {
+				b.Delete(k)
+			}
+		}
+	}
+	parents, err := d.Parents(ref)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range parents {
+		b.Put(pack(missing, ref, p), nil)
+	}
+	if err := d.db.Write(b, nil); err != nil {
+		return 0, err
+	}
+	if d.audit != nil {
+		d.audit(AuditEvent{Time: time.Now(), Op: AuditDelete, Ref: ref})
+	}
+	return len(parents), nil
+}
+
+// Forget removes a blob and everything indexed about it, such as after
+// it was garbage collected from the blob server, noting it as missing
+// for every blob that still depends on it. Unlike Delete, this also
+// removes the blob's own dependency edges, its extensions, sources,
+// derivatives, coordinates and verification time, its location in the
+// index of BlobsAt, and the last location if it was the blob's. Its
+// attributes and taken time, which are indexed by value, remain, but
+// ListTakenBetween skips the blob until it is Placed again. A
+// tombstone is left for ExportSince. All of it is written in a single
+// batch.
+func (d *DB) Forget(ref string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	if f, err := d.getFound(ref); err == nil && f.Location != "" {
+		b.Delete(pack(located, f.Location, ref))
+		l, err := d.Last()
+		if err != nil {
+			return err
+		}
+		if l == f.Location {
+			b.Delete(pack(last))
+		}
+	}
+	b.Delete(pack(found, ref))
+	b.Put(pack(tombstone, ref), []byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+	b.Delete(pack(geo, ref))
+	if err := d.unverify(b, ref); err != nil {
+		return err
+	}
+	for _, prefix := range []string{camliType, mimeType, extension, source, done} {
+		for _, kind := range d.kinds(prefix) {
+			k := pack(prefix, kind, ref)
+			if ok, _ := d.db.Has(k, nil); ok {
+				b.Delete(k)
+			}
+		}
+	}
+	derived, err := d.Derivatives(ref)
+	if err != nil {
+		return err
+	}
+	for _, r := range derived {
+		b.Delete(pack(derivative, ref, r))
+	}
+	children, err := d.Children(ref)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		b.Delete(pack(child, ref, c))
+		b.Delete(pack(parent, c, ref))
+		b.Delete(pack(missing, c, ref))
+	}
+	parents, err := d.Parents(ref)
+	if err != nil {
+		return err
+	}
+	for _, p := range parents {
+		b.Put(pack(missing, ref, p), nil)
+	}
+	if err := d.db.Write(b, nil); err != nil {
+		return err
+	}
+	if d.audit != nil {
+		d.audit(AuditEvent{Time: time.Now(), Op: AuditForget, Ref: ref})
+	}
+	return nil
+}
+
+// Prune Deletes every blob located under prefix, returning the number
+// of blobs removed and of dependents left blocked on them. Locations
+// are stored in values, so this scans every found blob.
+func (d *DB) Prune(prefix string) (pruned, blocked int, err error) {
+	if d.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		r, err := decodeFound(it.Value())
+		if err != nil {
+			return pruned, blocked, err
+		}
+		if !strings.HasPrefix(r.Location, prefix) {
+			continue
+		}
+		n, err := d.Delete(unpack(it.Key())[1])
+		if err != nil {
+			return pruned, blocked, err
+		}
+		pruned++
+		blocked += n
+	}
+	return pruned, blocked, it.Error()
+}
+
+// RefsAtLocationPrefix streams every found blob located under prefix,
+// in ref order. Locations are stored in values, so this scans every
+// found blob regardless of how few match.
+func (d *DB) RefsAtLocationPrefix(prefix string) <-chan string {
+	return d.RefsInLocations(prefix)
+}
+
+// BlobsAt streams, in ref order, every found blob whose current
+// location is exactly location, such as a particular pack file. Unlike
+// RefsAtLocationPrefix, this reads only the blobs at location, except
+// in an index older than KeyFormat 3, opened by NewRO, which has to
+// scan every found blob. Blobs are indexed by their current location
+// alone, not their duplicates.
+func (d *DB) BlobsAt(location string) <-chan string {
+	if atomic.LoadInt32(&d.format) < 3 {
+		return d.scanLocations(func(l string) bool { return l == location })
+	}
+	ch := make(chan string)
+	go d.streamBlobs(context.Background(), ch, 2, &util.Range{
+		Start: pack(located, location, start),
+		Limit: pack(located, location, limit),
+	}, true)
+	return ch
+}
+
+// RefsInLocations streams, in ref order, every found blob located
+// under any of prefixes, such as the names of several pack files. Like
+// RefsAtLocationPrefix, this scans every found blob, but only once.
+func (d *DB) RefsInLocations(prefixes ...string) <-chan string {
+	return d.scanLocations(func(l string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(l, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// scanLocations streams, in ref order, every found blob whose current
+// location match accepts.
+func (d *DB) scanLocations(match func(location string) bool) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			r, err := decodeFound(it.Value())
+			if err != nil {
+				continue
+			}
+			if match(r.Location) {
+				ch <- unpack(it.Key())[1]
+			}
+		}
+	}()
+	return ch
+}
+
+// CamliTypes returns the distinct camliTypes of known blobs.
+func (d *DB) CamliTypes() []string {
+	return d.kinds(camliType)
+}
+
+// MIMETypes returns the distinct MIME types of known blobs.
+func (d *DB) MIMETypes() []string {
+	return d.kinds(mimeType)
+}
+
+// RetypeBlob replaces whatever camliType a known blob has with
+// newType, or with none if newType is "".
+func (d *DB) RetypeBlob(ref, newType string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	for _, ct := range d.kinds(camliType) {
+		if ct == newType {
+			continue
+		}
+		k := pack(camliType, ct, ref)
+		if ok, _ := d.db.Has(k, nil); ok {
+			b.Delete(k)
+		}
+	}
+	if newType != "" {
+		b.Put(pack(camliType, newType, ref), nil)
+	}
+	return d.db.Write(b, nil)
+}
+
+// renameBatch is the number of entries RenameType moves at once.
+const renameBatch = 1000
+
+// RenameType relabels every blob of camliType from as camliType to,
+// returning the number of entries moved. Each blob is moved in a
+// single write, so an interrupted rename may simply be rerun.
+func (d *DB) RenameType(from, to string) (updated int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if from == to {
+		return 0, nil
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(camliType, from, start),
+		Limit: pack(camliType, from, limit),
+	}, nil)
+	defer it.Release()
+	b := new(leveldb.Batch)
+	for it.Next() {
+		parts, ok := keyFields(it.Key())
+		if !ok {
+			continue
+		}
+		ref := parts[2]
+		b.Delete(it.Key())
+		b.Put(pack(camliType, to, ref), nil)
+		updated++
+		if updated%renameBatch == 0 {
+			if err := d.db.Write(b, nil); err != nil {
+				return updated - renameBatch, err
+			}
+			b.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return updated - updated%renameBatch, err
+	}
+	if err := d.db.Write(b, nil); err != nil {
+		return updated - updated%renameBatch, err
+	}
+	return updated, nil
+}
+
+// PurgeType removes every blob of camliType ct from the index, such as
+// a type indexed by mistake. A blob that also has another camliType
+// only loses ct, and is counted in kept; the others are Deleted, and
+// counted in removed. Progress is reported as for TrackProgress.
+func (d *DB) PurgeType(ct string) (removed, kept int, err error) {
+	if d.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	var others []string
+	for _, kind := range d.kinds(camliType) {
+		if kind != ct {
+			others = append(others, kind)
+		}
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(camliType, ct, start),
+		Limit: pack(camliType, ct, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	b := new(leveldb.Batch)
+BLOB:
+	for it.Next() {
+		p.tick()
+		parts, ok := keyFields(it.Key())
+		if !ok {
+			continue
+		}
+		ref := parts[2]
+		for _, other := range others {
+			if ok, _ := d.db.Has(pack(camliType, other, ref), nil); ok {
+				b.Delete(it.Key())
+				kept++
+				if b.Len() >= renameBatch {
+					if err := d.db.Write(b, nil); err != nil {
+						return removed, kept, err
+					}
+					b.Reset()
+				}
+				continue BLOB
+			}
+		}
+		if _, err := d.Delete(ref); err != nil {
+			return removed, kept, err
+		}
+		removed++
+	}
+	if err := it.Error(); err != nil {
+		return removed, kept, err
+	}
+	return removed, kept, d.db.Write(b, nil)
+}
+
+// Ping checks that the index is open and readable without scanning or
+// writing anything. An empty index passes.
+func (d *DB) Ping() error {
+	if _, err := d.db.Get(pack(last), nil); err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Warm reads the entries under each of prefixes, or else the type and
+// MIME type indexes, to fill leveldb's block cache after opening the
+// index. It stops once it has read as much as the cache holds, since
+// reading more would only evict what it has read. Warm is safe to run
+// in the background while the index is in use.
+func (d *DB) Warm(prefixes ...string) error {
+	if len(prefixes) == 0 {
+		prefixes = []string{camliType, mimeType}
+	}
+	budget := d.options.GetBlockCacheCapacity()
+	for _, prefix := range prefixes {
+		it := d.db.NewIterator(util.BytesPrefix(pack(prefix, "")), nil)
+		for budget > 0 && it.Next() {
+			budget -= len(it.Key()) + len(it.Value())
+		}
+		err := it.Error()
+		it.Release()
+		if err != nil || budget <= 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// Last returns the last location successfully Placed, or "" if there
+// is none.
+func (d *DB) Last() (string, error) {
+	data, err := d.db.Get(pack(last), nil)
+	if err == leveldb.ErrNotFound {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// SetLast records location as the last one placed, as returned by
+// Last. The write is always synced to disk, so that a scan resumed
+// from Last after an OS crash never skips blobs that weren't indexed.
+func (d *DB) SetLast(location string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.db.Put(pack(last), []byte(location), &opt.WriteOptions{Sync: true})
+}
+
+// SetSync sets whether the writes of Place, BatchPlace and Batchers
+// are synced to disk before they return. By default they aren't, which
+// is much faster, but an OS crash or power loss may then lose the most
+// recent of them. SetLast and SetCheckpoint always sync, which makes
+// the progress they record durable along with every write before it,
+// so a scan that records its progress with either needs no more; a
+// process crash alone loses nothing either way. It may be called at
+// any time.
+func (d *DB) SetSync(sync bool) {
+	var v int32
+	if sync {
+		v = 1
+	}
+	atomic.StoreInt32(&d.sync, v)
+}
+
+// placeOptions returns the options for the writes SetSync governs.
+func (d *DB) placeOptions() *opt.WriteOptions {
+	if atomic.LoadInt32(&d.sync) == 0 {
+		return nil
+	}
+	return &opt.WriteOptions{Sync: true}
+}
+
+// SetCheckpoint records ref as the progress of the named scanner, as
+// of now, synced to disk whatever SetSync was given.
+func (d *DB) SetCheckpoint(name, ref string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.db.Put(pack(checkpoint, name), checkpointValue(ref, time.Now()), &opt.WriteOptions{Sync: true})
+}
+
+func checkpointValue(ref string, t time.Time) []byte {
+	return pack(ref, strconv.FormatInt(t.UnixNano(), 10))
+}
+
+// Checkpoint returns the progress last recorded by the named scanner,
+// or "" if it has none.
+func (d *DB) Checkpoint(name string) (string, error) {
+	ref, _, err := d.checkpointAt(name)
+	if err == leveldb.ErrNotFound {
+		return "", nil
+	}
+	return ref, err
+}
+
+// checkpointAt returns the named checkpoint and when it was recorded,
+// which is zero for checkpoints recorded before times were.
+func (d *DB) checkpointAt(name string) (ref string, t time.Time, err error) {
+	data, err := d.db.Get(pack(checkpoint, name), nil)
+	if err != nil {
+		return "", t, err
+	}
+	ref, t = decodeCheckpoint(data)
+	return ref, t, nil
+}
+
+func decodeCheckpoint(value []byte) (ref string, t time.Time) {
+	parts := unpack(value)
+	if len(parts) == 2 {
+		if ns, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			t = time.Unix(0, ns)
+		}
+	}
+	return parts[0], t
+}
+
+// RefsBetweenCheckpoints streams the found blobs last Placed after the
+// checkpoint from was recorded and no later than the checkpoint to
+// was, such as those indexed between two runs of a scanner. It is an
+// error if either checkpoint doesn't exist or wasn't recorded with a
+// time. This is a full scan of the found range.
+func (d *DB) RefsBetweenCheckpoints(from, to string) (<-chan string, error) {
+	var times [2]time.Time
+	for i, name := range []string{from, to} {
+		_, t, err := d.checkpointAt(name)
+		switch {
+		case err == leveldb.ErrNotFound:
+			return nil, fmt.Errorf("db: no checkpoint %q", name)
+		case err != nil:
+			return nil, err
+		case t.IsZero():
+			return nil, fmt.Errorf("db: checkpoint %q has no time", name)
+		}
+		times[i] = t
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			r, err := decodeFound(it.Value())
+			if err != nil || !r.Indexed.After(times[0]) || r.Indexed.After(times[1]) {
+				continue
+			}
+			ch <- unpack(it.Key())[1]
+		}
+	}()
+	return ch, nil
+}
+
+// Missing streams the currently unknown blobs.
+func (d *DB) Missing() <-chan string {
+	return d.MissingContext(context.Background())
+}
+
+// MissingContext is Missing, ending the stream and releasing its
+// iterator once ctx is done.
+func (d *DB) MissingContext(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(ctx, ch, 1, missingRange(), false)
+	return ch
+}
+
+func missingRange() *util.Range {
+	return &util.Range{
+		Start: pack(missing, start),
+		Limit: pack(missing, limit),
+	}
+}
+
+// MissingBlob is a blob that isn't found, and the blobs that depend
+// on it.
+type MissingBlob struct {
+	Ref     string
+	Parents []string
+}
+
+// MissingWithParents streams every missing blob once, in order, with
+// the blobs noted as depending on it.
+func (d *DB) MissingWithParents() <-chan MissingBlob {
+	ch := make(chan MissingBlob)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(missingRange(), nil)
+		defer it.Release()
+		p := d.newProgress()
+		defer p.done()
+		var m MissingBlob
+		for it.Next() {
+			p.tick()
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			if parts[1] != m.Ref {
+				if m.Ref != "" {
+					ch <- m
+				}
+				m = MissingBlob{Ref: parts[1]}
+			}
+			m.Parents = append(m.Parents, parts[2])
+		}
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: MissingWithParents: %s", err)
+			return
+		}
+		if m.Ref != "" {
+			ch <- m
+		}
+	}()
+	return ch
+}
+
+// MissingDependents returns the found blobs noted as waiting on the
+// missing blob dep, which become complete once dep is Placed. It is
+// the missing index's analog of Parents.
+func (d *DB) MissingDependents(dep string) (refs []string, err error) {
+	dep = d.lookupRef(dep)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(missing, dep, start),
+		Limit: pack(missing, dep, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts := unpack(it.Key())
+		refs = append(refs, parts[2])
+	}
+	err = it.Error()
+	return
+}
+
+// ResolveMissing brings the missing index up to date with the parent
+// index, noting every dependency that isn't found and forgetting those
+// that now are, such as after loading with MissingDeferred. It returns
+// the number of missing entries added and removed.
+func (d *DB) ResolveMissing() (added, removed int, err error) {
+	if d.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	b := new(leveldb.Batch)
+	flush := func() error {
+		if b.Len() < importBatch {
+			return nil
+		}
+		err := d.db.Write(b, nil)
+		b.Reset()
+		return err
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(parent, start),
+		Limit: pack(parent, limit),
+	}, nil)
+	defer it.Release()
+	var dep string
+	var isFound bool
+	for it.Next() {
+		parts := unpack(it.Key())
+		if len(parts) != 3 {
+			continue
+		}
+		// The parent index is ordered by dependency, so each is
+		// looked up once.
+		if parts[1] != dep {
+			dep = parts[1]
+			if isFound, err = d.db.Has(pack(found, dep), nil); err != nil {
+				return
+			}
+		}
+		k := pack(missing, dep, parts[2])
+		has, err := d.db.Has(k, nil)
+		if err != nil {
+			return added, removed, err
+		}
+		switch {
+		case isFound && has:
+			b.Delete(k)
+			removed++
+		case !isFound && !has:
+			b.Put(k, nil)
+			added++
+		}
+		if err := flush(); err != nil {
+			return added, removed, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return added, removed, err
+	}
+	return added, removed, d.db.Write(b, nil)
+}
+
+// PruneMissing deletes the missing entries whose dependent isn't found
+// or has no parent entry for the same dependency, such as those left
+// by a crash between writes or by older versions, which count toward
+// Missing though nothing depends on them. It returns the number
+// deleted.
+func (d *DB) PruneMissing() (removed int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	b := new(leveldb.Batch)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(missing, start),
+		Limit: pack(missing, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	for it.Next() {
+		p.tick()
+		parts := unpack(it.Key())
+		if len(parts) != 3 {
+			continue
+		}
+		ok, err := d.db.Has(pack(parent, parts[1], parts[2]), nil)
+		if err == nil && ok {
+			ok, err = d.db.Has(pack(found, parts[2]), nil)
+		}
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			continue
+		}
+		b.Delete(it.Key())
+		removed++
+		if b.Len() >= importBatch {
+			if err := d.db.Write(b, nil); err != nil {
+				return removed, err
+			}
+			b.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return removed, err
+	}
+	return removed, d.db.Write(b, nil)
+}
+
+// MissingActionable streams, once each, the currently unknown blobs
+// that are still needed by at least one found blob. Missing rows left
+// behind by Deleted dependents are skipped, but not removed. Missing
+// rows aren't timestamped, so none are considered expired.
+func (d *DB) MissingActionable() <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(missing, start),
+			Limit: pack(missing, limit),
+		}, nil)
+		defer it.Release()
+		for ok := it.Next(); ok; {
+			parts, valid := keyFields(it.Key())
+			if !valid {
+				ok = it.Next()
+				continue
+			}
+			if live, _ := d.db.Has(pack(found, parts[2]), nil); !live {
+				ok = it.Next()
+				continue
+			}
+			ch <- parts[1]
+			ok = it.Seek(pack(missing, parts[1], limit))
+		}
+	}()
+	return ch
+}
+
+// CountMissing returns the number of refs Missing would stream, a
+// missing blob counting once for each blob depending on it, without
+// streaming them.
+func (d *DB) CountMissing() (uint64, error) {
+	return d.countRange(missingRange())
+}
+
+// CountType returns the number of refs List would stream for ct,
+// without streaming them.
+func (d *DB) CountType(ct string) (uint64, error) {
+	return d.countRange(typeRange(ct))
+}
+
+// countRange returns the number of keys in rng.
+func (d *DB) countRange(rng *util.Range) (n uint64, err error) {
+	it := d.db.NewIterator(rng, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	for it.Next() {
+		p.tick()
+		n++
+	}
+	return n, it.Error()
+}
+
+// List streams all known blobs of a particular type, each once. If ct
+// is "", blobs of every type are streamed, and one Placed with several
+// types is streamed for each; see ListAnyType.
+func (d *DB) List(ct string) <-chan string {
+	return d.ListContext(context.Background(), ct)
+}
+
+// ListContext is List, ending the stream and releasing its iterator
+// once ctx is done.
+func (d *DB) ListContext(ctx context.Context, ct string) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(ctx, ch, 2, typeRange(ct), true)
+	return ch
+}
+
+// typeRange is the range of the type index holding blobs of type ct,
+// or of any type if ct is empty.
+func typeRange(ct string) *util.Range {
+	if ct == "" {
+		return &util.Range{
+			Start: pack(camliType, start),
+			Limit: pack(camliType, limit),
+		}
+	}
+	return &util.Range{
+		Start: pack(camliType, ct, start),
+		Limit: pack(camliType, ct, limit),
+	}
+}
+
+// ListAnyType streams, in order, all known blobs of any of the given
+// types. Each blob is streamed once.
+func (d *DB) ListAnyType(cts ...string) <-chan string {
+	rngs := make([]*util.Range, len(cts))
+	for i, ct := range cts {
+		rngs[i] = &util.Range{
+			Start: pack(camliType, ct, start),
+			Limit: pack(camliType, ct, limit),
+		}
+	}
+	ch := make(chan string)
+	go d.streamMerged(context.Background(), ch, 2, rngs)
+	return ch
+}
+
+// ListMIME streams all known files of a particular MIME type.
+func (d *DB) ListMIME(mt string) <-chan string {
+	return d.ListMIMEContext(context.Background(), mt)
+}
+
+// ListMIMEContext is ListMIME, ending the stream and releasing its
+// iterator once ctx is done.
+func (d *DB) ListMIMEContext(ctx context.Context, mt string) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(ctx, ch, 2, mimeRange(mt), true)
+	return ch
+}
+
+// ListMIMEAfter is ListMIMEContext, starting after the ref after, such
+// as a scan's Checkpoint, by seeking rather than skipping the refs up
+// to it.
+func (d *DB) ListMIMEAfter(ctx context.Context, mt, after string) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(ctx, ch, 2, mimeRangeAfter(mt, after), true)
+	return ch
+}
+
+// ListMIMEs streams, in order, all known files of any of the given MIME
+// types. Each file is streamed once, whatever its types.
+func (d *DB) ListMIMEs(mts ...string) <-chan string {
+	return d.ListMIMEsAfter(context.Background(), "", mts...)
+}
+
+// ListMIMEsAfter is ListMIMEs, starting after the ref after, as for
+// ListMIMEAfter, and stopping early once ctx is done.
+func (d *DB) ListMIMEsAfter(ctx context.Context, after string, mts ...string) <-chan string {
+	rngs := make([]*util.Range, len(mts))
+	for i, mt := range mts {
+		rngs[i] = mimeRangeAfter(mt, after)
+	}
+	ch := make(chan string)
+	go d.streamMerged(ctx, ch, 2, rngs)
+	return ch
+}
+
+// mimeRangeAfter is mimeRange, from after the ref after, if any.
+func mimeRangeAfter(mt, after string) *util.Range {
+	rng := mimeRange(mt)
+	if after != "" {
+		// the keys of refs greater than after, including those it
+		// prefixes, sort after this.
+		rng.Start = append(pack(mimeType, mt, after), 1)
+	}
+	return rng
+}
+
+func mimeRange(mt string) *util.Range {
+	return &util.Range{
+		Start: pack(mimeType, mt, start),
+		Limit: pack(mimeType, mt, limit),
+	}
+}
+
+// ListTypeMIME streams, in order, the blobs of camliType ct that also
+// have MIME type mt, such as file blobs of image/png; both must be
+// given. The two indexes are each ordered by ref, so rather than keep
+// a combined index in step with both, each iterator seeks past the
+// refs the other lacks, and the cost is bounded by the rarer of the
+// two.
+func (d *DB) ListTypeMIME(ct, mt string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		types := d.db.NewIterator(typeRange(ct), nil)
+		defer types.Release()
+		mimes := d.db.NewIterator(mimeRange(mt), nil)
+		defer mimes.Release()
+		p := d.newProgress()
+		defer p.done()
+		ref := func(k []byte) string {
+			if parts := unpack(k); len(parts) == 3 {
+				return parts[2]
+			}
+			return ""
+		}
+		ok := types.Next() && mimes.Next()
+		for ok {
+			p.tick()
+			t, m := ref(types.Key()), ref(mimes.Key())
+			switch {
+			case t == m:
+				if t != "" {
+					ch <- t
+				}
+				ok = types.Next() && mimes.Next()
+			case t < m:
+				ok = types.Seek(pack(camliType, ct, m))
+			default:
+				ok = mimes.Seek(pack(mimeType, mt, t))
+			}
+		}
+		for _, it := range []iterator.Iterator{types, mimes} {
+			if err := it.Error(); err != nil {
+				errorLog.Printf("db: ListTypeMIME: %s", err)
+			}
+		}
+	}()
+	return ch
+}
+
+// RangeFound streams all found blobs from startRef through endRef,
+// inclusive. Empty bounds are open-ended.
+func (d *DB) RangeFound(startRef, endRef string) <-chan string {
+	rng := util.Range{
+		Start: pack(found, startRef),
+		Limit: pack(found, limit),
+	}
+	if startRef == "" {
+		rng.Start = pack(found, start)
+	}
+	if endRef != "" {
+		rng.Limit = pack(found, endRef+start)
+	}
+	ch := make(chan string)
+	go d.streamBlobs(context.Background(), ch, 1, &rng, true)
+	return ch
+}
+
+// RefsFromSource streams all known blobs Placed by the named source.
+func (d *DB) RefsFromSource(name string) <-chan string {
+	ch := make(chan string)
+	go d.streamBlobs(context.Background(), ch, 2, &util.Range{
+		Start: pack(source, name, start),
+		Limit: pack(source, name, limit),
+	}, true)
+	return ch
+}
+
+// ListExtension streams all known files with a particular file name
+// extension, normalized as for PlaceExtension.
+func (d *DB) ListExtension(ext string) <-chan string {
+	ext = normalizeExt(ext)
+	ch := make(chan string)
+	go d.streamBlobs(context.Background(), ch, 2, &util.Range{
+		Start: pack(extension, ext, start),
+		Limit: pack(extension, ext, limit),
+	}, true)
+	return ch
+}
+
+// RefInfo describes an indexed blob without reference to the
+// blobstore.
+type RefInfo struct {
+	Ref, Location string
+	// Size is -1 if the index has no record of it.
+	Size int64
+}
+
+// Info looks up each ref supplied on the provided channel, streaming
+// what the index knows about it. Refs that aren't found are skipped.
+func (d *DB) Info(refs <-chan string) <-chan RefInfo {
+	ch := make(chan RefInfo)
+	go func() {
+		defer close(ch)
+		for ref := range refs {
+			r, err := d.getFound(ref)
+			if err != nil {
+				continue
+			}
+			ch <- RefInfo{Ref: ref, Location: r.Location, Size: r.Size}
+		}
+	}()
+	return ch
+}
+
+// BlobMeta is a stored blob, as enumerated by a blob server.
+type BlobMeta struct {
+	Ref  string
+	Size int64
+}
+
+// UnindexedBlobs streams the refs of the blobs from enum that aren't
+// found, such as those a crashed indexer had yet to Place. enum must be
+// sorted by ref, as blob servers enumerate them, so that both sides are
+// read in a single streaming merge; a ref out of order is looked up
+// separately instead.
+func (d *DB) UnindexedBlobs(enum <-chan BlobMeta) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer it.Release()
+		valid := it.Next()
+		var prev string
+		for m := range enum {
+			k := pack(found, m.Ref)
+			var indexed bool
+			if m.Ref < prev {
+				indexed, _ = d.db.Has(k, nil)
+			} else {
+				prev = m.Ref
+				if valid && bytes.Compare(it.Key(), k) < 0 {
+					valid = it.Seek(k)
+				}
+				indexed = valid && bytes.Equal(it.Key(), k)
+			}
+			if !indexed {
+				ch <- m.Ref
+			}
+		}
+	}()
+	return ch
+}
+
+// DupeGroup is a blob that has been Placed at more than one location.
+type DupeGroup struct {
+	Ref string
+	// Locations starts with the current location.
+	Locations []string
+}
+
+// DuplicateLocations streams every found blob that has been Placed at
+// more than one location, such as by a repacking bug.
+func (d *DB) DuplicateLocations() <-chan DupeGroup {
+	ch := make(chan DupeGroup)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			r, err := decodeFound(it.Value())
+			if err != nil || len(r.Duplicates) == 0 {
+				continue
+			}
+			ch <- DupeGroup{
+				Ref:       unpack(it.Key())[1],
+				Locations: append([]string{r.Location}, r.Duplicates...),
+			}
+		}
+	}()
+	return ch
+}
+
+// Duplicates streams the refs of DuplicateLocations.
+func (d *DB) Duplicates() <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for g := range d.DuplicateLocations() {
+			ch <- g.Ref
+		}
+	}()
+	return ch
+}
+
+// DedupSavings returns the number of bytes that collapsing every
+// found blob's duplicate locations into one would reclaim: the sum,
+// over blobs with more than one location, of the blob's size times its
+// number of extra locations. skipped is the number of such blobs whose
+// size is unknown, which aren't counted.
+func (d *DB) DedupSavings() (savings int64, skipped int, err error) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		r, err := decodeFound(it.Value())
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %s", unpack(it.Key())[1], err)
+		}
+		switch {
+		case len(r.Duplicates) == 0:
+		case r.Size < 0:
+			skipped++
+		default:
+			savings += r.Size * int64(len(r.Duplicates))
+		}
+	}
+	return savings, skipped, it.Error()
 }
 
-func New(path string) (*DB, error) {
-	db, err := leveldb.OpenFile(path, nil)
+// Verified records that ref was successfully read and verified at t,
+// replacing any earlier verification time.
+func (d *DB) Verified(ref string, t time.Time) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &DB{db: db}, nil
+	b := new(leveldb.Batch)
+	if err := d.unverify(b, ref); err != nil {
+		return err
+	}
+	ns := t.UnixNano()
+	b.Put(pack(verified, ref), []byte(strconv.FormatInt(ns, 10)))
+	b.Put(pack(lastVerified, verifiedKey(ns), ref), nil)
+	return d.db.Write(b, nil)
 }
 
-func NewRO(path string) (*DB, error) {
-	db, err := leveldb.OpenFile(path, &opt.Options{
-		ErrorIfMissing: true,
-		ReadOnly:       true,
-	})
+// unverify adds the deletion of ref's verification time, if any, to b.
+func (d *DB) unverify(b *leveldb.Batch, ref string) error {
+	v, err := d.db.Get(pack(verified, ref), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	ns, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return fmt.Errorf("db: %s: verified: %s", ref, err)
 	}
-	return &DB{db: db}, nil
+	b.Delete(pack(verified, ref))
+	b.Delete(pack(lastVerified, verifiedKey(ns), ref))
+	return nil
 }
 
-const (
-	// prefixes used in leveldb
-	found     = "found"
-	missing   = "missing"
-	parent    = "parent"
-	last      = "last"
-	camliType = "type"
-	mimeType  = "mime"
+// verifiedKey formats ns for the lastverified index. Times before the
+// epoch sort as the epoch.
+func verifiedKey(ns int64) string {
+	if ns < 0 {
+		ns = 0
+	}
+	return fmt.Sprintf("%019d", ns)
+}
 
-	// bounds for iterators
-	start = "\x00"
-	limit = "\xff"
-)
+// StaleVerifications streams the found blobs that haven't been
+// Verified since olderThan, oldest first. Blobs that were never
+// Verified come first, in ref order; finding them costs a lookup per
+// found blob.
+func (d *DB) StaleVerifications(olderThan time.Time) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		for it.Next() {
+			ref := unpack(it.Key())[1]
+			if ok, _ := d.db.Has(pack(verified, ref), nil); !ok {
+				ch <- ref
+			}
+		}
+		err := it.Error()
+		it.Release()
+		if err != nil {
+			errorLog.Printf("db: stale verifications: %s", err)
+			return
+		}
+		it = d.db.NewIterator(&util.Range{
+			Start: pack(lastVerified, start),
+			Limit: pack(lastVerified, verifiedKey(olderThan.UnixNano())),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			ref := parts[2]
+			if ok, _ := d.db.Has(pack(found, ref), nil); ok {
+				ch <- ref
+			}
+		}
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: stale verifications: %s", err)
+		}
+	}()
+	return ch
+}
 
-func (d *DB) PlaceMIME(ref, mime string) error {
-	return d.db.Put(pack(mimeType, mime, ref), nil, nil)
+// Untyped streams all known blobs that have no camliType, ie, blobs
+// that were Placed as plain data. The type index is keyed by type
+// first, so this costs one lookup per known camliType for every
+// found blob.
+func (d *DB) Untyped() <-chan string {
+	return d.unindexed(camliType)
 }
 
-// Place notes the presence of a blob at a particular location.
-func (d *DB) Place(ref, location, ct string, dependencies []string) (err error) {
-	b := new(leveldb.Batch)
-	// TODO(dichro): duplicates are interesting, but pretty rare,
-	// so probably not worth tracking?
-	b.Put(pack(found, ref), pack(location))
-	b.Put(pack(last), pack(location))
-	if ct != "" {
-		b.Put(pack(camliType, ct, ref), nil)
-	}
-	for _, dep := range dependencies {
-		b.Put(pack(parent, dep, ref), nil)
-		// TODO(dichro): should these always be looked up
-		// inline? Maybe a post-scan would be faster for bulk
-		// insert?
-		if ok, _ := d.db.Has(pack(found, dep), nil); !ok {
-			b.Put(pack(missing, dep, ref), nil)
+// Unclassified streams all known blobs that have neither a camliType
+// nor a MIME type. As for Untyped, this costs one lookup per known
+// camliType and MIME type for every found blob.
+func (d *DB) Unclassified() <-chan string {
+	return d.unindexed(camliType, mimeType)
+}
+
+// unindexed streams all found blobs that have no entries in any of
+// the indexes named by prefixes.
+func (d *DB) unindexed(prefixes ...string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		var keys [][2]string
+		for _, prefix := range prefixes {
+			for _, kind := range d.kinds(prefix) {
+				keys = append(keys, [2]string{prefix, kind})
+			}
+		}
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(found, start),
+			Limit: pack(found, limit),
+		}, nil)
+		defer it.Release()
+	BLOB:
+		for it.Next() {
+			ref := unpack(it.Key())[1]
+			for _, k := range keys {
+				if ok, _ := d.db.Has(pack(k[0], k[1], ref), nil); ok {
+					continue BLOB
+				}
+			}
+			ch <- ref
+		}
+	}()
+	return ch
+}
+
+// AllRefs streams, in order and once each, every ref that appears in
+// the found, missing, dependency, type, MIME type, extension or
+// tombstone indexes. This scans nearly the whole index, merging one
+// ordered range per index and per type, MIME type and extension.
+// Refs appearing only in attributes aren't included.
+func (d *DB) AllRefs() <-chan string {
+	var (
+		rngs   []*util.Range
+		refPos []int
+	)
+	for _, prefix := range []string{found, missing, parent, child, tombstone} {
+		rngs = append(rngs, util.BytesPrefix(pack(prefix, "")))
+		refPos = append(refPos, 1)
+	}
+	for _, prefix := range []string{camliType, mimeType, extension} {
+		for _, kind := range d.kinds(prefix) {
+			rngs = append(rngs, util.BytesPrefix(pack(prefix, kind, "")))
+			refPos = append(refPos, 2)
 		}
 	}
+	ch := make(chan string)
+	go d.streamMergedAt(context.Background(), ch, refPos, rngs)
+	return ch
+}
+
+// kinds returns the distinct values of the first field following
+// prefix, skipping over the entries for each value.
+func (d *DB) kinds(prefix string) (kinds []string) {
 	it := d.db.NewIterator(&util.Range{
-		Start: pack(missing, ref, start),
-		Limit: pack(missing, ref, limit),
+		Start: pack(prefix, start),
+		Limit: pack(prefix, limit),
 	}, nil)
 	defer it.Release()
-	for it.Next() {
-		b.Delete(it.Key())
-	}
-	if err := it.Error(); err != nil {
-		fmt.Println(err)
+	for ok := it.Next(); ok; ok = it.Seek(pack(prefix, kinds[len(kinds)-1], limit)) {
+		kinds = append(kinds, unpack(it.Key())[1])
 	}
-	err = d.db.Write(b, nil)
 	return
 }
 
-// Last returns the last location successfully Placed.
-func (d *DB) Last() string {
-	if data, err := d.db.Get(pack(last), nil); err == nil {
-		return string(data)
-	} else {
-		log.Print(err)
+// streamMerged streams the refs from several ranges, each of which
+// must be ordered by ref, as a single ordered stream without
+// duplicates, stopping early once ctx is done. The ref of each key is
+// its refPos'th field.
+func (d *DB) streamMerged(ctx context.Context, ch chan<- string, refPos int, rngs []*util.Range) {
+	pos := make([]int, len(rngs))
+	for i := range pos {
+		pos[i] = refPos
 	}
-	return ""
-}
-
-// Missing streams the currently unknown blobs.
-func (d *DB) Missing() <-chan string {
-	ch := make(chan string)
-	go d.streamBlobs(ch, 1, &util.Range{
-		Start: pack(missing, start),
-		Limit: pack(missing, limit),
-	})
-	return ch
+	d.streamMergedAt(ctx, ch, pos, rngs)
 }
 
-// List streams all known blobs of a particular type.
-func (d *DB) List(ct string) <-chan string {
-	var rng util.Range
-	if ct != "" {
-		rng.Start = pack(camliType, ct, start)
-		rng.Limit = pack(camliType, ct, limit)
-	} else {
-		rng.Start = pack(camliType, start)
-		rng.Limit = pack(camliType, limit)
+// streamMergedAt is streamMerged, where the ref of each key of
+// rngs[i] is its refPos[i]'th field.
+func (d *DB) streamMergedAt(ctx context.Context, ch chan<- string, refPos []int, rngs []*util.Range) {
+	defer close(ch)
+	its := make([]iterator.Iterator, 0, len(rngs))
+	refs := make([]string, 0, len(rngs))
+	pos := make([]int, 0, len(rngs))
+	for i, rng := range rngs {
+		it := d.db.NewIterator(rng, nil)
+		defer it.Release()
+		if it.Next() {
+			its = append(its, it)
+			refs = append(refs, unpack(it.Key())[refPos[i]])
+			pos = append(pos, refPos[i])
+		}
+	}
+	for len(its) > 0 {
+		min := 0
+		for i := range refs {
+			if refs[i] < refs[min] {
+				min = i
+			}
+		}
+		ref := refs[min]
+		select {
+		case ch <- ref:
+		case <-ctx.Done():
+			return
+		}
+		// advance every iterator past ref
+		for i := 0; i < len(its); i++ {
+			for refs[i] == ref {
+				if !its[i].Next() {
+					its = append(its[:i], its[i+1:]...)
+					refs = append(refs[:i], refs[i+1:]...)
+					pos = append(pos[:i], pos[i+1:]...)
+					i--
+					break
+				}
+				refs[i] = unpack(its[i].Key())[pos[i]]
+			}
+		}
+	}
+	for _, it := range its {
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: stream: %s", err)
+		}
 	}
-	ch := make(chan string)
-	go d.streamBlobs(ch, 2, &rng)
-	return ch
 }
 
-// ListMIME streams all known files of a particular MIME type.
-func (d *DB) ListMIME(mt string) <-chan string {
-	ch := make(chan string)
-	go d.streamBlobs(ch, 2, &util.Range{
-		Start: pack(mimeType, mt, start),
-		Limit: pack(mimeType, mt, limit),
+// streamBlobs streams the ref in the refPos'th field of each key in
+// rng, stopping early once ctx is done. If distinct, a ref repeated by
+// adjacent keys, such as malformed ones with extra fields, is sent
+// once; otherwise, as for the missing index, once per key.
+func (d *DB) streamBlobs(ctx context.Context, ch chan<- string, refPos int, rng *util.Range, distinct bool) {
+	defer close(ch)
+	var prev string
+	err := d.scanRefs(refPos, rng, func(ref string) bool {
+		if distinct && ref == prev {
+			return true
+		}
+		prev = ref
+		select {
+		case ch <- ref:
+			return true
+		case <-ctx.Done():
+			return false
+		}
 	})
-	return ch
+	if err != nil {
+		errorLog.Printf("db: stream: %s", err)
+	}
 }
 
-func (d *DB) streamBlobs(ch chan<- string, refPos int, rng *util.Range) {
-	defer close(ch)
-	it := d.db.NewIterator(rng, nil)
-	defer it.Release()
+// scanRefs calls fn with the ref in the refPos'th field of each key in
+// rng until fn returns false, returning the iterator's error, if any.
+func (d *DB) scanRefs(refPos int, rng *util.Range, fn func(ref string) bool) error {
+	p := d.newProgress()
+	defer p.done()
+	it := d.newRefIterator(refPos, rng)
+	defer it.Close()
 	for it.Next() {
-		parts := unpack(it.Key())
-		ch <- parts[refPos]
+		p.tick()
+		if !fn(it.Ref()) {
+			return nil
+		}
 	}
+	return it.Err()
 }
 
 type Stats struct {
-	Blobs, Links, Missing, Unknown uint64
-	CamliTypes, MIMETypes          map[string]int64
+	Blobs, Links, Missing, Unknown    uint64
+	CamliTypes, MIMETypes, Extensions map[string]int64
+	// Duplicates is the number of found blobs Placed at more than one
+	// location.
+	Duplicates uint64
+	// TotalBytes is the total size of the blobs of known size, as
+	// given to PlaceBlob, and CamliTypeBytes the same by camliType.
+	TotalBytes     uint64
+	CamliTypeBytes map[string]uint64
+	// Malformed is the number of keys of known indexes with the wrong
+	// number of fields, which queries skip. Only Stats computes it.
+	Malformed uint64
 }
 
 func (s Stats) String() string {
-	return fmt.Sprintf("%d blobs, %d links, %d missing; %d unknown index entries",
-		s.Blobs, s.Links, s.Missing, s.Unknown)
+	str := fmt.Sprintf("%d blobs, %d links, %d missing; %d unknown and %d malformed index entries; %d bytes",
+		s.Blobs, s.Links, s.Missing, s.Unknown, s.Malformed, s.TotalBytes)
+	cts := make([]string, 0, len(s.CamliTypeBytes))
+	for ct := range s.CamliTypeBytes {
+		cts = append(cts, ct)
+	}
+	sort.Strings(cts)
+	for i, ct := range cts {
+		sep := ", "
+		if i == 0 {
+			sep = " ("
+		}
+		str += fmt.Sprintf("%s%s %d", sep, ct, s.CamliTypeBytes[ct])
+	}
+	if len(cts) > 0 {
+		str += ")"
+	}
+	return str
 }
 
-// Stats scans the entire index counting various things.
+// newStats returns an empty Stats with its maps made.
+func newStats() Stats {
+	return Stats{
+		CamliTypes:     make(map[string]int64),
+		MIMETypes:      make(map[string]int64),
+		Extensions:     make(map[string]int64),
+		CamliTypeBytes: make(map[string]uint64),
+	}
+}
+
+// add adds the counts of o to s, whose maps must be made.
+func (s *Stats) add(o Stats) {
+	s.Blobs += o.Blobs
+	s.Links += o.Links
+	s.Missing += o.Missing
+	s.Unknown += o.Unknown
+	s.Malformed += o.Malformed
+	s.Duplicates += o.Duplicates
+	s.TotalBytes += o.TotalBytes
+	for ct, n := range o.CamliTypeBytes {
+		s.CamliTypeBytes[ct] += n
+	}
+	for _, c := range []struct{ to, from map[string]int64 }{
+		{s.CamliTypes, o.CamliTypes},
+		{s.MIMETypes, o.MIMETypes},
+		{s.Extensions, o.Extensions},
+	} {
+		for k, n := range c.from {
+			c.to[k] += n
+		}
+	}
+}
+
+// addBytes counts the size of ref, if known, in s.
+func (s *Stats) addBytes(d *DB, cts []string, ref string, r foundRecord) {
+	if r.Size < 0 {
+		return
+	}
+	s.TotalBytes += uint64(r.Size)
+	for _, ct := range d.kindsOf(camliType, cts, ref) {
+		s.CamliTypeBytes[ct] += uint64(r.Size)
+	}
+}
+
+// Stats scans the entire index counting various things. Attributing
+// sizes to camliTypes costs a lookup per camliType for every found
+// blob of known size.
 func (d *DB) Stats() (s Stats) {
-	s.CamliTypes = make(map[string]int64)
-	s.MIMETypes = make(map[string]int64)
-	it := d.db.NewIterator(nil, nil)
+	s, _ = d.StatsProgress(context.Background(), nil)
+	return
+}
+
+// statsCheckEvery is how many entries StatsProgress scans between
+// checks of its context, and calls of its progress func unless
+// TrackProgress set another interval.
+const statsCheckEvery = 10000
+
+// statsPrefixes are the indexes that StatsProgress scans in
+// goroutines of their own, being those with an entry per blob or
+// dependency. The keys before, between and after them are scanned by
+// one more goroutine each.
+var statsPrefixes = []string{found, parent, child, missing, camliType, mimeType}
+
+// statsRanges partitions the whole index into the ranges of
+// statsPrefixes and those between them, in key order.
+func statsRanges() []*util.Range {
+	prefixes := append([]string(nil), statsPrefixes...)
+	sort.Strings(prefixes)
+	var rngs []*util.Range
+	var prev []byte
+	for _, prefix := range prefixes {
+		lo, hi := pack(prefix, start), pack(prefix, limit)
+		rngs = append(rngs, &util.Range{Start: prev, Limit: lo}, &util.Range{Start: lo, Limit: hi})
+		prev = hi
+	}
+	return append(rngs, &util.Range{Start: prev})
+}
+
+// StatsProgress is Stats, calling progress, if not nil, in place of
+// any func set by TrackProgress. The ranges of statsRanges are scanned
+// concurrently, against a snapshot of the index, and their counts
+// summed. If ctx is done before the scan finishes, it returns the
+// counts of the entries scanned so far with ctx's error.
+func (d *DB) StatsProgress(ctx context.Context, progress func(scanned uint64)) (s Stats, err error) {
+	s = newStats()
+	f, release, err := d.frozen()
+	if err != nil {
+		return s, err
+	}
+	defer release()
+	cts := f.kinds(camliType)
+	p := d.newProgress()
+	if progress != nil {
+		every := d.progressEvery
+		if every == 0 {
+			every = statsCheckEvery
+		}
+		p = &scanProgress{fn: progress, every: every}
+	}
+	defer p.done()
+	rngs := statsRanges()
+	parts := make([]Stats, len(rngs))
+	errs := make([]error, len(rngs))
+	var wg sync.WaitGroup
+	for i, rng := range rngs {
+		wg.Add(1)
+		go func(i int, rng *util.Range) {
+			defer wg.Done()
+			parts[i], errs[i] = f.statsRange(ctx, rng, cts, p)
+		}(i, rng)
+	}
+	wg.Wait()
+	for i := range parts {
+		s.add(parts[i])
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	return s, err
+}
+
+// statsRange counts the entries of rng for StatsProgress.
+func (d *DB) statsRange(ctx context.Context, rng *util.Range, cts []string, p *scanProgress) (s Stats, err error) {
+	s = newStats()
+	it := d.db.NewIterator(rng, nil)
 	defer it.Release()
-	for it.Next() {
-		parts := unpack(it.Key())
+	for n := 1; it.Next(); n++ {
+		if n%statsCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return s, err
+			}
+		}
+		p.tick()
+		parts, ok := keyFields(it.Key())
+		if _, known := keySpecs[parts[0]]; known && !ok {
+			s.Malformed++
+			continue
+		}
 		switch parts[0] {
-		case last:
+		case last, checkpoint, recent, tombstone, attr, source, verified, lastVerified, derivative, done, schema, geo, taken, located:
 		case found:
 			s.Blobs++
+			if r, err := decodeFound(it.Value()); err == nil {
+				if len(r.Duplicates) > 0 {
+					s.Duplicates++
+				}
+				s.addBytes(d, cts, parts[1], r)
+			}
 		case parent:
 			s.Links++
+		case child:
 		case missing:
 			s.Missing++
 		case camliType:
 			s.CamliTypes[parts[1]]++
 		case mimeType:
 			s.MIMETypes[parts[1]]++
+		case extension:
+			s.Extensions[parts[1]]++
 		default:
 			s.Unknown++
 		}
 	}
+	return s, it.Error()
+}
+
+// StatsForLocation is Stats for just the found blobs whose location
+// starts with prefix, such as those in a pack file: Blobs counts them,
+// TotalBytes their known sizes, Links and Missing their dependencies
+// and those that are missing, and the type maps them by type. Unknown
+// is always 0. Locations are only in found values, so this is a full
+// scan of the found range, filtering each value.
+func (d *DB) StatsForLocation(prefix string) (s Stats, err error) {
+	s = newStats()
+	kinds := []struct {
+		prefix string
+		kinds  []string
+		counts map[string]int64
+	}{
+		{camliType, d.kinds(camliType), s.CamliTypes},
+		{mimeType, d.kinds(mimeType), s.MIMETypes},
+		{extension, d.kinds(extension), s.Extensions},
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	for it.Next() {
+		p.tick()
+		ref := unpack(it.Key())[1]
+		r, err := decodeFound(it.Value())
+		if err != nil {
+			return s, fmt.Errorf("%s: %s", ref, err)
+		}
+		if !strings.HasPrefix(r.Location, prefix) {
+			continue
+		}
+		s.Blobs++
+		if len(r.Duplicates) > 0 {
+			s.Duplicates++
+		}
+		s.addBytes(d, kinds[0].kinds, ref, r)
+		for _, k := range kinds {
+			for _, kind := range d.kindsOf(k.prefix, k.kinds, ref) {
+				k.counts[kind]++
+			}
+		}
+		deps, err := d.Children(ref)
+		if err != nil {
+			return s, err
+		}
+		for _, dep := range deps {
+			s.Links++
+			if ok, _ := d.db.Has(pack(missing, dep, ref), nil); ok {
+				s.Missing++
+			}
+		}
+	}
+	return s, it.Error()
+}
+
+// SizeStat summarizes the sizes of a group of blobs.
+type SizeStat struct {
+	Count, Total, Max int64
+	// Unsized counts blobs with no recorded size, which are
+	// excluded from the other fields.
+	Unsized int64
+}
+
+func (s *SizeStat) add(size int64) {
+	if size < 0 {
+		s.Unsized++
+		return
+	}
+	s.Count++
+	s.Total += size
+	if size > s.Max {
+		s.Max = size
+	}
+}
+
+// Mean returns the average size of blobs with a recorded size.
+func (s SizeStat) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Total) / float64(s.Count)
+}
+
+func (s SizeStat) String() string {
+	return fmt.Sprintf("%d blobs, %d bytes (mean %.0f, max %d); %d unsized",
+		s.Count, s.Total, s.Mean(), s.Max, s.Unsized)
+}
+
+const (
+	// AgeUnknown is the AgeHistogram bucket of blobs with no recorded
+	// time of indexing.
+	AgeUnknown time.Duration = -1
+	// AgeOlder is the AgeHistogram bucket of blobs indexed before the
+	// largest bucket.
+	AgeOlder time.Duration = math.MaxInt64
+)
+
+// AgeHistogram counts found blobs by how long ago they were indexed.
+// Each blob is counted in the smallest of buckets at least its age, or
+// else in AgeOlder or AgeUnknown; eg, buckets of an hour, a day and a
+// week count blobs indexed in the last hour, the hour to a day before
+// that, and so on.
+func (d *DB) AgeHistogram(buckets []time.Duration) (map[time.Duration]int64, error) {
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	counts := make(map[time.Duration]int64)
+	now := time.Now()
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		r, err := decodeFound(it.Value())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", unpack(it.Key())[1], err)
+		}
+		if r.Indexed.IsZero() {
+			counts[AgeUnknown]++
+			continue
+		}
+		age := now.Sub(r.Indexed)
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i] >= age })
+		if i == len(buckets) {
+			counts[AgeOlder]++
+		} else {
+			counts[buckets[i]]++
+		}
+	}
+	return counts, it.Error()
+}
+
+// RefDistribution counts found blobs by the first prefixLen hex digits
+// of their digests, whatever their hash. Digests shorter than
+// prefixLen are counted whole.
+func (d *DB) RefDistribution(prefixLen int) (map[string]int64, error) {
+	if prefixLen <= 0 {
+		return nil, fmt.Errorf("db: prefix length %d isn't positive", prefixLen)
+	}
+	counts := make(map[string]int64)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		ref := unpack(it.Key())[1]
+		digest := ref[strings.IndexByte(ref, '-')+1:]
+		if len(digest) > prefixLen {
+			digest = digest[:prefixLen]
+		}
+		counts[digest]++
+	}
+	return counts, it.Error()
+}
+
+// SizeStats groups the sizes of blobs by camliType and by MIME type.
+type SizeStats struct {
+	CamliTypes, MIMETypes map[string]*SizeStat
+}
+
+// SizeStats scans the type and MIME indexes, looking up the size of
+// every blob in each.
+func (d *DB) SizeStats() (s SizeStats, err error) {
+	if s.CamliTypes, err = d.sizeStats(camliType); err != nil {
+		return
+	}
+	s.MIMETypes, err = d.sizeStats(mimeType)
 	return
 }
 
+func (d *DB) sizeStats(prefix string) (map[string]*SizeStat, error) {
+	stats := make(map[string]*SizeStat)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(prefix, start),
+		Limit: pack(prefix, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts, ok := keyFields(it.Key())
+		if !ok {
+			continue
+		}
+		f, err := d.getFound(parts[2])
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, ok := stats[parts[1]]
+		if !ok {
+			s = new(SizeStat)
+			stats[parts[1]] = s
+		}
+		s.add(f.Size)
+	}
+	return stats, it.Error()
+}
+
 // Parents returns all immediate parents of a blob ref.
 func (d *DB) Parents(ref string) (parents []string, err error) {
+	ref = d.lookupRef(ref)
 	it := d.db.NewIterator(&util.Range{
 		Start: pack(parent, ref, start),
 		Limit: pack(parent, ref, limit),
@@ -193,44 +2421,275 @@ func (d *DB) Parents(ref string) (parents []string, err error) {
 	return
 }
 
+// RootsOf returns the distinct ancestors of a blob ref that have no
+// parents themselves, in sorted order; this is ref itself if it has no
+// parents. Each ancestor is visited once, so cycles terminate.
+func (d *DB) RootsOf(ref string) ([]string, error) {
+	ref = d.lookupRef(ref)
+	var roots []string
+	seen := map[string]bool{ref: true}
+	for queue := []string{ref}; len(queue) > 0; queue = queue[1:] {
+		parents, err := d.Parents(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) == 0 {
+			roots = append(roots, queue[0])
+		}
+		for _, p := range parents {
+			if !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// Ancestors returns the distinct transitive parents of a blob ref, in
+// sorted order, excluding ref itself unless it is on a cycle. Unlike
+// enumerating StreamAllParentPaths, each ancestor is visited once, so
+// this is linear in the number of ancestors and their edges.
+func (d *DB) Ancestors(ref string) ([]string, error) {
+	ref = d.lookupRef(ref)
+	var ancestors []string
+	seen := map[string]bool{}
+	for queue := []string{ref}; len(queue) > 0; queue = queue[1:] {
+		parents, err := d.Parents(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parents {
+			if !seen[p] {
+				seen[p] = true
+				ancestors = append(ancestors, p)
+				queue = append(queue, p)
+			}
+		}
+	}
+	sort.Strings(ancestors)
+	return ancestors, nil
+}
+
 // StreamAllParentPaths resolves and returns all complete parent paths
-// for a blob ref.
+// for a blob ref. Each path sent is a slice of its own. If a path
+// reaches a blob already on it, the walk stops with a *CycleError,
+// having sent the paths found before it. The walk reads a snapshot of
+// the index, so every path is of the same graph however it's being
+// written; use Reader for several queries of the same snapshot.
 func (d *DB) StreamAllParentPaths(ref string, ch chan<- []string) error {
-	return d.streamAllParentPaths(nil, ref, ch)
+	return d.StreamAllParentPathsContext(context.Background(), ref, ch)
 }
 
-func (d *DB) streamAllParentPaths(path []string, ref string, ch chan<- []string) error {
-	parents, err := d.Parents(ref)
+// StreamAllParentPathsContext is StreamAllParentPaths, stopping with
+// ctx's error once ctx is done.
+func (d *DB) StreamAllParentPathsContext(ctx context.Context, ref string, ch chan<- []string) error {
+	ref = d.lookupRef(ref)
+	r, release, err := d.frozen()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return r.walkParentPaths(nil, ref, map[string]bool{ref: true}, func(path []string) error {
+		select {
+		case ch <- append([]string(nil), path...):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// CycleError is returned by the parent path walks when Parent, a
+// parent of Ref, is already on the path being walked.
+type CycleError struct {
+	Ref, Parent string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("db: parent paths cycle: %s, a parent of %s, is already on the path", e.Parent, e.Ref)
+}
+
+// StreamParentPathStrings is StreamAllParentPaths, with each path
+// joined by delim and each blob annotated with its camliType, if it has
+// one. The index doesn't record file names, so those aren't shown.
+func (d *DB) StreamParentPathStrings(ref, delim string, ch chan<- string) error {
+	ref = d.lookupRef(ref)
+	types := d.kinds(camliType)
+	annotated := map[string]string{}
+	annotate := func(ref string) string {
+		if a, ok := annotated[ref]; ok {
+			return a
+		}
+		a := ref
+		for _, ct := range types {
+			if ok, _ := d.db.Has(pack(camliType, ct, ref), nil); ok {
+				a = fmt.Sprintf("%s (%s)", ref, ct)
+				break
+			}
+		}
+		annotated[ref] = a
+		return a
+	}
+	return d.walkParentPaths(nil, ref, map[string]bool{ref: true}, func(path []string) error {
+		parts := make([]string, len(path))
+		for i, p := range path {
+			parts[i] = annotate(p)
+		}
+		ch <- strings.Join(parts, delim)
+		return nil
+	})
+}
+
+// ErrPathsTruncated is returned by StreamParentPathsLimit when there
+// were more paths than it was allowed to send.
+var ErrPathsTruncated = errors.New("db: too many parent paths")
+
+// StreamParentPathsLimit is StreamAllParentPaths, sending at most max
+// paths and then returning ErrPathsTruncated if there are more, for
+// callers that only want a sample of how a heavily shared blob is
+// reached.
+func (d *DB) StreamParentPathsLimit(ref string, max int, ch chan<- []string) error {
+	ref = d.lookupRef(ref)
+	n := 0
+	return d.walkParentPaths(nil, ref, map[string]bool{ref: true}, func(path []string) error {
+		if n == max {
+			return ErrPathsTruncated
+		}
+		n++
+		ch <- append([]string(nil), path...)
+		return nil
+	})
+}
+
+// ParentPath is a parent path sent by StreamParentPaths.
+type ParentPath struct {
+	// Path is the blobs from a parent of the ref through an ancestor,
+	// as sent by StreamAllParentPaths.
+	Path []string
+	// Truncated is set if the path reached the depth limit before an
+	// ancestor without parents, so that its last blob has parents
+	// that weren't followed.
+	Truncated bool
+}
+
+// StreamParentPaths is StreamAllParentPaths, except that paths stop
+// once they are maxDepth blobs long, and are sent marked Truncated if
+// their last blob has parents. A maxDepth of 0 is no limit. Since
+// parents beyond the limit aren't followed, neither are any cycles
+// through them.
+func (d *DB) StreamParentPaths(ref string, maxDepth int, ch chan<- ParentPath) error {
+	ref = d.lookupRef(ref)
+	r, release, err := d.frozen()
 	if err != nil {
 		return err
 	}
-	if len(parents) == 0 {
-		ch <- path
+	defer release()
+	return r.walkParentPathsDepth(nil, ref, map[string]bool{ref: true}, maxDepth, func(path []string, truncated bool) error {
+		ch <- ParentPath{Path: append([]string(nil), path...), Truncated: truncated}
 		return nil
+	})
+}
+
+// walkParentPaths calls fn with each complete parent path of ref,
+// prefixed by path, stopping with fn's error if it returns one, or a
+// *CycleError if a parent is in onPath, the blobs on path and ref. fn
+// must not retain its argument.
+func (d *DB) walkParentPaths(path []string, ref string, onPath map[string]bool, fn func([]string) error) error {
+	return d.walkParentPathsDepth(path, ref, onPath, 0, func(path []string, _ bool) error {
+		return fn(path)
+	})
+}
+
+// walkParentPathsDepth is walkParentPaths, except that paths of
+// maxDepth blobs, if it isn't 0, are passed to fn as they are, with
+// whether ref has parents.
+func (d *DB) walkParentPathsDepth(path []string, ref string, onPath map[string]bool, maxDepth int, fn func(path []string, truncated bool) error) error {
+	parents, err := d.Parents(ref)
+	if err != nil {
+		return err
+	}
+	if len(parents) == 0 || maxDepth > 0 && len(path) >= maxDepth {
+		return fn(path, len(parents) > 0)
 	}
 	for _, parent := range parents {
-		if err := d.streamAllParentPaths(append(path, parent), parent, ch); err != nil {
+		if onPath[parent] {
+			return &CycleError{Ref: ref, Parent: parent}
+		}
+		onPath[parent] = true
+		err := d.walkParentPathsDepth(append(path, parent), parent, onPath, maxDepth, fn)
+		delete(onPath, parent)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (d *DB) Close() {
-	if err := d.db.Close(); err != nil {
-		log.Print(err)
-	}
+func (d *DB) Close() error {
+	return d.db.Close()
 }
 
+// pack joins prefix and fields with sep, escaping each as escapeField
+// does.
 func pack(prefix string, fields ...string) []byte {
-	b := bytes.NewBufferString(prefix)
+	b := new(bytes.Buffer)
+	escapeField(b, prefix)
 	for _, f := range fields {
-		b.WriteByte('|')
-		b.WriteString(f)
+		b.WriteByte(sep)
+		escapeField(b, f)
 	}
 	return b.Bytes()
 }
 
+// unpack splits a key packed by pack into its prefix and fields.
 func unpack(bts []byte) []string {
-	return strings.Split(string(bts), "|")
+	parts := strings.Split(string(bts), string(sep))
+	for i, p := range parts {
+		parts[i] = unescapeField(p)
+	}
+	return parts
+}
+
+// escapeField writes f to b with each sep replaced by esc 0x01, and
+// each esc by esc 0x02. Both escapes sort after sep and before every
+// other byte, as the bytes they replace do, so packed keys sort as
+// their fields do.
+func escapeField(b *bytes.Buffer, f string) {
+	for i := 0; i < len(f); i++ {
+		switch c := f[i]; c {
+		case sep:
+			b.WriteByte(esc)
+			b.WriteByte(0x01)
+		case esc:
+			b.WriteByte(esc)
+			b.WriteByte(0x02)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// unescapeField reverses escapeField. An esc followed by anything
+// else is left alone.
+func unescapeField(f string) string {
+	if strings.IndexByte(f, esc) < 0 {
+		return f
+	}
+	b := make([]byte, 0, len(f))
+	for i := 0; i < len(f); i++ {
+		c := f[i]
+		if c == esc && i+1 < len(f) {
+			switch f[i+1] {
+			case 0x01:
+				c = sep
+				i++
+			case 0x02:
+				i++
+			}
+		}
+		b = append(b, c)
+	}
+	return string(b)
 }
@@ -0,0 +1,966 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newTestDB returns an empty index in a temporary directory, closed
+// when the test ends.
+func newTestDB(t testing.TB) *DB {
+	d, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// ref returns the ref of a blob holding name.
+func ref(name string) string {
+	return fmt.Sprintf("sha1-%x", sha1.Sum([]byte(name)))
+}
+
+// place Places ref, named by ref, at location, failing t on error.
+func place(t testing.TB, d *DB, name, location, ct string, deps ...string) {
+	t.Helper()
+	refs := make([]string, len(deps))
+	for i, dep := range deps {
+		refs[i] = ref(dep)
+	}
+	if err := d.Place(ref(name), location, ct, refs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collect drains ch.
+func collect(ch <-chan string) []string {
+	refs := []string{}
+	for r := range ch {
+		refs = append(refs, r)
+	}
+	return refs
+}
+
+func TestPlaceUnknownLocation(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "pack 0", "")
+	if err := d.PlaceBlob(PlaceEntry{Ref: ref("a"), Type: "file", Size: 10, SkipLast: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PlaceBlob(PlaceEntry{Ref: ref("b"), Size: 10, SkipLast: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Location(ref("a")); err != nil || got != "pack 0" {
+		t.Errorf("Location(a) = %q, %v; want the one it was first Placed at", got, err)
+	}
+	if got := collect(d.BlobsAt("")); len(got) != 0 {
+		t.Errorf("BlobsAt(\"\") = %q, want none", got)
+	}
+	if got := collect(d.List("file")); len(got) != 1 {
+		t.Errorf("List(file) = %q, want a", got)
+	}
+	if got, err := d.Last(); err != nil || got != "pack 0" {
+		t.Errorf("Last = %q, %v; want pack 0", got, err)
+	}
+}
+
+// BenchmarkPlace measures Placing blobs that no other blob is waiting
+// on, the common case of a bulk index build, and blobs that each have
+// a dependent noted as missing.
+func BenchmarkPlace(b *testing.B) {
+	b.Run("no-dependents", func(b *testing.B) {
+		d := newTestDB(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := d.Place(ref(fmt.Sprint(i)), "loc", "", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("missing-dependent", func(b *testing.B) {
+		d := newTestDB(b)
+		for i := 0; i < b.N; i++ {
+			if err := d.Place(ref(fmt.Sprint("parent", i)), "loc", "file", []string{ref(fmt.Sprint(i))}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := d.Place(ref(fmt.Sprint(i)), "loc", "", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// parentPaths returns the parent paths StreamAllParentPaths sends for
+// name, and its error, failing t if it doesn't return promptly.
+func parentPaths(t *testing.T, d *DB, name string) ([][]string, error) {
+	t.Helper()
+	ch := make(chan []string)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.StreamAllParentPaths(ref(name), ch)
+		close(ch)
+	}()
+	var paths [][]string
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return paths, <-errc
+			}
+			paths = append(paths, p)
+		case <-time.After(10 * time.Second):
+			t.Fatal("StreamAllParentPaths didn't return")
+		}
+	}
+}
+
+func TestStreamAllParentPathsCycle(t *testing.T) {
+	d := newTestDB(t)
+	// a depends on b, b on c, and c on a
+	place(t, d, "a", "loc", "directory", "b")
+	place(t, d, "b", "loc", "directory", "c")
+	place(t, d, "c", "loc", "directory", "a")
+
+	_, err := parentPaths(t, d, "a")
+	var cycle *CycleError
+	if !errors.As(err, &cycle) {
+		t.Fatalf("StreamAllParentPaths = %v, want a *CycleError", err)
+	}
+	if cycle.Parent != ref("a") || cycle.Ref != ref("b") {
+		t.Errorf("CycleError = %+v, want a, a parent of b", cycle)
+	}
+}
+
+func TestStreamAllParentPathsDiamond(t *testing.T) {
+	d := newTestDB(t)
+	// root depends on l and r, both of which depend on leaf
+	place(t, d, "root", "loc", "directory", "l", "r")
+	place(t, d, "l", "loc", "directory", "leaf")
+	place(t, d, "r", "loc", "directory", "leaf")
+	place(t, d, "leaf", "loc", "file")
+
+	paths, err := parentPaths(t, d, "leaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range paths {
+		got = append(got, strings.Join(p, " "))
+	}
+	sort.Strings(got)
+	want := []string{ref("l") + " " + ref("root"), ref("r") + " " + ref("root")}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths = %q, want %q", got, want)
+	}
+	// the paths were collected before being compared, so a later send
+	// reusing an earlier one's array would have shown above; check
+	// writing to one doesn't show in the other either
+	paths[0][0] = "x"
+	if paths[1][0] == "x" {
+		t.Error("paths share an array")
+	}
+}
+
+func TestForgetNotesMissing(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p1", "loc", "directory", "a")
+	place(t, d, "p2", "loc", "directory", "a")
+	// a depends on c, which was never found
+	place(t, d, "a", "loc", "file", "c")
+
+	if err := d.Forget(ref("a")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(ref("a")); err != nil || ok {
+		t.Errorf("Has(a) = %v, %v after Forget", ok, err)
+	}
+	got, err := d.MissingDependents(ref("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := refs("p1", "p2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingDependents(a) = %q, want %q", got, want)
+	}
+	var missing []MissingBlob
+	for m := range d.MissingWithParents() {
+		missing = append(missing, m)
+	}
+	if want := []MissingBlob{{Ref: ref("a"), Parents: refs("p1", "p2")}}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("MissingWithParents = %+v, want only a, for both parents", missing)
+	}
+	if got, err := d.Children(ref("a")); err != nil || len(got) != 0 {
+		t.Errorf("Children(a) = %q, %v after Forget", got, err)
+	}
+}
+
+func TestListContextCancel(t *testing.T) {
+	d := newTestDB(t)
+	// progress is reported once the scan's iterator is released, and
+	// at no multiple of every before then
+	finished := make(chan uint64, 1)
+	d.TrackProgress(1000, func(scanned uint64) { finished <- scanned })
+	for i := 0; i < 100; i++ {
+		place(t, d, fmt.Sprint(i), "loc", "file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := d.ListContext(ctx, "file")
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	cancel()
+	timeout := time.After(10 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-ch:
+		case <-timeout:
+			t.Fatal("stream wasn't closed after cancel")
+		}
+	}
+	select {
+	case n := <-finished:
+		if n >= 100 {
+			t.Errorf("scanned %d entries after cancel, want fewer than all", n)
+		}
+	case <-timeout:
+		t.Fatal("scan didn't finish after cancel")
+	}
+}
+
+func TestBlobsReadError(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "loc", "file", "b")
+	// iterators of a closed leveldb.DB fail with ErrClosed
+	if err := d.db.cur.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, ch := range map[string]<-chan Blob{
+		"ListBlobs":     d.ListBlobs(context.Background(), "file"),
+		"ListMIMEBlobs": d.ListMIMEBlobs(context.Background(), ""),
+		"MissingBlobs":  d.MissingBlobs(context.Background()),
+	} {
+		var got []Blob
+		for b := range ch {
+			got = append(got, b)
+		}
+		if len(got) != 1 || got[0].Err != leveldb.ErrClosed {
+			t.Errorf("%s = %+v, want just ErrClosed", name, got)
+		}
+	}
+}
+
+func TestMissingWithParents(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p1", "loc", "directory", "m1", "m2")
+	place(t, d, "p2", "loc", "directory", "m1", "found")
+	place(t, d, "found", "loc", "file")
+
+	var got []MissingBlob
+	for m := range d.MissingWithParents() {
+		got = append(got, m)
+	}
+	want := []MissingBlob{
+		{Ref: ref("m1"), Parents: refs("p1", "p2")},
+		{Ref: ref("m2"), Parents: refs("p1")},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Ref < want[j].Ref })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingWithParents = %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsSizes(t *testing.T) {
+	d := newTestDB(t)
+	for _, e := range []PlaceEntry{
+		{Ref: ref("f1"), Location: "loc", Type: "file", Size: 10},
+		{Ref: ref("f2"), Location: "loc", Type: "file", Size: 20},
+		{Ref: ref("d"), Location: "loc", Type: "directory", Size: 5},
+		{Ref: ref("unknown"), Location: "loc", Type: "file", Size: -1},
+		// Placing again without a size keeps the known one
+		{Ref: ref("f1"), Location: "loc2", Type: "file", Size: -1},
+	} {
+		if err := d.PlaceBlob(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := d.Stats()
+	if s.TotalBytes != 35 {
+		t.Errorf("TotalBytes = %d, want 35", s.TotalBytes)
+	}
+	if want := map[string]uint64{"file": 30, "directory": 5}; !reflect.DeepEqual(s.CamliTypeBytes, want) {
+		t.Errorf("CamliTypeBytes = %v, want %v", s.CamliTypeBytes, want)
+	}
+	if str := s.String(); !strings.HasSuffix(str, "; 35 bytes (directory 5, file 30)") {
+		t.Errorf("String = %q, want the sizes", str)
+	}
+}
+
+func TestLastCloseErrors(t *testing.T) {
+	d, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Last(); err != nil || got != "" {
+		t.Errorf("Last of an empty index = %q, %v; want none", got, err)
+	}
+	place(t, d, "a", "loc", "file")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Last(); err != leveldb.ErrClosed {
+		t.Errorf("Last of a closed index = %q, %v; want ErrClosed", got, err)
+	}
+	if err := d.Close(); err != leveldb.ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		place(t, d, fmt.Sprint(i), "loc", "file")
+	}
+	for i := 0; i < 500; i += 2 {
+		if err := d.Forget(ref(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(d.List("file")); len(got) != 250 {
+		t.Errorf("List(file) after Compact = %d refs, want 250", len(got))
+	}
+	if ok, err := d.Has(ref("1")); err != nil || !ok {
+		t.Errorf("Has(1) after Compact = %v, %v", ok, err)
+	}
+	d.Close()
+
+	ro, err := NewRO(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.Compact(); err != ErrReadOnly {
+		t.Errorf("read-only Compact = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestPruneMissing(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p", "loc", "directory", "m")
+	b := new(leveldb.Batch)
+	// q has no parent entry for m, and gone, which has, isn't found
+	b.Put(pack(missing, ref("m"), ref("q")), nil)
+	b.Put(pack(parent, ref("m"), ref("gone")), nil)
+	b.Put(pack(missing, ref("m"), ref("gone")), nil)
+	if err := d.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := d.PruneMissing(); err != nil || removed != 2 {
+		t.Errorf("PruneMissing = %d, %v; want 2", removed, err)
+	}
+	if got, err := d.MissingDependents(ref("m")); err != nil || !reflect.DeepEqual(got, refs("p")) {
+		t.Errorf("MissingDependents(m) = %q, %v; want just p", got, err)
+	}
+	if removed, err := d.PruneMissing(); err != nil || removed != 0 {
+		t.Errorf("PruneMissing rerun = %d, %v; want 0", removed, err)
+	}
+}
+
+func TestStatsProgressCancel(t *testing.T) {
+	d := newTestDB(t)
+	const n = 3 * statsCheckEvery
+	entries := make([]PlaceEntry, n)
+	for i := range entries {
+		entries[i] = PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: "loc", Type: "file", Size: 1}
+	}
+	if err := d.BatchPlace(entries); err != nil {
+		t.Fatal(err)
+	}
+	full := d.Stats()
+	if full.Blobs != n {
+		t.Fatalf("Stats.Blobs = %d, want %d", full.Blobs, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	s, err := d.StatsProgress(ctx, func(uint64) {
+		calls++
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Fatalf("StatsProgress = %v, want context.Canceled", err)
+	}
+	if calls == 0 {
+		t.Error("progress wasn't called")
+	}
+	if s.Blobs == 0 || s.Blobs >= n {
+		t.Errorf("partial Blobs = %d, want some of %d", s.Blobs, n)
+	}
+	// each count is of the entries scanned, so those of one blob each
+	// agree with the scan as far as it went
+	if s.TotalBytes != s.Blobs || s.CamliTypes["file"] > n {
+		t.Errorf("partial Stats = %+v, inconsistent", s)
+	}
+}
+
+func TestListDistinct(t *testing.T) {
+	d := newTestDB(t)
+	a, b := ref("a"), ref("b")
+	// keys with trailing fields hold the same ref as the key they
+	// follow
+	batch := new(leveldb.Batch)
+	for _, k := range [][]byte{
+		pack(camliType, "file", a),
+		pack(camliType, "file", a, "extra"),
+		pack(camliType, "file", b),
+		pack(mimeType, "text/plain", a),
+		pack(mimeType, "text/plain", a, "extra"),
+		pack(mimeType, "text/plain", a, "more"),
+	} {
+		batch.Put(k, nil)
+	}
+	if err := d.db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := collect(d.List("file")), refs("a", "b"); !reflect.DeepEqual(got, want) {
+		t.Errorf("List(file) = %q, want %q", got, want)
+	}
+	if got := collect(d.ListMIME("text/plain")); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("ListMIME(text/plain) = %q, want a once", got)
+	}
+}
+
+func TestCountMissing(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p1", "loc", "directory", "m1", "m2", "found")
+	place(t, d, "p2", "loc", "file", "m1")
+	place(t, d, "found", "loc", "file")
+
+	n, err := d.CountMissing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed := len(collect(d.Missing())); n != uint64(streamed) || n != 3 {
+		t.Errorf("CountMissing = %d, Missing streamed %d; want 3", n, streamed)
+	}
+	for ct, want := range map[string]uint64{"file": 2, "directory": 1, "bytes": 0} {
+		if n, err := d.CountType(ct); err != nil || n != want {
+			t.Errorf("CountType(%s) = %d, %v; want %d", ct, n, err, want)
+		}
+	}
+}
+
+func TestListTypeMIME(t *testing.T) {
+	d := newTestDB(t)
+	var want []string
+	for i := 0; i < 60; i++ {
+		name := fmt.Sprint(i)
+		// every type is Placed before any MIME type
+		ct := "bytes"
+		if i%2 == 0 {
+			ct = "file"
+		}
+		place(t, d, name, "loc", ct)
+		if i%6 == 0 {
+			want = append(want, ref(name))
+		}
+	}
+	for i := 0; i < 60; i++ {
+		mt := "text/plain"
+		if i%3 == 0 {
+			mt = "image/png"
+		}
+		if err := d.PlaceMIME(ref(fmt.Sprint(i)), mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// refs are hashes, so the two indexes interleave, and each skips
+	// past runs of the other
+	sort.Strings(want)
+	if got := collect(d.ListTypeMIME("file", "image/png")); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTypeMIME(file, image/png) = %q, want %q", got, want)
+	}
+	if got := collect(d.ListTypeMIME("file", "video/mp4")); len(got) != 0 {
+		t.Errorf("ListTypeMIME of an unused MIME type = %q, want none", got)
+	}
+}
+
+func TestListMIMEsAfterCheckpoint(t *testing.T) {
+	d := newTestDB(t)
+	var all []string
+	for i := 0; i < 10; i++ {
+		r := ref(fmt.Sprint(i))
+		place(t, d, fmt.Sprint(i), "loc", "file")
+		mt := []string{"image/jpeg", "image/png"}[i%2]
+		if err := d.PlaceMIME(r, mt); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, r)
+	}
+	sort.Strings(all)
+	if err := d.SetCheckpoint("scan", all[4]); err != nil {
+		t.Fatal(err)
+	}
+	resume, err := d.Checkpoint("scan")
+	if err != nil || resume != all[4] {
+		t.Fatalf("Checkpoint = %q, %v; want %q", resume, err, all[4])
+	}
+	got := collect(d.ListMIMEsAfter(context.Background(), resume, "image/jpeg", "image/png"))
+	if !reflect.DeepEqual(got, all[5:]) {
+		t.Errorf("ListMIMEsAfter the checkpoint = %q, want %q", got, all[5:])
+	}
+}
+
+func TestListMIMEsOverlapping(t *testing.T) {
+	d := newTestDB(t)
+	mimes := map[string][]string{
+		"jpeg":   {"image/jpeg"},
+		"tiff":   {"image/tiff"},
+		"both":   {"image/jpeg", "image/tiff"},
+		"png":    {"image/png"},
+		"all":    {"image/jpeg", "image/png", "image/tiff"},
+		"other":  {"text/plain"},
+		"tiff 2": {"image/tiff", "text/plain"},
+	}
+	for name, mts := range mimes {
+		place(t, d, name, "loc", "file")
+		for _, mt := range mts {
+			if err := d.PlaceMIME(ref(name), mt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := refs("jpeg", "tiff", "both", "all", "tiff 2")
+	if got := collect(d.ListMIMEs("image/jpeg", "image/tiff")); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListMIMEs(jpeg, tiff) = %q, want %q, each once", got, want)
+	}
+	// asking for a type twice is no different
+	if got := collect(d.ListMIMEs("image/tiff", "image/jpeg", "image/tiff")); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListMIMEs(tiff, jpeg, tiff) = %q, want %q", got, want)
+	}
+}
+
+// populateStats fills d with n blobs of every kind Stats counts,
+// along with keys it knows nothing of and a malformed one.
+func populateStats(t testing.TB, d *DB, n int) {
+	types := []string{"", "file", "directory", "bytes"}
+	entries := make([]PlaceEntry, n)
+	for i := range entries {
+		e := PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: fmt.Sprintf("pack%d", i%7), Type: types[i%len(types)], Size: int64(i)}
+		if i > 0 && e.Type != "" {
+			e.Dependencies = []string{ref(fmt.Sprint(i - 1)), ref(fmt.Sprint("absent", i))}
+		}
+		entries[i] = e
+	}
+	if err := d.BatchPlace(entries); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i += 5 {
+		if err := d.PlaceMIME(ref(fmt.Sprint(i)), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := new(leveldb.Batch)
+	for _, k := range []string{"aaa", "gap", "zzz"} {
+		b.Put(pack(k, "x"), nil)
+	}
+	b.Put([]byte(found), nil)
+	if err := d.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sequentialStats is Stats scanned in one range, by one goroutine.
+func sequentialStats(d *DB) (Stats, error) {
+	return d.statsRange(context.Background(), nil, d.kinds(camliType), nil)
+}
+
+func TestStatsParallel(t *testing.T) {
+	d := newTestDB(t)
+	populateStats(t, d, 500)
+	want, err := sequentialStats(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Unknown != 3 || want.Malformed != 1 || want.Missing == 0 || len(want.MIMETypes) == 0 {
+		t.Fatalf("sequential Stats = %+v, want some of everything", want)
+	}
+	if got := d.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+// BenchmarkStats compares scanning the index in one range with
+// scanning the ranges of statsRanges concurrently.
+func BenchmarkStats(b *testing.B) {
+	d := newTestDB(b)
+	populateStats(b, d, 20000)
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := sequentialStats(d); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			d.Stats()
+		}
+	})
+}
+
+func TestNewROErrors(t *testing.T) {
+	if _, err := NewRO(filepath.Join(t.TempDir(), "missing")); err != ErrNotExist {
+		t.Errorf("NewRO of a missing path = %v, want ErrNotExist", err)
+	}
+	if _, err := NewRO(t.TempDir()); err != ErrNotExist {
+		t.Errorf("NewRO of an empty directory = %v, want ErrNotExist", err)
+	}
+
+	dir := t.TempDir()
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	place(t, d, "a", "loc", "file")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := NewRO(dir)
+	if err != nil {
+		t.Fatalf("NewRO of a healthy index = %v", err)
+	}
+	if ok, err := ro.Has(ref("a")); err != nil || !ok {
+		t.Errorf("Has(a) = %t, %v; want true", ok, err)
+	}
+	ro.Close()
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("no manifest in %s: %v", dir, err)
+	}
+	for _, m := range manifests {
+		if err := ioutil.WriteFile(m, []byte("garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ro, err := NewRO(dir); err == nil {
+		ro.Close()
+		t.Error("NewRO of a corrupt index succeeded")
+	} else if err == ErrNotExist {
+		t.Error("NewRO of a corrupt index = ErrNotExist, want the corruption")
+	}
+}
+
+func TestPlaceConcurrent(t *testing.T) {
+	d := newTestDB(t)
+	const goroutines, blobs = 8, 50
+	name := func(g, i int) string { return fmt.Sprintf("%d-%d", g, i) }
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			// syncing some writes but not others mustn't matter
+			d.SetSync(g%2 == 0)
+			for i := 0; i < blobs; i++ {
+				deps := []string{ref("shared")}
+				if i > 0 {
+					deps = append(deps, ref(name(g, i-1)))
+				}
+				if err := d.Place(ref(name(g, i)), "loc "+name(g, i), "file", deps); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+	for g := 0; g < goroutines; g++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := d.Stats()
+	if s.Blobs != goroutines*blobs || s.Links != goroutines*(2*blobs-1) || s.Missing != goroutines*blobs || s.Malformed != 0 {
+		t.Errorf("Stats = %+v, want %d blobs, %d links and every blob missing shared", s, goroutines*blobs, goroutines*(2*blobs-1))
+	}
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < blobs; i++ {
+			if loc, err := d.Location(ref(name(g, i))); err != nil || loc != "loc "+name(g, i) {
+				t.Errorf("Location(%s) = %q, %v", name(g, i), loc, err)
+			}
+		}
+	}
+	if parents, err := d.Parents(ref("shared")); err != nil || len(parents) != goroutines*blobs {
+		t.Errorf("Parents(shared) = %d, %v; want %d", len(parents), err, goroutines*blobs)
+	}
+	for k := range d.FindInvalidKeys() {
+		t.Errorf("invalid key %q", k)
+	}
+}
+
+// depthPaths returns the paths StreamParentPaths sends for the blob
+// named name, sorted.
+func depthPaths(t *testing.T, d *DB, name string, maxDepth int) ([]ParentPath, error) {
+	t.Helper()
+	ch := make(chan ParentPath)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.StreamParentPaths(ref(name), maxDepth, ch)
+		close(ch)
+	}()
+	var paths []ParentPath
+	for p := range ch {
+		paths = append(paths, p)
+	}
+	return sortPaths(paths...), <-errc
+}
+
+// sortPaths sorts paths in order of their blobs.
+func sortPaths(paths ...ParentPath) []ParentPath {
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Join(paths[i].Path, " ") < strings.Join(paths[j].Path, " ")
+	})
+	return paths
+}
+
+func TestStreamParentPathsDepth(t *testing.T) {
+	d := newTestDB(t)
+	// leaf's parent p1 has the parents p2 and q, and p2 has p3
+	place(t, d, "p3", "loc", "directory", "p2")
+	place(t, d, "p2", "loc", "directory", "p1")
+	place(t, d, "q", "loc", "directory", "p1")
+	place(t, d, "p1", "loc", "directory", "leaf")
+	place(t, d, "leaf", "loc", "file")
+	p := func(truncated bool, names ...string) ParentPath {
+		path := make([]string, len(names))
+		for i, n := range names {
+			path[i] = ref(n)
+		}
+		return ParentPath{Path: path, Truncated: truncated}
+	}
+	full := sortPaths(p(false, "p1", "p2", "p3"), p(false, "p1", "q"))
+	for _, c := range []struct {
+		maxDepth int
+		want     []ParentPath
+	}{
+		{0, full},
+		{1, sortPaths(p(true, "p1"))},
+		{2, sortPaths(p(true, "p1", "p2"), p(false, "p1", "q"))},
+		// paths reaching an ancestor without parents at the limit are
+		// complete
+		{3, full},
+		{4, full},
+	} {
+		got, err := depthPaths(t, d, "leaf", c.maxDepth)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("StreamParentPaths(leaf, %d) = %v, %v; want %v", c.maxDepth, got, err, c.want)
+		}
+	}
+	if got, err := depthPaths(t, d, "p3", 1); err != nil || len(got) != 1 || len(got[0].Path) != 0 || got[0].Truncated {
+		t.Errorf("StreamParentPaths(p3, 1) = %v, %v; want one empty complete path", got, err)
+	}
+
+	// a cycle beyond the limit isn't followed
+	place(t, d, "leaf", "loc", "directory", "p3")
+	var cycle *CycleError
+	if _, err := depthPaths(t, d, "leaf", 0); !errors.As(err, &cycle) {
+		t.Errorf("StreamParentPaths(leaf, 0) of a cycle = %v, want a *CycleError", err)
+	}
+	got, err := depthPaths(t, d, "leaf", 2)
+	if want := sortPaths(p(true, "p1", "p2"), p(false, "p1", "q")); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamParentPaths(leaf, 2) of a cycle = %v, %v; want %v", got, err, want)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	dir := t.TempDir()
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]PlaceEntry, 2000)
+	for i := range entries {
+		entries[i] = PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: "loc", Size: -1, Dependencies: []string{ref(fmt.Sprint("absent", i))}}
+	}
+	if err := d.BatchPlace(entries); err != nil {
+		t.Fatal(err)
+	}
+	// sizes are of table files, not the log
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	ro, err := NewRO(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	full, err := ro.ApproximateSize(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := ro.ApproximateSize(mimeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full < 10000 || full < 10*empty {
+		t.Errorf("ApproximateSize of missing = %d and of mime = %d, want missing much larger", full, empty)
+	}
+	sizes, err := ro.Sizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != len(keySpecs) || sizes[missing] != full || sizes[mimeType] != empty {
+		t.Errorf("Sizes = %v, want every index, with missing %d and mime %d", sizes, full, empty)
+	}
+	if _, err := ro.ApproximateSize("bogus"); err == nil {
+		t.Error("ApproximateSize of an unknown index succeeded")
+	}
+}
+
+// typesOf returns the camliTypes the blob named name has.
+func typesOf(d *DB, name string) []string {
+	return d.kindsOf(camliType, d.kinds(camliType), ref(name))
+}
+
+func TestRetypeBlob(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "loc", "file")
+	place(t, d, "a", "loc", "bytes")
+	place(t, d, "b", "loc", "file")
+
+	if err := d.RetypeBlob(ref("a"), "directory"); err != nil {
+		t.Fatal(err)
+	}
+	if got := typesOf(d, "a"); !reflect.DeepEqual(got, []string{"directory"}) {
+		t.Errorf("types of a = %q, want directory only", got)
+	}
+	if got := typesOf(d, "b"); !reflect.DeepEqual(got, []string{"file"}) {
+		t.Errorf("types of b = %q, want file", got)
+	}
+	// retyping to a type it already has only drops the others
+	place(t, d, "b", "loc", "bytes")
+	if err := d.RetypeBlob(ref("b"), "file"); err != nil {
+		t.Fatal(err)
+	}
+	if got := typesOf(d, "b"); !reflect.DeepEqual(got, []string{"file"}) {
+		t.Errorf("types of b = %q, want file", got)
+	}
+	if err := d.RetypeBlob(ref("a"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := typesOf(d, "a"); len(got) != 0 {
+		t.Errorf("types of a = %q, want none", got)
+	}
+	if got := collect(d.Untyped()); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("Untyped = %q, want a", got)
+	}
+}
+
+func TestRenameType(t *testing.T) {
+	d := newTestDB(t)
+	// more than a batch, so that the rename takes several writes
+	const n = renameBatch + 3
+	entries := make([]PlaceEntry, n)
+	for i := range entries {
+		entries[i] = PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: "loc", Type: "fiel", Size: -1}
+	}
+	if err := d.BatchPlace(entries); err != nil {
+		t.Fatal(err)
+	}
+	// a blob already of the new type as well only has it once after
+	place(t, d, "0", "loc", "file")
+	place(t, d, "other", "loc", "directory")
+	// malformed keys are left alone
+	b := new(leveldb.Batch)
+	b.Put(pack(camliType, "fiel", ref("x"), "extra"), nil)
+	if err := d.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated, err := d.RenameType("fiel", "file"); err != nil || updated != n {
+		t.Fatalf("RenameType = %d, %v; want %d", updated, err, n)
+	}
+	if got := collect(d.List("file")); len(got) != n {
+		t.Errorf("List(file) = %d blobs, want %d", len(got), n)
+	}
+	if got := collect(d.List("fiel")); !reflect.DeepEqual(got, []string{ref("x")}) {
+		t.Errorf("List(fiel) = %q, want only the malformed key's", got)
+	}
+	if got := typesOf(d, "0"); !reflect.DeepEqual(got, []string{"file"}) {
+		t.Errorf("types of 0 = %q, want file", got)
+	}
+	if got := typesOf(d, "other"); !reflect.DeepEqual(got, []string{"directory"}) {
+		t.Errorf("types of other = %q, want directory", got)
+	}
+	// a rerun, as after an interruption, has nothing left to move
+	if updated, err := d.RenameType("fiel", "file"); err != nil || updated != 0 {
+		t.Errorf("RenameType rerun = %d, %v; want 0", updated, err)
+	}
+	if got := collect(d.List("file")); len(got) != n {
+		t.Errorf("List(file) after rerun = %d blobs, want %d", len(got), n)
+	}
+	if updated, err := d.RenameType("file", "file"); err != nil || updated != 0 {
+		t.Errorf("RenameType to itself = %d, %v; want 0", updated, err)
+	}
+}
+
+func TestPurgeType(t *testing.T) {
+	d := newTestDB(t)
+	// both is also a file, so survives; only is Deleted, so is then
+	// missing for p
+	place(t, d, "both", "loc", "bogus")
+	place(t, d, "both", "loc", "file")
+	place(t, d, "only", "loc", "bogus")
+	place(t, d, "p", "loc", "directory", "only")
+
+	removed, kept, err := d.PurgeType("bogus")
+	if err != nil || removed != 1 || kept != 1 {
+		t.Fatalf("PurgeType = %d removed, %d kept, %v; want 1 and 1", removed, kept, err)
+	}
+	if ok, err := d.Has(ref("only")); err != nil || ok {
+		t.Errorf("Has(only) = %t, %v; want false", ok, err)
+	}
+	if ok, err := d.Has(ref("both")); err != nil || !ok {
+		t.Errorf("Has(both) = %t, %v; want true", ok, err)
+	}
+	if got := typesOf(d, "both"); !reflect.DeepEqual(got, []string{"file"}) {
+		t.Errorf("types of both = %q, want file", got)
+	}
+	if got := collect(d.Missing()); !reflect.DeepEqual(got, []string{ref("only")}) {
+		t.Errorf("Missing = %q, want only", got)
+	}
+	if got := collect(d.List("bogus")); len(got) != 0 {
+		t.Errorf("List(bogus) = %q, want none", got)
+	}
+	if got := collect(d.List("file")); !reflect.DeepEqual(got, []string{ref("both")}) {
+		t.Errorf("List(file) = %q, want both", got)
+	}
+	if removed, kept, err := d.PurgeType("bogus"); err != nil || removed != 0 || kept != 0 {
+		t.Errorf("PurgeType rerun = %d removed, %d kept, %v; want none", removed, kept, err)
+	}
+}
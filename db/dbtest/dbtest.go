@@ -0,0 +1,47 @@
+// Package dbtest generates synthetic indexes for tests and benchmarks.
+package dbtest
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// types are the camliTypes assigned to generated blobs; "" is a data
+// blob. Data blobs dominate, as they do in a real blobstore.
+var types = []string{"", "", "", "", "bytes", "file", "file", "directory", "static-set"}
+
+// Ref returns the ref of the i'th generated blob.
+func Ref(i int) string {
+	return fmt.Sprintf("sha1-%x", sha1.Sum([]byte(fmt.Sprint(i))))
+}
+
+// Populate Places the given number of generated blobs into d. Each
+// schema blob depends on an average of avgDeps earlier blobs, so the
+// graph is acyclic; about one in fifty dependencies is on a blob that
+// is never Placed, and so shows up as missing. The output is
+// deterministic.
+func Populate(d *db.DB, blobs int, avgDeps int) error {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < blobs; i++ {
+		ct := types[r.Intn(len(types))]
+		var deps []string
+		if ct != "" && i > 0 {
+			n := r.Intn(2*avgDeps + 1)
+			for j := 0; j < n; j++ {
+				if r.Intn(50) == 0 {
+					deps = append(deps, Ref(blobs+r.Int()))
+				} else {
+					deps = append(deps, Ref(r.Intn(i)))
+				}
+			}
+		}
+		location := fmt.Sprintf("pack-%05d.blobs %d", i/1000, (i%1000)*4096)
+		if err := d.Place(Ref(i), location, ct, deps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
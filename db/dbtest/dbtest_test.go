@@ -0,0 +1,42 @@
+package dbtest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dichro/cameloff/db"
+)
+
+func populated(t testing.TB, blobs, avgDeps int) *db.DB {
+	d, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := Populate(d, blobs, avgDeps); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestPopulate(t *testing.T) {
+	s := populated(t, 2000, 3).Stats()
+	if s.Blobs != 2000 {
+		t.Errorf("Blobs = %d, want 2000", s.Blobs)
+	}
+	if s.Links == 0 || s.Missing == 0 {
+		t.Errorf("got %d links and %d missing, want some of each", s.Links, s.Missing)
+	}
+	if len(s.CamliTypes) < 2 {
+		t.Errorf("CamliTypes = %v, want several", s.CamliTypes)
+	}
+	if again := populated(t, 2000, 3).Stats(); !reflect.DeepEqual(s, again) {
+		t.Errorf("repopulated Stats = %v, want %v", again, s)
+	}
+}
+
+func BenchmarkPopulate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		populated(b, 1000, 3)
+	}
+}
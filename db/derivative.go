@@ -0,0 +1,38 @@
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PlaceDerivative notes that derived, such as a thumbnail or a
+// transcode, was generated from original. Derivatives aren't
+// dependencies: they don't appear in Parents, Children or Closure.
+func (d *DB) PlaceDerivative(original, derived string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	original, err := d.normalizeRef(original)
+	if err != nil {
+		return err
+	}
+	if derived, err = d.normalizeRef(derived); err != nil {
+		return err
+	}
+	return d.db.Put(pack(derivative, original, derived), nil, nil)
+}
+
+// Derivatives returns the blobs Placed as derivatives of original, in
+// sorted order.
+func (d *DB) Derivatives(original string) (derived []string, err error) {
+	original = d.lookupRef(original)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(derivative, original, start),
+		Limit: pack(derivative, original, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		derived = append(derived, unpack(it.Key())[2])
+	}
+	err = it.Error()
+	return
+}
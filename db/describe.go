@@ -0,0 +1,76 @@
+package db
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrNotFound is returned for blobs the index has no record of. It is
+// leveldb.ErrNotFound, which some methods document returning.
+var ErrNotFound = leveldb.ErrNotFound
+
+// BlobRecord is everything the index knows about a found blob.
+type BlobRecord struct {
+	Ref, Location, FirstLocation string
+	// Size is -1 if unknown.
+	Size       int64
+	Duplicates []string
+	// Indexed is zero if unknown.
+	Indexed                           time.Time
+	CamliTypes, MIMETypes, Extensions []string
+	// Sources name the crawlers that Placed the blob, if they said.
+	Sources []string
+	// Derivatives are the blobs Placed as derived from this one.
+	Derivatives []string
+	// Parents is the number of blobs depending on this one.
+	Parents int
+	// Missing are the dependencies of this blob that aren't found.
+	Missing []string
+}
+
+// Describe returns everything the index knows about a found blob, or
+// ErrNotFound.
+func (d *DB) Describe(ref string) (BlobRecord, error) {
+	ref = d.lookupRef(ref)
+	r := BlobRecord{Ref: ref}
+	f, err := d.getFound(ref)
+	if err != nil {
+		return r, err
+	}
+	r.Location, r.FirstLocation, r.Size = f.Location, f.First, f.Size
+	r.Duplicates, r.Indexed = f.Duplicates, f.Indexed
+	for _, idx := range []struct {
+		prefix string
+		kinds  *[]string
+	}{
+		{camliType, &r.CamliTypes},
+		{mimeType, &r.MIMETypes},
+		{extension, &r.Extensions},
+		{source, &r.Sources},
+	} {
+		*idx.kinds = d.kindsOf(idx.prefix, d.kinds(idx.prefix), ref)
+	}
+	if r.Derivatives, err = d.Derivatives(ref); err != nil {
+		return r, err
+	}
+	it := d.db.NewIterator(util.BytesPrefix(pack(parent, ref, "")), nil)
+	for it.Next() {
+		r.Parents++
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return r, err
+	}
+	deps, err := d.Children(ref)
+	if err != nil {
+		return r, err
+	}
+	for _, dep := range deps {
+		if ok, _ := d.db.Has(pack(found, dep), nil); !ok {
+			r.Missing = append(r.Missing, dep)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// DiffKind is how a found blob differs between two indexes.
+type DiffKind int
+
+const (
+	// Added blobs are found only in the newer index.
+	Added DiffKind = iota
+	// Removed blobs are found only in the older index.
+	Removed
+	// Moved blobs are found in both, at different locations.
+	Moved
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Moved:
+		return "moved"
+	}
+	return fmt.Sprintf("DiffKind(%d)", int(k))
+}
+
+// DiffRecord is a found blob that differs between two indexes.
+type DiffRecord struct {
+	Kind DiffKind
+	Ref  string
+	// OldLocation and NewLocation are the blob's locations in the
+	// older and newer index, or "" in the one it isn't found in.
+	OldLocation, NewLocation string
+}
+
+// locatedRef is a found blob and its location, as read by Diff.
+type locatedRef struct {
+	ref, location string
+}
+
+// nextFound returns the next found blob of one side of a Diff, in ref
+// order, or false once there are no more.
+type nextFound func() (locatedRef, bool, error)
+
+// Diff sends to ch, in ref order, a DiffRecord for each found blob that
+// was Added, Removed or Moved between older and newer, such as before
+// and after a garbage collection. The found blobs of both are read in
+// a single merged pass over snapshots of them. Only locations are
+// compared, not other fields such as sizes or duplicates.
+func Diff(older, newer *DB, ch chan<- DiffRecord) error {
+	o, releaseOld, err := older.frozen()
+	if err != nil {
+		return err
+	}
+	defer releaseOld()
+	n, releaseNew, err := newer.frozen()
+	if err != nil {
+		return err
+	}
+	defer releaseNew()
+	nextOld, stopOld := o.foundLocations()
+	defer stopOld()
+	nextNew, stopNew := n.foundLocations()
+	defer stopNew()
+	return diff(nextOld, nextNew, ch)
+}
+
+// DiffDump is Diff, with the older index read from dump, as written by
+// Export, such as an archived snapshot. Gzipped dumps are decompressed
+// transparently.
+func DiffDump(dump io.Reader, newer *DB, ch chan<- DiffRecord) error {
+	br, release, err := exportReader(dump)
+	if err != nil {
+		return err
+	}
+	defer release()
+	n, releaseNew, err := newer.frozen()
+	if err != nil {
+		return err
+	}
+	defer releaseNew()
+	nextNew, stopNew := n.foundLocations()
+	defer stopNew()
+	return diff(dumpLocations(br), nextNew, ch)
+}
+
+// diff merges the found blobs of older and newer.
+func diff(older, newer nextFound, ch chan<- DiffRecord) error {
+	o, ook, err := older()
+	if err != nil {
+		return err
+	}
+	n, nok, err := newer()
+	if err != nil {
+		return err
+	}
+	for ook || nok {
+		switch {
+		case !nok || ook && o.ref < n.ref:
+			ch <- DiffRecord{Kind: Removed, Ref: o.ref, OldLocation: o.location}
+			o, ook, err = older()
+		case !ook || n.ref < o.ref:
+			ch <- DiffRecord{Kind: Added, Ref: n.ref, NewLocation: n.location}
+			n, nok, err = newer()
+		default:
+			if o.location != n.location {
+				ch <- DiffRecord{Kind: Moved, Ref: o.ref, OldLocation: o.location, NewLocation: n.location}
+			}
+			if o, ook, err = older(); err == nil {
+				n, nok, err = newer()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foundLocations iterates over the found blobs of d, returning a func
+// to call to release the iterator.
+func (d *DB) foundLocations() (nextFound, func()) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	return func() (locatedRef, bool, error) {
+		for it.Next() {
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			r, err := decodeFound(it.Value())
+			if err != nil {
+				return locatedRef{}, false, fmt.Errorf("%s: %s", parts[1], err)
+			}
+			return locatedRef{parts[1], r.Location}, true, nil
+		}
+		return locatedRef{}, false, it.Error()
+	}, it.Release
+}
+
+// dumpLocations reads the found blobs of a dump, which must be in ref
+// order, as Export writes them.
+func dumpLocations(br *bufio.Reader) nextFound {
+	line, prev := 0, ""
+	return func() (locatedRef, bool, error) {
+		for {
+			data, err := br.ReadBytes('\n')
+			line++
+			if len(bytes.TrimSpace(data)) > 0 {
+				rec, err := DecodeRecord(data)
+				if err != nil {
+					return locatedRef{}, false, fmt.Errorf("line %d: %s", line, err)
+				}
+				if f, ok := rec.(*FoundRecord); ok {
+					if f.Ref <= prev {
+						return locatedRef{}, false, fmt.Errorf("line %d: %s is out of order", line, f.Ref)
+					}
+					prev = f.Ref
+					return locatedRef{f.Ref, f.Location}, true, nil
+				}
+			}
+			if err == io.EOF {
+				return locatedRef{}, false, nil
+			}
+			if err != nil {
+				return locatedRef{}, false, err
+			}
+		}
+	}
+}
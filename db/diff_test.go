@@ -0,0 +1,62 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// collectDiff runs diff, returning the records it sends.
+func collectDiff(t *testing.T, diff func(ch chan<- DiffRecord) error) []DiffRecord {
+	t.Helper()
+	ch := make(chan DiffRecord)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- diff(ch)
+		close(ch)
+	}()
+	var got []DiffRecord
+	for r := range ch {
+		got = append(got, r)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestDiff(t *testing.T) {
+	older, newer := newTestDB(t), newTestDB(t)
+	place(t, older, "kept", "pack1", "file")
+	place(t, older, "removed", "pack1", "")
+	place(t, older, "moved", "pack1", "")
+	place(t, newer, "kept", "pack1", "file")
+	place(t, newer, "moved", "pack2", "")
+	place(t, newer, "added", "pack2", "")
+
+	want := []DiffRecord{
+		{Kind: Added, Ref: ref("added"), NewLocation: "pack2"},
+		{Kind: Moved, Ref: ref("moved"), OldLocation: "pack1", NewLocation: "pack2"},
+		{Kind: Removed, Ref: ref("removed"), OldLocation: "pack1"},
+	}
+	// records are sent in ref order
+	sort.Slice(want, func(i, j int) bool { return want[i].Ref < want[j].Ref })
+
+	got := collectDiff(t, func(ch chan<- DiffRecord) error { return Diff(older, newer, ch) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %+v, want %+v", got, want)
+	}
+	if got := collectDiff(t, func(ch chan<- DiffRecord) error { return Diff(newer, newer, ch) }); len(got) != 0 {
+		t.Errorf("Diff of an index with itself = %+v, want none", got)
+	}
+
+	var dump bytes.Buffer
+	if err := older.Export(&dump, &ExportOptions{Gzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	got = collectDiff(t, func(ch chan<- DiffRecord) error { return DiffDump(&dump, newer, ch) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffDump = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// MarkDone records that the named scanner has processed ref, whether
+// or not it found anything to index, so that a later run can skip it.
+func (d *DB) MarkDone(scanner, ref string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(done, scanner, ref), nil, nil)
+}
+
+// IsDone reports whether ref has been MarkDone by the named scanner
+// since its last ResetDone.
+func (d *DB) IsDone(scanner, ref string) bool {
+	ref = d.lookupRef(ref)
+	ok, _ := d.db.Has(pack(done, scanner, ref), nil)
+	return ok
+}
+
+// ResetDone forgets every ref MarkDone by the named scanner, so that
+// its next run processes everything again.
+func (d *DB) ResetDone(scanner string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(done, scanner, start),
+		Limit: pack(done, scanner, limit),
+	}, nil)
+	defer it.Release()
+	b := new(leveldb.Batch)
+	for it.Next() {
+		b.Delete(it.Key())
+		if b.Len() >= renameBatch {
+			if err := d.db.Write(b, nil); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return d.db.Write(b, nil)
+}
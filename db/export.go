@@ -0,0 +1,535 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ExportOptions control the output of Export. A nil *ExportOptions
+// means the defaults.
+type ExportOptions struct {
+	// Gzip compresses the output.
+	Gzip bool
+}
+
+// record is a single line of the Export format, of any kind. Which
+// fields are set depends on Kind; see the typed records of
+// DecodeRecord.
+type record struct {
+	RecordHeader
+	Ref      string `json:"ref,omitempty"`
+	Dep      string `json:"dep,omitempty"`
+	Location string `json:"location,omitempty"`
+	Size     *int64 `json:"size,omitempty"`
+	Type     string `json:"type,omitempty"`
+	MIME     string `json:"mime,omitempty"`
+	Ext      string `json:"ext,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Attr     string `json:"attr,omitempty"`
+	// Derived is a derivative of Ref.
+	Derived string `json:"derived,omitempty"`
+	// First is where a found blob was first Placed, if not Location.
+	First string `json:"first,omitempty"`
+	// Duplicates are a found blob's other locations.
+	Duplicates []string `json:"duplicates,omitempty"`
+	// Time is when a found blob was indexed, a tombstone's blob was
+	// deleted, a checkpoint was recorded, or a blob was taken.
+	Time *time.Time `json:"time,omitempty"`
+	// Lat and Lng are a blob's coordinates.
+	Lat *float64 `json:"lat,omitempty"`
+	Lng *float64 `json:"lng,omitempty"`
+}
+
+// toRecord decodes an index entry. It returns false for keys that
+// aren't part of any known index.
+func toRecord(key, value []byte) (r record, ok bool, err error) {
+	parts := unpack(key)
+	if spec, known := keySpecs[parts[0]]; !known || !spec.exported || len(spec.fields)+1 != len(parts) {
+		return r, false, nil
+	}
+	r.Kind, r.Format = parts[0], ExportFormat
+	switch r.Kind {
+	case found:
+		r.Ref = parts[1]
+		f, err := decodeFound(value)
+		if err != nil {
+			return r, false, fmt.Errorf("%s: %s", r.Ref, err)
+		}
+		r.Location = f.Location
+		if f.Size >= 0 {
+			r.Size = &f.Size
+		}
+		if f.First != f.Location {
+			r.First = f.First
+		}
+		r.Duplicates = f.Duplicates
+		if !f.Indexed.IsZero() {
+			r.Time = &f.Indexed
+		}
+	case last:
+		r.Location = string(value)
+	case parent, missing:
+		r.Dep, r.Ref = parts[1], parts[2]
+	case child:
+		r.Ref, r.Dep = parts[1], parts[2]
+	case camliType:
+		r.Type, r.Ref = parts[1], parts[2]
+	case mimeType:
+		r.MIME, r.Ref = parts[1], parts[2]
+	case extension:
+		r.Ext, r.Ref = parts[1], parts[2]
+	case checkpoint:
+		var t time.Time
+		r.Name = parts[1]
+		if r.Ref, t = decodeCheckpoint(value); !t.IsZero() {
+			r.Time = &t
+		}
+	case attr:
+		r.Name, r.Attr, r.Ref = parts[1], parts[2], parts[3]
+	case source:
+		r.Name, r.Ref = parts[1], parts[2]
+	case derivative:
+		r.Ref, r.Derived = parts[1], parts[2]
+	case taken:
+		t, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return r, false, fmt.Errorf("%s: taken: %s", parts[2], err)
+		}
+		r.Ref, r.Time = parts[2], &t
+	case geo:
+		r.Ref = parts[1]
+		lat, lng, err := decodeGeo(string(value))
+		if err != nil {
+			return r, false, fmt.Errorf("%s: geo: %s", r.Ref, err)
+		}
+		r.Lat, r.Lng = &lat, &lng
+	case tombstone:
+		r.Ref = parts[1]
+		ns, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return r, false, fmt.Errorf("%s: tombstone: %s", r.Ref, err)
+		}
+		t := time.Unix(0, ns)
+		r.Time = &t
+	}
+	return r, true, nil
+}
+
+// fromRecord encodes an index entry, as d would write it.
+func (d *DB) fromRecord(r record) (key, value []byte, err error) {
+	switch r.Kind {
+	case found:
+		f := foundRecord{Location: r.Location, First: r.First, Size: -1, Duplicates: r.Duplicates}
+		if r.Size != nil {
+			f.Size = *r.Size
+		}
+		if r.Time != nil {
+			f.Indexed = *r.Time
+		}
+		return pack(found, r.Ref), d.foundValue(f), nil
+	case last:
+		return pack(last), []byte(r.Location), nil
+	case parent, missing:
+		return pack(r.Kind, r.Dep, r.Ref), nil, nil
+	case child:
+		return pack(child, r.Ref, r.Dep), nil, nil
+	case camliType:
+		return pack(camliType, r.Type, r.Ref), nil, nil
+	case mimeType:
+		return pack(mimeType, r.MIME, r.Ref), nil, nil
+	case extension:
+		return pack(extension, r.Ext, r.Ref), nil, nil
+	case checkpoint:
+		if r.Time == nil {
+			return pack(checkpoint, r.Name), []byte(r.Ref), nil
+		}
+		return pack(checkpoint, r.Name), checkpointValue(r.Ref, *r.Time), nil
+	case attr:
+		return pack(attr, r.Name, r.Attr, r.Ref), nil, nil
+	case source:
+		return pack(source, r.Name, r.Ref), nil, nil
+	case derivative:
+		return pack(derivative, r.Ref, r.Derived), nil, nil
+	case taken:
+		if r.Time == nil {
+			return nil, nil, fmt.Errorf("%s: taken record without a time", r.Ref)
+		}
+		return pack(taken, takenKey(*r.Time), r.Ref), nil, nil
+	case geo:
+		if r.Lat == nil || r.Lng == nil {
+			return nil, nil, fmt.Errorf("%s: geo record without coordinates", r.Ref)
+		}
+		return pack(geo, r.Ref), encodeGeo(*r.Lat, *r.Lng), nil
+	case tombstone:
+		var ns int64
+		if r.Time != nil {
+			ns = r.Time.UnixNano()
+		}
+		return pack(tombstone, r.Ref), []byte(strconv.FormatInt(ns, 10)), nil
+	}
+	return nil, nil, fmt.Errorf("unknown record kind %q", r.Kind)
+}
+
+// Export writes every entry of the index to w as newline-delimited
+// JSON, in key order. Entries that aren't part of any known index are
+// skipped.
+func (d *DB) Export(w io.Writer, opts *ExportOptions) error {
+	if opts != nil && opts.Gzip {
+		gz := gzip.NewWriter(w)
+		if err := d.Export(gz, nil); err != nil {
+			gz.Close()
+			return err
+		}
+		return gz.Close()
+	}
+	enc := json.NewEncoder(w)
+	p := d.newProgress()
+	defer p.done()
+	it := d.db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		p.tick()
+		r, ok, err := toRecord(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// DumpCSV writes a CSV table with a header row and then a row for each
+// found blob, in ref order, giving its ref, location, size, camliType,
+// MIME type and number of parents. An unknown size is left empty, as
+// are unknown types; a blob with several types of a kind has them
+// separated by spaces.
+func (d *DB) DumpCSV(w io.Writer) error {
+	types, mimes := d.kinds(camliType), d.kinds(mimeType)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ref", "location", "size", "camliType", "mime", "parents"})
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	for it.Next() {
+		p.tick()
+		ref := unpack(it.Key())[1]
+		f, err := decodeFound(it.Value())
+		if err != nil {
+			return fmt.Errorf("%s: %s", ref, err)
+		}
+		var size string
+		if f.Size >= 0 {
+			size = strconv.FormatInt(f.Size, 10)
+		}
+		parents := 0
+		pit := d.db.NewIterator(util.BytesPrefix(pack(parent, ref, "")), nil)
+		for pit.Next() {
+			parents++
+		}
+		pit.Release()
+		if err := pit.Error(); err != nil {
+			return err
+		}
+		cw.Write([]string{
+			ref, f.Location, size,
+			strings.Join(d.kindsOf(camliType, types, ref), " "),
+			strings.Join(d.kindsOf(mimeType, mimes, ref), " "),
+			strconv.Itoa(parents),
+		})
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// kindsOf returns those of kinds in the index named by prefix that
+// include ref.
+func (d *DB) kindsOf(prefix string, kinds []string, ref string) (of []string) {
+	for _, kind := range kinds {
+		if ok, _ := d.db.Has(pack(prefix, kind, ref), nil); ok {
+			of = append(of, kind)
+		}
+	}
+	return of
+}
+
+// ExportSubtree writes, in the format of Export, the entries of the
+// index that describe root and its transitive dependencies. Edges
+// leading out of the subtree are omitted, so importing the result
+// into an empty index yields a self-consistent partial index.
+func (d *DB) ExportSubtree(root string, w io.Writer, opts *ExportOptions) error {
+	root = d.lookupRef(root)
+	if opts != nil && opts.Gzip {
+		gz := gzip.NewWriter(w)
+		if err := d.ExportSubtree(root, gz, nil); err != nil {
+			gz.Close()
+			return err
+		}
+		return gz.Close()
+	}
+	refs, err := d.Closure(root)
+	if err != nil {
+		return err
+	}
+	keys, err := d.entryKeys(refs)
+	if err != nil {
+		return err
+	}
+	return d.exportKeys(json.NewEncoder(w), keys)
+}
+
+// ExportSince writes, in the format of Export, the entries describing
+// every blob Placed after t and its dependency edges, followed by a
+// tombstone for every blob Deleted after t. Importing the result into
+// a replica that has imported everything up to t brings it up to date,
+// with these caveats: entries added to a blob after it was Placed,
+// such as by PlaceMIME or PlaceExtension, are only exported along with
+// a later Place of the blob; and blobs Placed before an index recorded
+// when blobs were placed are only exported by Export.
+func (d *DB) ExportSince(t time.Time, w io.Writer, opts *ExportOptions) error {
+	if opts != nil && opts.Gzip {
+		gz := gzip.NewWriter(w)
+		if err := d.ExportSince(t, gz, nil); err != nil {
+			gz.Close()
+			return err
+		}
+		return gz.Close()
+	}
+	var refs []string
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		f, err := decodeFound(it.Value())
+		if err != nil {
+			return err
+		}
+		if f.Indexed.After(t) {
+			refs = append(refs, unpack(it.Key())[1])
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	keys, err := d.entryKeys(refs)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if err := d.exportKeys(enc, keys); err != nil {
+		return err
+	}
+	ts := d.db.NewIterator(&util.Range{
+		Start: pack(tombstone, start),
+		Limit: pack(tombstone, limit),
+	}, nil)
+	defer ts.Release()
+	for ts.Next() {
+		r, ok, err := toRecord(ts.Key(), ts.Value())
+		if err != nil {
+			return err
+		}
+		if !ok || !r.Time.After(t) {
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return ts.Error()
+}
+
+// entryKeys returns the keys that may describe refs and the dependency
+// edges leading from them.
+func (d *DB) entryKeys(refs []string) ([][]byte, error) {
+	var keys [][]byte
+	for _, prefix := range []string{camliType, mimeType, extension, source} {
+		for _, kind := range d.kinds(prefix) {
+			for _, ref := range refs {
+				keys = append(keys, pack(prefix, kind, ref))
+			}
+		}
+	}
+	for _, ref := range refs {
+		keys = append(keys, pack(found, ref))
+		deps, err := d.Children(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range deps {
+			keys = append(keys, pack(parent, dep, ref), pack(child, ref, dep), pack(missing, dep, ref))
+		}
+	}
+	return keys, nil
+}
+
+// exportKeys encodes the entries for those of keys that exist.
+func (d *DB) exportKeys(enc *json.Encoder, keys [][]byte) error {
+	for _, k := range keys {
+		v, err := d.db.Get(k, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r, ok, err := toRecord(k, v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump is Export with the default options: it streams every entry of
+// the index as a line of JSON, for Load.
+func (d *DB) Dump(w io.Writer) error {
+	return d.Export(w, nil)
+}
+
+// exportReader returns a reader of the Export format written to r,
+// decompressed if it was gzipped, and a func to call once it's read.
+func exportReader(r io.Reader) (*bufio.Reader, func() error, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bufio.NewReader(gz), gz.Close, nil
+	}
+	return br, func() error { return nil }, nil
+}
+
+// importBatch is the number of entries Import writes at once.
+const importBatch = 1000
+
+// Import adds every entry read from r, in the format written by
+// Export, to the index. Gzipped input is decompressed transparently.
+// A found blob is no longer missing, and a tombstone Deletes its blob,
+// as if the blob had been Placed or Deleted locally.
+func (d *DB) Import(r io.Reader) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	br, release, err := exportReader(r)
+	if err != nil {
+		return err
+	}
+	defer release()
+	b := new(leveldb.Batch)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var rec record
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			if err := rec.check(); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			k, v, err := d.fromRecord(rec)
+			if err == nil {
+				// catches empty and malformed fields
+				err = ValidateKey(k)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			switch rec.Kind {
+			case found:
+				if prev, err := d.getFound(rec.Ref); err == nil {
+					b.Delete(pack(located, prev.Location, rec.Ref))
+				}
+				if rec.Location != "" {
+					b.Put(pack(located, rec.Location, rec.Ref), nil)
+				}
+				b.Delete(pack(tombstone, rec.Ref))
+				if err := d.unmissing(b, rec.Ref); err != nil {
+					return err
+				}
+			case tombstone:
+				if err := d.db.Write(b, nil); err != nil {
+					return err
+				}
+				b.Reset()
+				if _, err := d.Delete(rec.Ref); err != nil {
+					return err
+				}
+			}
+			b.Put(k, v)
+			if b.Len() >= importBatch {
+				if err := d.db.Write(b, nil); err != nil {
+					return err
+				}
+				b.Reset()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return d.db.Write(b, nil)
+}
+
+// Load rebuilds an index from the output of Dump, such as into a
+// fresh index on another machine. It Imports r, rejecting records of
+// unknown kinds, and then recomputes the missing index with
+// ResolveMissing, so that it agrees with the found blobs loaded
+// whatever order they came in.
+func (d *DB) Load(r io.Reader) error {
+	if err := d.Import(r); err != nil {
+		return err
+	}
+	_, _, err := d.ResolveMissing()
+	return err
+}
+
+// unmissing adds to b the removal of every note that ref is missing.
+func (d *DB) unmissing(b *leveldb.Batch, ref string) error {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(missing, ref, start),
+		Limit: pack(missing, ref, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		b.Delete(it.Key())
+	}
+	return it.Error()
+}
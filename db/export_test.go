@@ -0,0 +1,161 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportCompressesFound(t *testing.T) {
+	src := newTestDB(t)
+	loc := strings.Repeat("compressible/", 20)
+	place(t, src, "a", loc, "file")
+	var buf bytes.Buffer
+	if err := src.Export(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewWithOptions(t.TempDir(), Options{CompressFound: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.db.Get(pack(found, ref("a")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) < 2 || v[1] != foundSnappy {
+		t.Errorf("imported found value %q isn't compressed", v)
+	}
+	if got, err := d.Location(ref("a")); err != nil || got != loc {
+		t.Errorf("Location = %q, %v; want %q", got, err, loc)
+	}
+}
+
+func TestDump(t *testing.T) {
+	d := newTestDB(t)
+	if err := d.PlaceBlob(PlaceEntry{Ref: ref("dir"), Location: "pack 0", Type: "directory", Size: 100, Dependencies: []string{ref("file"), ref("gone")}}); err != nil {
+		t.Fatal(err)
+	}
+	place(t, d, "file", "pack 1", "file")
+	if err := d.PlaceMIME(ref("file"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := d.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		// when the blobs were indexed isn't of interest
+		r.Time = nil
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	dir, file, gone := ref("dir"), ref("file"), ref("gone")
+	want := []string{
+		`{"kind":"child","format":1,"ref":"` + dir + `","dep":"` + file + `"}`,
+		`{"kind":"child","format":1,"ref":"` + dir + `","dep":"` + gone + `"}`,
+		`{"kind":"found","format":1,"ref":"` + dir + `","location":"pack 0","size":100}`,
+		`{"kind":"found","format":1,"ref":"` + file + `","location":"pack 1"}`,
+		`{"kind":"last","format":1,"location":"pack 1"}`,
+		`{"kind":"mime","format":1,"ref":"` + file + `","mime":"text/plain"}`,
+		`{"kind":"missing","format":1,"ref":"` + dir + `","dep":"` + gone + `"}`,
+		`{"kind":"parent","format":1,"ref":"` + dir + `","dep":"` + file + `"}`,
+		`{"kind":"parent","format":1,"ref":"` + dir + `","dep":"` + gone + `"}`,
+		`{"kind":"type","format":1,"ref":"` + dir + `","type":"directory"}`,
+		`{"kind":"type","format":1,"ref":"` + file + `","type":"file"}`,
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dump =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a Load of the dump dumps the same
+	loaded := newTestDB(t)
+	if err := loaded.Load(strings.NewReader(dump)); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := loaded.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != dump {
+		t.Errorf("Dump of Load =\n%s\nwant\n%s", buf.String(), dump)
+	}
+}
+
+func TestLoadStats(t *testing.T) {
+	d := newTestDB(t)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprint(i)
+		deps := []string{ref(fmt.Sprint(i + 1)), ref("missing " + name)}
+		if err := d.PlaceBlob(PlaceEntry{Ref: ref(name), Location: "pack " + name, Type: []string{"file", "directory"}[i%2], Size: int64(i), Dependencies: deps}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.PlaceMIME(ref(name), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place(t, d, "3", "pack 3 again", "file")
+	var buf bytes.Buffer
+	if err := d.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestDB(t)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Stats(), d.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats after Load = %+v, want %+v", got, want)
+	}
+
+	err := newTestDB(t).Load(strings.NewReader(`{"kind":"bogus","format":1}` + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Errorf("Load of an unknown kind = %v, want an error naming it", err)
+	}
+}
+
+func TestExportSinceGzip(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "old", "pack 0", "file")
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	place(t, d, "new", "pack 1", "file")
+
+	var buf bytes.Buffer
+	if err := d.ExportSince(since, &buf, &ExportOptions{Gzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gzip.NewReader(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ExportSince with Gzip isn't gzipped: %v", err)
+	}
+	replica := newTestDB(t)
+	if err := replica.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(replica.List("file")); !reflect.DeepEqual(got, []string{ref("new")}) {
+		t.Errorf("imported List(file) = %q, want only new", got)
+	}
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RefSize is a blob and its size.
+type RefSize struct {
+	Ref  string
+	Size int64
+}
+
+// sizeHeap is a heap of RefSizes whose root is the first by less.
+type sizeHeap struct {
+	refs []RefSize
+	less func(a, b int64) bool
+}
+
+func (h *sizeHeap) Len() int           { return len(h.refs) }
+func (h *sizeHeap) Less(i, j int) bool { return h.less(h.refs[i].Size, h.refs[j].Size) }
+func (h *sizeHeap) Swap(i, j int)      { h.refs[i], h.refs[j] = h.refs[j], h.refs[i] }
+func (h *sizeHeap) Push(x interface{}) { h.refs = append(h.refs, x.(RefSize)) }
+func (h *sizeHeap) Pop() interface{} {
+	r := h.refs[len(h.refs)-1]
+	h.refs = h.refs[:len(h.refs)-1]
+	return r
+}
+
+// offer keeps r if it is among the n last by less seen so far.
+func (h *sizeHeap) offer(r RefSize, n int) {
+	if len(h.refs) < n {
+		heap.Push(h, r)
+	} else if h.less(h.refs[0].Size, r.Size) {
+		h.refs[0] = r
+		heap.Fix(h, 0)
+	}
+}
+
+// SizeExtremes returns the n smallest found blobs, smallest first,
+// and the n largest, largest first, in a single pass over the found
+// range. skipped is the number of blobs of unknown size, which are
+// excluded.
+func (d *DB) SizeExtremes(n int) (smallest, largest []RefSize, skipped int, err error) {
+	if n <= 0 {
+		return nil, nil, 0, fmt.Errorf("db: SizeExtremes count %d must be positive", n)
+	}
+	small := &sizeHeap{less: func(a, b int64) bool { return a > b }}
+	large := &sizeHeap{less: func(a, b int64) bool { return a < b }}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	for it.Next() {
+		p.tick()
+		ref := unpack(it.Key())[1]
+		f, err := decodeFound(it.Value())
+		if err != nil {
+			return nil, nil, skipped, fmt.Errorf("%s: %s", ref, err)
+		}
+		if f.Size < 0 {
+			skipped++
+			continue
+		}
+		r := RefSize{ref, f.Size}
+		small.offer(r, n)
+		large.offer(r, n)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, skipped, err
+	}
+	smallest, largest = small.refs, large.refs
+	sort.SliceStable(smallest, func(i, j int) bool { return smallest[i].Size < smallest[j].Size })
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+	return smallest, largest, skipped, nil
+}
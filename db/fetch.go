@@ -0,0 +1,31 @@
+package db
+
+import (
+	"fmt"
+	"io"
+)
+
+// Fetcher retrieves blob contents by ref. It is the db package's view
+// of a blobstore; db/camli adapts Camlistore's blobservers to it.
+type Fetcher interface {
+	Fetch(ref string) (io.ReadCloser, int64, error)
+}
+
+// Check verifies that a found blob can be fetched from f, and that its
+// size matches any size recorded in the index.
+func (d *DB) Check(f Fetcher, ref string) error {
+	ref = d.lookupRef(ref)
+	r, err := d.getFound(ref)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ref, err)
+	}
+	body, size, err := f.Fetch(ref)
+	if err != nil {
+		return fmt.Errorf("%s: indexed at %q but unfetchable: %s", ref, r.Location, err)
+	}
+	body.Close()
+	if r.Size >= 0 && r.Size != size {
+		return fmt.Errorf("%s: indexed with size %d but fetched %d", ref, r.Size, size)
+	}
+	return nil
+}
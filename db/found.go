@@ -0,0 +1,328 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// foundRecord is the value stored under found|ref; see found.proto.
+type foundRecord struct {
+	// Location is where the blob currently is, and First where it
+	// was first Placed.
+	Location, First string
+	// Size is -1 if unknown.
+	Size int64
+	// Duplicates are other locations the blob has been Placed at.
+	Duplicates []string
+	// Indexed is when the blob was last Placed, or zero if unknown.
+	Indexed time.Time
+}
+
+const (
+	// foundMarker starts every encoded foundRecord. Values written
+	// before foundRecord existed are a bare location, which never
+	// starts with a NUL.
+	foundMarker = 0
+	// foundVersion follows foundMarker, and identifies the encoding
+	// of the remainder of the value.
+	foundVersion = 1
+	// foundSnappy replaces foundVersion when the remainder is
+	// snappy-compressed.
+	foundSnappy = 2
+
+	foundLocation protowire.Number = 1
+	foundSize     protowire.Number = 2
+	foundDup      protowire.Number = 3
+	foundIndexed  protowire.Number = 4
+	foundFirst    protowire.Number = 5
+)
+
+var errBadFound = errors.New("db: malformed found record")
+
+func encodeFound(r foundRecord) []byte {
+	b := []byte{foundMarker, foundVersion}
+	b = protowire.AppendTag(b, foundLocation, protowire.BytesType)
+	b = protowire.AppendString(b, r.Location)
+	if r.Size >= 0 {
+		b = protowire.AppendTag(b, foundSize, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Size))
+	}
+	for _, dup := range r.Duplicates {
+		b = protowire.AppendTag(b, foundDup, protowire.BytesType)
+		b = protowire.AppendString(b, dup)
+	}
+	if !r.Indexed.IsZero() {
+		b = protowire.AppendTag(b, foundIndexed, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Indexed.UnixNano()))
+	}
+	if r.First != "" && r.First != r.Location {
+		b = protowire.AppendTag(b, foundFirst, protowire.BytesType)
+		b = protowire.AppendString(b, r.First)
+	}
+	return b
+}
+
+func decodeFound(v []byte) (r foundRecord, err error) {
+	r.Size = -1
+	defer func() {
+		if r.First == "" {
+			r.First = r.Location
+		}
+	}()
+	if len(v) == 0 || v[0] != foundMarker {
+		r.Location = string(v)
+		return
+	}
+	if len(v) < 2 {
+		return r, errBadFound
+	}
+	body := v[2:]
+	switch v[1] {
+	case foundVersion:
+	case foundSnappy:
+		if body, err = snappy.Decode(nil, body); err != nil {
+			return r, errBadFound
+		}
+	default:
+		return r, errBadFound
+	}
+	for b := body; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return r, errBadFound
+		}
+		b = b[n:]
+		switch {
+		case num == foundLocation && typ == protowire.BytesType:
+			var s string
+			s, n = protowire.ConsumeString(b)
+			r.Location = s
+		case num == foundSize && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			r.Size = int64(v)
+		case num == foundDup && typ == protowire.BytesType:
+			var s string
+			s, n = protowire.ConsumeString(b)
+			r.Duplicates = append(r.Duplicates, s)
+		case num == foundIndexed && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			r.Indexed = time.Unix(0, int64(v))
+		case num == foundFirst && typ == protowire.BytesType:
+			var s string
+			s, n = protowire.ConsumeString(b)
+			r.First = s
+		default:
+			// written by a newer version; skip it.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return r, errBadFound
+		}
+		b = b[n:]
+	}
+	return
+}
+
+// compressFound returns an encoded foundRecord snappy-compressed, if
+// that makes it smaller.
+func compressFound(v []byte) []byte {
+	if len(v) < 2 || v[0] != foundMarker || v[1] != foundVersion {
+		return v
+	}
+	c := snappy.Encode(nil, v[2:])
+	if len(c)+2 >= len(v) {
+		return v
+	}
+	return append([]byte{foundMarker, foundSnappy}, c...)
+}
+
+// foundValue encodes r for storage by d.
+func (d *DB) foundValue(r foundRecord) []byte {
+	if d.compressFound {
+		return compressFound(encodeFound(r))
+	}
+	return encodeFound(r)
+}
+
+// getFound returns the record for a found blob. The error is
+// leveldb.ErrNotFound if the index has no such blob.
+func (d *DB) getFound(ref string) (foundRecord, error) {
+	v, err := d.db.Get(pack(found, ref), nil)
+	if err != nil {
+		return foundRecord{Size: -1}, err
+	}
+	return decodeFound(v)
+}
+
+// duplicatesAfter returns the blob's duplicate locations once it is
+// Placed again at location: the current location becomes a duplicate
+// unless it is the same.
+func (r foundRecord) duplicatesAfter(location string) []string {
+	if r.Location == "" || r.Location == location {
+		return r.Duplicates
+	}
+	dups := []string{r.Location}
+	for _, dup := range r.Duplicates {
+		if dup != location && dup != r.Location {
+			dups = append(dups, dup)
+		}
+	}
+	return dups
+}
+
+// Location returns the current location of a found blob. The error is
+// leveldb.ErrNotFound if the index has no such blob.
+func (d *DB) Location(ref string) (string, error) {
+	ref = d.lookupRef(ref)
+	r, err := d.getFound(ref)
+	return r.Location, err
+}
+
+// LocationOf is Location, reporting whether the index has the blob
+// rather than returning leveldb.ErrNotFound.
+func (d *DB) LocationOf(ref string) (location string, ok bool, err error) {
+	location, err = d.Location(ref)
+	if err == ErrNotFound {
+		return "", false, nil
+	}
+	return location, err == nil, err
+}
+
+// Has reports whether ref is a found blob.
+func (d *DB) Has(ref string) (bool, error) {
+	ref = d.lookupRef(ref)
+	return d.db.Has(pack(found, ref), nil)
+}
+
+// Locations returns every location a found blob has been Placed at,
+// starting with the current one. The error is leveldb.ErrNotFound if
+// the index has no such blob.
+func (d *DB) Locations(ref string) ([]string, error) {
+	ref = d.lookupRef(ref)
+	r, err := d.getFound(ref)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{r.Location}, r.Duplicates...), nil
+}
+
+// FirstLocation returns the location a found blob was first Placed
+// at, which later Places and UpdateLocation leave alone. For blobs
+// Placed before first locations were recorded, it is their location
+// when first Placed since.
+func (d *DB) FirstLocation(ref string) (string, error) {
+	ref = d.lookupRef(ref)
+	r, err := d.getFound(ref)
+	return r.First, err
+}
+
+// UpdateLocation records that a found blob has moved to location,
+// without noting its previous location as a duplicate. The error is
+// leveldb.ErrNotFound if the index has no such blob.
+func (d *DB) UpdateLocation(ref, location string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	r, err := d.getFound(ref)
+	if err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	b.Delete(pack(located, r.Location, ref))
+	b.Put(pack(located, location, ref), nil)
+	r.Location = location
+	b.Put(pack(found, ref), d.foundValue(r))
+	return d.db.Write(b, nil)
+}
+
+// RemapLocations replaces oldPrefix with newPrefix at the start of
+// every location of every found blob, including first locations and
+// duplicates, and of the last location, such as after moving a blob
+// store. It returns the number of blobs updated. Blobs are rewritten
+// in batches, each of whole blobs, so an interrupted remap may simply
+// be rerun, provided newPrefix doesn't start with oldPrefix.
+func (d *DB) RemapLocations(oldPrefix, newPrefix string) (updated int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if oldPrefix == newPrefix {
+		return 0, nil
+	}
+	remap := func(loc string) (string, bool) {
+		if !strings.HasPrefix(loc, oldPrefix) {
+			return loc, false
+		}
+		return newPrefix + loc[len(oldPrefix):], true
+	}
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	p := d.newProgress()
+	defer p.done()
+	b := new(leveldb.Batch)
+	// pending is the number of blobs updated in b.
+	pending := 0
+	for it.Next() {
+		p.tick()
+		ref := unpack(it.Key())[1]
+		r, err := decodeFound(it.Value())
+		if err != nil {
+			return updated - pending, fmt.Errorf("%s: %s", ref, err)
+		}
+		var changed, ok bool
+		prev := r.Location
+		if r.Location, ok = remap(r.Location); ok {
+			b.Delete(pack(located, prev, ref))
+			b.Put(pack(located, r.Location, ref), nil)
+			changed = true
+		}
+		if r.First, ok = remap(r.First); ok {
+			changed = true
+		}
+		for i, dup := range r.Duplicates {
+			if r.Duplicates[i], ok = remap(dup); ok {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		b.Put(it.Key(), d.foundValue(r))
+		updated++
+		pending++
+		if pending >= renameBatch {
+			if err := d.db.Write(b, nil); err != nil {
+				return updated - pending, err
+			}
+			b.Reset()
+			pending = 0
+		}
+	}
+	if err := it.Error(); err != nil {
+		return updated - pending, err
+	}
+	if l, err := d.Last(); err != nil {
+		return updated - pending, err
+	} else if loc, ok := remap(l); ok {
+		b.Put(pack(last), []byte(loc))
+	}
+	if err := d.db.Write(b, nil); err != nil {
+		return updated - pending, err
+	}
+	return updated, nil
+}
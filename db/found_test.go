@@ -0,0 +1,194 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLocations(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "dir1/a", "file")
+	place(t, d, "a", "dir2/a", "file")
+	// Placing again at a known location isn't another duplicate
+	place(t, d, "a", "dir2/a", "file")
+	place(t, d, "b", "dir1/b", "file")
+
+	got, err := d.Locations(ref("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir2/a", "dir1/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Locations(a) = %q, want %q", got, want)
+	}
+	if got, err := d.Locations(ref("b")); err != nil || !reflect.DeepEqual(got, []string{"dir1/b"}) {
+		t.Errorf("Locations(b) = %q, %v; want just dir1/b", got, err)
+	}
+	if got := collect(d.Duplicates()); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("Duplicates = %q, want a", got)
+	}
+	if s := d.Stats(); s.Duplicates != 1 {
+		t.Errorf("Stats.Duplicates = %d, want 1", s.Duplicates)
+	}
+}
+
+func TestLocationOf(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "dir/a", "file")
+
+	if loc, ok, err := d.LocationOf(ref("a")); err != nil || !ok || loc != "dir/a" {
+		t.Errorf("LocationOf(a) = %q, %v, %v; want dir/a", loc, ok, err)
+	}
+	if ok, err := d.Has(ref("a")); err != nil || !ok {
+		t.Errorf("Has(a) = %v, %v; want true", ok, err)
+	}
+	if loc, ok, err := d.LocationOf(ref("absent")); err != nil || ok || loc != "" {
+		t.Errorf("LocationOf(absent) = %q, %v, %v; want not found", loc, ok, err)
+	}
+	if ok, err := d.Has(ref("absent")); err != nil || ok {
+		t.Errorf("Has(absent) = %v, %v; want false", ok, err)
+	}
+	if err := d.Forget(ref("a")); err != nil {
+		t.Fatal(err)
+	}
+	if loc, ok, err := d.LocationOf(ref("a")); err != nil || ok || loc != "" {
+		t.Errorf("LocationOf(a) after Forget = %q, %v, %v; want not found", loc, ok, err)
+	}
+	if ok, err := d.Has(ref("a")); err != nil || ok {
+		t.Errorf("Has(a) after Forget = %v, %v; want false", ok, err)
+	}
+}
+
+func TestNewROWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{BlockCache: 1 << 20, BloomBits: 10}
+	d, err := NewWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	place(t, d, "a", "loc", "file")
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d, err = NewROWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := d.options.GetBlockCacheCapacity(); got != 1<<20 {
+		t.Errorf("block cache = %d, want 1MiB", got)
+	}
+	if ok, err := d.Has(ref("a")); err != nil || !ok {
+		t.Errorf("Has(a) = %v, %v; want true", ok, err)
+	}
+	if ok, err := d.Has(ref("b")); err != nil || ok {
+		t.Errorf("Has(b) = %v, %v; want false", ok, err)
+	}
+	if err := d.Place(ref("b"), "loc", "", nil); err != ErrReadOnly {
+		t.Errorf("Place = %v, want ErrReadOnly", err)
+	}
+}
+
+// BenchmarkHas measures looking up blobs that aren't indexed, as Place
+// does of missing dependencies, in an index with and without bloom
+// filters.
+func BenchmarkHas(b *testing.B) {
+	for _, bits := range []int{0, 10} {
+		b.Run(fmt.Sprintf("bloom-%d", bits), func(b *testing.B) {
+			dir := b.TempDir()
+			opts := Options{BloomBits: bits}
+			d, err := NewWithOptions(dir, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			entries := make([]PlaceEntry, 100000)
+			for i := range entries {
+				entries[i] = PlaceEntry{Ref: ref(fmt.Sprint(i)), Location: "loc", Size: -1}
+			}
+			if err := d.BatchPlace(entries); err != nil {
+				b.Fatal(err)
+			}
+			if err := d.Compact(); err != nil {
+				b.Fatal(err)
+			}
+			d.Close()
+			// a cache holding the filters but few of the blocks, so
+			// that lookups without a filter mostly read the tables
+			opts.BlockCache = 1 << 20
+			d, err = NewROWithOptions(dir, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ok, err := d.Has(ref(fmt.Sprint("absent", i))); err != nil || ok {
+					b.Fatal(ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRemapLocations(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "/old/blobs/a", "file")
+	place(t, d, "b", "/old/blobs/b", "file")
+	place(t, d, "b", "/elsewhere/b", "file")
+	place(t, d, "c", "/elsewhere/c", "file")
+	place(t, d, "d", "/old/blobs/d", "file")
+
+	updated, err := d.RemapLocations("/old/blobs", "/mnt/new/blobs")
+	if err != nil || updated != 3 {
+		t.Fatalf("RemapLocations = %d, %v; want 3", updated, err)
+	}
+	for name, want := range map[string][]string{
+		"a": {"/mnt/new/blobs/a"},
+		"b": {"/elsewhere/b", "/mnt/new/blobs/b"},
+		"c": {"/elsewhere/c"},
+		"d": {"/mnt/new/blobs/d"},
+	} {
+		if got, err := d.Locations(ref(name)); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Locations(%s) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if got, err := d.FirstLocation(ref("b")); err != nil || got != "/mnt/new/blobs/b" {
+		t.Errorf("FirstLocation(b) = %q, %v", got, err)
+	}
+	if got := collect(d.BlobsAt("/mnt/new/blobs/a")); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("BlobsAt the new location = %q, want a", got)
+	}
+	if got := collect(d.BlobsAt("/old/blobs/a")); len(got) != 0 {
+		t.Errorf("BlobsAt the old location = %q, want none", got)
+	}
+	if got, err := d.Last(); err != nil || got != "/mnt/new/blobs/d" {
+		t.Errorf("Last = %q, %v; want it remapped", got, err)
+	}
+	if updated, err := d.RemapLocations("/old/blobs", "/mnt/new/blobs"); err != nil || updated != 0 {
+		t.Errorf("RemapLocations rerun = %d, %v; want 0", updated, err)
+	}
+}
+
+func TestBlobsAt(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "pack1", "file")
+	place(t, d, "b", "pack1", "file")
+	place(t, d, "c", "pack10", "file")
+	place(t, d, "d", "pack10", "file")
+	place(t, d, "e", "pack10", "file")
+
+	for _, c := range []struct {
+		location string
+		want     []string
+	}{
+		{"pack1", refs("a", "b")},
+		{"pack10", refs("c", "d", "e")},
+		{"pack", []string{}},
+	} {
+		if got := collect(d.BlobsAt(c.location)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("BlobsAt(%q) = %q, want %q", c.location, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// GeoRef is a blob and the coordinates Placed for it.
+type GeoRef struct {
+	Ref string
+	// Lat and Lng are in decimal degrees, negative to the south and
+	// west.
+	Lat, Lng float64
+}
+
+// PlaceGeo notes where a blob, such as a photo, was taken, replacing
+// any coordinates noted before. The index isn't spatial: ListGeo lists
+// every blob with coordinates, by ref.
+func (d *DB) PlaceGeo(ref string, lat, lng float64) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return fmt.Errorf("db: %s: coordinates %g, %g out of range", ref, lat, lng)
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(geo, ref), encodeGeo(lat, lng), nil)
+}
+
+func encodeGeo(lat, lng float64) []byte {
+	return []byte(strconv.FormatFloat(lat, 'g', -1, 64) + " " + strconv.FormatFloat(lng, 'g', -1, 64))
+}
+
+// ListGeo streams, in ref order, every blob with coordinates Placed by
+// PlaceGeo.
+func (d *DB) ListGeo() <-chan GeoRef {
+	ch := make(chan GeoRef)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(geo, start),
+			Limit: pack(geo, limit),
+		}, nil)
+		defer it.Release()
+		p := d.newProgress()
+		defer p.done()
+		for it.Next() {
+			p.tick()
+			g := GeoRef{Ref: unpack(it.Key())[1]}
+			var err error
+			if g.Lat, g.Lng, err = decodeGeo(string(it.Value())); err != nil {
+				errorLog.Printf("db: ListGeo: %s: %s", g.Ref, err)
+				continue
+			}
+			ch <- g
+		}
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: ListGeo: %s", err)
+		}
+	}()
+	return ch
+}
+
+func decodeGeo(v string) (lat, lng float64, err error) {
+	parts := strings.Split(v, " ")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed coordinates %q", v)
+	}
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return 0, 0, err
+	}
+	lng, err = strconv.ParseFloat(parts[1], 64)
+	return lat, lng, err
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlaceGeo(t *testing.T) {
+	d := newTestDB(t)
+	for _, g := range []GeoRef{
+		{ref("sydney"), -33.8688, 151.2093},
+		{ref("null island"), 0, 0},
+		{ref("reykjavik"), 64.1466, -21.9426},
+	} {
+		if err := d.PlaceGeo(g.Ref, g.Lat, g.Lng); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// replacing the coordinates noted before
+	if err := d.PlaceGeo(ref("reykjavik"), 64.1355, -21.8954); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PlaceGeo(ref("nowhere"), 91, 0); err == nil {
+		t.Error("PlaceGeo of latitude 91 succeeded")
+	}
+
+	var got []GeoRef
+	for g := range d.ListGeo() {
+		got = append(got, g)
+	}
+	want := map[string]GeoRef{
+		ref("sydney"):      {ref("sydney"), -33.8688, 151.2093},
+		ref("null island"): {ref("null island"), 0, 0},
+		ref("reykjavik"):   {ref("reykjavik"), 64.1355, -21.8954},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ListGeo = %v, want %v", got, want)
+	}
+	for i, g := range got {
+		if g != want[g.Ref] || i > 0 && got[i-1].Ref >= g.Ref {
+			t.Errorf("ListGeo = %v, want %v in ref order", got, want)
+			break
+		}
+	}
+
+	// coordinates are exported, as GeoRecords, and imported
+	var buf bytes.Buffer
+	if err := d.Export(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	var geos int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		r, err := DecodeRecord([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ok := r.(*GeoRecord)
+		if !ok {
+			continue
+		}
+		geos++
+		if w := want[g.Ref]; g.Lat != w.Lat || g.Lng != w.Lng {
+			t.Errorf("GeoRecord = %+v, want %v", g, w)
+		}
+		if b, _ := json.Marshal(g); string(b) != line {
+			t.Errorf("GeoRecord marshals to %s, want %s", b, line)
+		}
+	}
+	if geos != len(want) {
+		t.Errorf("exported %d GeoRecords, want %d", geos, len(want))
+	}
+	imported := newTestDB(t)
+	if err := imported.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var again []GeoRef
+	for g := range imported.ListGeo() {
+		again = append(again, g)
+	}
+	if !reflect.DeepEqual(again, got) {
+		t.Errorf("imported ListGeo = %v, want %v", again, got)
+	}
+	if err := imported.Import(strings.NewReader(`{"kind":"geo","format":1,"ref":"` + ref("a") + `"}` + "\n")); err == nil {
+		t.Error("Import of a geo record without coordinates succeeded")
+	}
+}
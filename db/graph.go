@@ -0,0 +1,543 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Children returns all immediate dependencies of a blob ref. Only
+// dependencies Placed since the child index was introduced are known,
+// until MigrateChildren is run.
+func (d *DB) Children(ref string) (children []string, err error) {
+	ref = d.lookupRef(ref)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(child, ref, start),
+		Limit: pack(child, ref, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts := unpack(it.Key())
+		children = append(children, parts[2])
+	}
+	err = it.Error()
+	return
+}
+
+// Edge is a dependency of Parent on Child.
+type Edge struct {
+	Parent, Child string
+}
+
+// Edges streams every indexed dependency in the order of the parent
+// index, ie, by Child. The stream ends, releasing the iterator, if ctx
+// is done before the consumer has read every edge.
+func (d *DB) Edges(ctx context.Context) <-chan Edge {
+	ch := make(chan Edge)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(parent, start),
+			Limit: pack(parent, limit),
+		}, nil)
+		defer it.Release()
+		for it.Next() {
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- Edge{Parent: parts[2], Child: parts[1]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: Edges: %s", err)
+		}
+	}()
+	return ch
+}
+
+// RefCount is a blob and the number of blobs that depend on it.
+type RefCount struct {
+	Ref     string
+	Parents int
+}
+
+// ByFanIn streams the blobs depended on by at least min others, in ref
+// order rather than by count, in a single pass over the parent index.
+// Refs are streamed whether or not they are found.
+func (d *DB) ByFanIn(min int) <-chan RefCount {
+	ch := make(chan RefCount)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(parent, start),
+			Limit: pack(parent, limit),
+		}, nil)
+		defer it.Release()
+		p := d.newProgress()
+		defer p.done()
+		var rc RefCount
+		for it.Next() {
+			p.tick()
+			dep := unpack(it.Key())[1]
+			if dep != rc.Ref {
+				if rc.Parents > 0 && rc.Parents >= min {
+					ch <- rc
+				}
+				rc = RefCount{Ref: dep}
+			}
+			rc.Parents++
+		}
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: ByFanIn: %s", err)
+			return
+		}
+		if rc.Parents > 0 && rc.Parents >= min {
+			ch <- rc
+		}
+	}()
+	return ch
+}
+
+// Closure returns a blob ref and all of its transitive dependencies,
+// in sorted order. Each dependency is visited once, so cycles
+// terminate.
+func (d *DB) Closure(root string) ([]string, error) {
+	return d.ClosureContext(context.Background(), root)
+}
+
+// ClosureContext is Closure, abandoning the walk with ctx's error if
+// ctx is done before it completes.
+func (d *DB) ClosureContext(ctx context.Context, root string) ([]string, error) {
+	root = d.lookupRef(root)
+	seen := map[string]bool{root: true}
+	refs := []string{root}
+	for i := 0; i < len(refs); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		children, err := d.Children(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			if !seen[c] {
+				seen[c] = true
+				refs = append(refs, c)
+			}
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// SkipChildren is returned by a Walk visit func to leave the
+// dependencies of the blob it was called with unvisited, unless they
+// are reached some other way.
+var SkipChildren = errors.New("db: skip children")
+
+// Walk calls visit with root and each of its transitive dependencies,
+// breadth first, so that depth is the fewest edges from root to the
+// blob. Each blob is visited once, so cycles terminate. If visit
+// returns SkipChildren, the blob's dependencies aren't queued; any
+// other error stops the walk and is returned. Only dependencies known
+// to Children are followed, and the walk reads a snapshot of the
+// index.
+func (d *DB) Walk(root string, visit func(ref string, depth int) error) error {
+	root = d.lookupRef(root)
+	r, release, err := d.frozen()
+	if err != nil {
+		return err
+	}
+	defer release()
+	type queued struct {
+		ref   string
+		depth int
+	}
+	seen := map[string]bool{root: true}
+	queue := []queued{{root, 0}}
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+		switch err := visit(q.ref, q.depth); err {
+		case nil:
+		case SkipChildren:
+			continue
+		default:
+			return err
+		}
+		children, err := r.Children(q.ref)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			if !seen[c] {
+				seen[c] = true
+				queue = append(queue, queued{c, q.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// SharedBlobs streams the blobs in the Closure of both rootA and
+// rootB, such as content shared by two file trees, in no particular
+// order. A root that isn't indexed has no known dependencies, so it
+// shares only itself, if the other root depends on it. Only the
+// smaller closure is held in memory, along with the blobs of the
+// larger that aren't shared; the channel is closed early if reading
+// the index fails.
+func (d *DB) SharedBlobs(rootA, rootB string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		if err := d.sharedBlobs(rootA, rootB, ch); err != nil {
+			errorLog.Printf("db: SharedBlobs %s %s: %s", rootA, rootB, err)
+		}
+	}()
+	return ch
+}
+
+func (d *DB) sharedBlobs(rootA, rootB string, ch chan<- string) error {
+	r, release, err := d.frozen()
+	if err != nil {
+		return err
+	}
+	defer release()
+	// unsent holds the smaller closure, each blob true until sent.
+	unsent, other, err := r.smallerClosure(d.lookupRef(rootA), d.lookupRef(rootB))
+	if err != nil {
+		return err
+	}
+	// The closure of a shared blob is all shared, so rather than
+	// walking it again, it is sent straight from unsent.
+	send := func(ref string) error {
+		unsent[ref] = false
+		stack := []string{ref}
+		for len(stack) > 0 {
+			ref := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			ch <- ref
+			children, err := r.Children(ref)
+			if err != nil {
+				return err
+			}
+			for _, c := range children {
+				if unsent[c] {
+					unsent[c] = false
+					stack = append(stack, c)
+				}
+			}
+		}
+		return nil
+	}
+	return r.Walk(other, func(ref string, depth int) error {
+		u, shared := unsent[ref]
+		if !shared {
+			return nil
+		}
+		if u {
+			if err := send(ref); err != nil {
+				return err
+			}
+		}
+		return SkipChildren
+	})
+}
+
+// smallerClosure walks the Closures of a and b a blob at a time, and
+// returns that of whichever is exhausted first, as a set of its blobs
+// to true, and the other root. Neither walk gets further than the
+// smaller closure.
+func (d *DB) smallerClosure(a, b string) (map[string]bool, string, error) {
+	type walk struct {
+		root  string
+		seen  map[string]bool
+		queue []string
+	}
+	walks := [2]*walk{
+		{a, map[string]bool{a: true}, []string{a}},
+		{b, map[string]bool{b: true}, []string{b}},
+	}
+	for i := 0; ; i = 1 - i {
+		w := walks[i]
+		if len(w.queue) == 0 {
+			return w.seen, walks[1-i].root, nil
+		}
+		ref := w.queue[0]
+		w.queue = w.queue[1:]
+		children, err := d.Children(ref)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, c := range children {
+			if !w.seen[c] {
+				w.seen[c] = true
+				w.queue = append(w.queue, c)
+			}
+		}
+	}
+}
+
+// ParentsPage returns up to limit immediate parents of a blob ref,
+// starting after cursor, or from the first if cursor is "". next is
+// the cursor for the following page, or "" if there are no more.
+func (d *DB) ParentsPage(ref, cursor string, limit int) (parents []string, next string, err error) {
+	ref = d.lookupRef(ref)
+	rng := util.BytesPrefix(pack(parent, ref, ""))
+	if cursor != "" {
+		rng.Start = pack(parent, ref, cursor+start)
+	}
+	return d.page(rng, limit)
+}
+
+// page returns up to limit of the final fields of the keys in rng,
+// and the final field of the last of them if there are more.
+func (d *DB) page(rng *util.Range, limit int) (refs []string, next string, err error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("db: page limit %d must be positive", limit)
+	}
+	it := d.db.NewIterator(rng, nil)
+	defer it.Release()
+	for it.Next() {
+		if len(refs) == limit {
+			next = refs[len(refs)-1]
+			break
+		}
+		parts := unpack(it.Key())
+		refs = append(refs, parts[len(parts)-1])
+	}
+	err = it.Error()
+	return
+}
+
+// MissingByRoot returns, for every found blob with no parents, the
+// number of distinct missing blobs among its transitive dependencies.
+// Roots with nothing missing are omitted. Each root is walked
+// separately, so memory is bounded by the largest tree rather than the
+// index, and cycles terminate. Only dependencies known to Children are
+// followed.
+func (d *DB) MissingByRoot() (map[string]int, error) {
+	counts := map[string]int{}
+	err := d.roots(func(root string) error {
+		n, err := d.missingBelow(root)
+		if n > 0 {
+			counts[root] = n
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Roots streams, in sorted order, the found blobs that no indexed blob
+// depends on, such as the permanodes and top-level directories of a
+// repo. Each found blob costs a seek of the parent index.
+func (d *DB) Roots() <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		err := d.roots(func(root string) error {
+			ch <- root
+			return nil
+		})
+		if err != nil {
+			errorLog.Printf("db: Roots: %s", err)
+		}
+	}()
+	return ch
+}
+
+// roots calls fn with each found blob with no parents, in order,
+// stopping at the first error.
+func (d *DB) roots(fn func(root string) error) error {
+	roots := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer roots.Release()
+	parents := d.db.NewIterator(nil, nil)
+	defer parents.Release()
+	p := d.newProgress()
+	defer p.done()
+	for roots.Next() {
+		p.tick()
+		root := unpack(roots.Key())[1]
+		k := pack(parent, root, "")
+		if parents.Seek(k) && bytes.HasPrefix(parents.Key(), k) {
+			continue
+		}
+		if err := fn(root); err != nil {
+			return err
+		}
+	}
+	if err := roots.Error(); err != nil {
+		return err
+	}
+	return parents.Error()
+}
+
+// missingBelow counts the distinct missing transitive dependencies of
+// root.
+func (d *DB) missingBelow(root string) (n int, err error) {
+	seen := map[string]bool{root: true}
+	queue := []string{root}
+	for len(queue) > 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		children, err := d.Children(ref)
+		if err != nil {
+			return n, err
+		}
+		for _, c := range children {
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			if ok, _ := d.db.Has(pack(found, c), nil); !ok {
+				n++
+				continue
+			}
+			queue = append(queue, c)
+		}
+	}
+	return n, nil
+}
+
+// BlockedIntermediates streams, in sorted order, the blobs that are
+// both missing dependencies and depended upon themselves: the interior
+// nodes of incomplete trees, whose repair unblocks the most. The
+// missing index is ordered by dependency, so the blobs with missing
+// dependencies are collected in memory before being streamed.
+func (d *DB) BlockedIntermediates() <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		blocked := map[string]bool{}
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(missing, start),
+			Limit: pack(missing, limit),
+		}, nil)
+		for it.Next() {
+			if parts := unpack(it.Key()); len(parts) == 3 {
+				blocked[parts[2]] = true
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			errorLog.Printf("db: BlockedIntermediates: %s", err)
+			return
+		}
+		refs := make([]string, 0, len(blocked))
+		for ref := range blocked {
+			refs = append(refs, ref)
+		}
+		blocked = nil
+		sort.Strings(refs)
+		parents := d.db.NewIterator(nil, nil)
+		defer parents.Release()
+		for _, ref := range refs {
+			p := pack(parent, ref, "")
+			if parents.Seek(p) && bytes.HasPrefix(parents.Key(), p) {
+				ch <- ref
+			}
+		}
+	}()
+	return ch
+}
+
+// PathLengths sends on ch the length, in edges, of every parent path
+// from ref to a blob with no parents, as StreamAllParentPaths would
+// find, without building the paths. A path that would revisit a blob
+// is abandoned, so cycles terminate; memory is bounded by the depth.
+func (d *DB) PathLengths(ref string, ch chan<- int) error {
+	ref = d.lookupRef(ref)
+	return d.pathLengths(map[string]bool{ref: true}, ref, 0, ch)
+}
+
+func (d *DB) pathLengths(onPath map[string]bool, ref string, depth int, ch chan<- int) error {
+	parents, err := d.Parents(ref)
+	if err != nil {
+		return err
+	}
+	if len(parents) == 0 {
+		ch <- depth
+		return nil
+	}
+	for _, p := range parents {
+		if onPath[p] {
+			continue
+		}
+		onPath[p] = true
+		err := d.pathLengths(onPath, p, depth+1, ch)
+		delete(onPath, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeepestPath returns the longest path of dependencies from root to a
+// blob with no known dependencies, starting with root, and its depth
+// in edges. Where several are longest, the first in ref order is
+// returned. The depth below each blob is computed once, so shared
+// subtrees aren't rewalked; a dependency that would revisit a blob on
+// the current path is skipped, so cycles terminate, but then the path
+// found through a cycle may not be the longest.
+func (d *DB) DeepestPath(root string) (path []string, depth int, err error) {
+	root = d.lookupRef(root)
+	below := map[string]deepest{}
+	if _, err := d.deepest(below, map[string]bool{root: true}, root); err != nil {
+		return nil, 0, err
+	}
+	seen := map[string]bool{}
+	for ref := root; ref != "" && !seen[ref]; ref = below[ref].next {
+		seen[ref] = true
+		path = append(path, ref)
+	}
+	return path, len(path) - 1, nil
+}
+
+// deepest is the longest path below a blob: its depth in edges, and
+// the next blob along it, or "" if none.
+type deepest struct {
+	depth int
+	next  string
+}
+
+func (d *DB) deepest(below map[string]deepest, onPath map[string]bool, ref string) (int, error) {
+	if b, ok := below[ref]; ok {
+		return b.depth, nil
+	}
+	children, err := d.Children(ref)
+	if err != nil {
+		return 0, err
+	}
+	var b deepest
+	for _, c := range children {
+		if onPath[c] {
+			continue
+		}
+		onPath[c] = true
+		n, err := d.deepest(below, onPath, c)
+		delete(onPath, c)
+		if err != nil {
+			return 0, err
+		}
+		if b.next == "" || n+1 > b.depth {
+			b = deepest{n + 1, c}
+		}
+	}
+	below[ref] = b
+	return b.depth, nil
+}
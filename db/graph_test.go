@@ -0,0 +1,186 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// refs returns the refs of names, sorted.
+func refs(names ...string) []string {
+	rs := make([]string, len(names))
+	for i, n := range names {
+		rs[i] = ref(n)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// sorted drains ch, sorted.
+func sorted(ch <-chan string) []string {
+	got := collect(ch)
+	sort.Strings(got)
+	return got
+}
+
+func TestSharedBlobs(t *testing.T) {
+	d := newTestDB(t)
+	// two trees sharing the subtree under s, one of them much larger,
+	// with a cycle through the shared subtree
+	place(t, d, "a", "loc", "directory", "a1", "s")
+	place(t, d, "b", "loc", "directory", "b1", "b2", "b3", "x")
+	place(t, d, "x", "loc", "directory", "s")
+	place(t, d, "b1", "loc", "file", "b4", "b5")
+	place(t, d, "s", "loc", "directory", "s1", "s2")
+	place(t, d, "s1", "loc", "file", "s")
+	place(t, d, "s2", "loc", "file", "s3")
+
+	want := refs("s", "s1", "s2", "s3")
+	if got := sorted(d.SharedBlobs(ref("a"), ref("b"))); !reflect.DeepEqual(got, want) {
+		t.Errorf("SharedBlobs(a, b) = %q, want %q", got, want)
+	}
+	if got := sorted(d.SharedBlobs(ref("b"), ref("a"))); !reflect.DeepEqual(got, want) {
+		t.Errorf("SharedBlobs(b, a) = %q, want %q", got, want)
+	}
+	if got := sorted(d.SharedBlobs(ref("a"), ref("b1"))); len(got) != 0 {
+		t.Errorf("SharedBlobs of disjoint trees = %q, want none", got)
+	}
+	// s3 isn't indexed, but a depends on it
+	if got := sorted(d.SharedBlobs(ref("s3"), ref("a"))); !reflect.DeepEqual(got, refs("s3")) {
+		t.Errorf("SharedBlobs(s3, a) = %q, want s3", got)
+	}
+	if got := sorted(d.SharedBlobs(ref("s1"), ref("s1"))); !reflect.DeepEqual(got, refs("s", "s1", "s2", "s3")) {
+		t.Errorf("SharedBlobs(s1, s1) = %q, want its closure", got)
+	}
+}
+
+func TestChildren(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "dir", "loc", "directory", "c1", "c2", "c3")
+	place(t, d, "other", "loc", "directory", "c2")
+
+	got, err := d.Children(ref("dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := refs("c1", "c2", "c3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Children(dir) = %q, want %q", got, want)
+	}
+	if got, err := d.Children(ref("c2")); err != nil || len(got) != 0 {
+		t.Errorf("Children(c2) = %q, %v; want none", got, err)
+	}
+
+	// drop the child entries, as an index from before them would lack
+	b := new(leveldb.Batch)
+	b.Delete(pack(child, ref("dir"), ref("c1")))
+	b.Delete(pack(child, ref("dir"), ref("c3")))
+	if err := d.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.MigrateChildren(); err != nil || n != 2 {
+		t.Fatalf("MigrateChildren = %d, %v; want 2", n, err)
+	}
+	if got, _ := d.Children(ref("dir")); !reflect.DeepEqual(got, refs("c1", "c2", "c3")) {
+		t.Errorf("Children(dir) after MigrateChildren = %q", got)
+	}
+	if n, err := d.MigrateChildren(); err != nil || n != 0 {
+		t.Errorf("MigrateChildren rerun = %d, %v; want 0", n, err)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "root", "loc", "directory", "dir", "file")
+	place(t, d, "dir", "loc", "directory", "leaf")
+	place(t, d, "file", "loc", "file", "leaf")
+	place(t, d, "leaf", "loc", "bytes")
+
+	if got := collect(d.Roots()); !reflect.DeepEqual(got, refs("root")) {
+		t.Errorf("Roots = %q, want just root", got)
+	}
+	if got, err := d.RootsOf(ref("leaf")); err != nil || !reflect.DeepEqual(got, refs("root")) {
+		t.Errorf("RootsOf(leaf) = %q, %v; want root", got, err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	d := newTestDB(t)
+	// a tree whose leaf is reached twice, with a cycle back to the root
+	place(t, d, "root", "loc", "directory", "a", "b")
+	place(t, d, "a", "loc", "directory", "leaf", "skipped")
+	place(t, d, "b", "loc", "directory", "leaf", "root", "c")
+	place(t, d, "c", "loc", "file", "under c")
+
+	visits := map[string]int{}
+	depths := map[string]int{}
+	err := d.Walk(ref("root"), func(r string, depth int) error {
+		visits[r]++
+		depths[r] = depth
+		if r == ref("c") {
+			return SkipChildren
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		ref("root"): 0, ref("a"): 1, ref("b"): 1,
+		ref("leaf"): 2, ref("skipped"): 2, ref("c"): 2,
+	}
+	if !reflect.DeepEqual(depths, want) {
+		t.Errorf("Walk visited %v, want %v", depths, want)
+	}
+	for r, n := range visits {
+		if n != 1 {
+			t.Errorf("Walk visited %s %d times", r, n)
+		}
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = d.Walk(ref("root"), func(string, int) error {
+		if n++; n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("Walk stopped after %d visits with %v, want 2 and the visit's error", n, err)
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	d := newTestDB(t)
+	// top depends on root, which depends on l and r, both of which
+	// depend on leaf: a diamond with a shared ancestor above it
+	place(t, d, "top", "loc", "directory", "root")
+	place(t, d, "root", "loc", "directory", "l", "r")
+	place(t, d, "l", "loc", "directory", "leaf")
+	place(t, d, "r", "loc", "directory", "leaf")
+	place(t, d, "leaf", "loc", "file")
+
+	for _, c := range []struct {
+		name string
+		want []string
+	}{
+		{"leaf", refs("l", "r", "root", "top")},
+		{"l", refs("root", "top")},
+		{"top", nil},
+	} {
+		got, err := d.Ancestors(ref(c.name))
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Ancestors(%s) = %q, %v; want %q", c.name, got, err, c.want)
+		}
+	}
+
+	// on a cycle, a blob is its own ancestor, but still only once
+	place(t, d, "leaf", "loc", "directory", "top")
+	got, err := d.Ancestors(ref("leaf"))
+	if want := refs("leaf", "l", "r", "root", "top"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Ancestors(leaf) on a cycle = %q, %v; want %q", got, err, want)
+	}
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// handle is the leveldb.DB under a DB, or a snapshot of one, which
+// Reopen or SnapshotReader.Refresh may replace while the DB is in use.
+// Each call, and each iterator until it's released, holds the
+// leveldb.DB or snapshot that was current when it started; a replaced
+// one is closed once the last of these is done.
+type handle struct {
+	mu  sync.RWMutex
+	cur *ldbRef
+}
+
+// reader is what leveldb.DB and leveldb.Snapshot have in common.
+type reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	NewIterator(rng *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// ldbRef counts the users of a leveldb.DB or snapshot.
+type ldbRef struct {
+	db *leveldb.DB
+	// snap, if not nil, is the snapshot of parent's db to read
+	// instead, which holds parent until it's released.
+	snap   *leveldb.Snapshot
+	parent *ldbRef
+	users  sync.WaitGroup
+	// closed is set for the reference that replaces a closed
+	// snapshot, whose reads all fail.
+	closed bool
+}
+
+func newHandle(db *leveldb.DB) *handle {
+	return &handle{cur: &ldbRef{db: db}}
+}
+
+func (r *ldbRef) reader() reader {
+	if r.closed {
+		return closedReader{}
+	}
+	if r.snap != nil {
+		return r.snap
+	}
+	return r.db
+}
+
+// close closes r, which must have no users.
+func (r *ldbRef) close() error {
+	if r.closed {
+		return nil
+	}
+	if r.snap == nil {
+		return r.db.Close()
+	}
+	r.snap.Release()
+	r.parent.release()
+	return nil
+}
+
+// snapshot returns a reference to a new snapshot of the current
+// leveldb.DB.
+func (h *handle) snapshot() (*ldbRef, error) {
+	parent := h.acquire()
+	snap, err := parent.db.GetSnapshot()
+	if err != nil {
+		parent.release()
+		return nil, err
+	}
+	return &ldbRef{db: parent.db, snap: snap, parent: parent}, nil
+}
+
+func (h *handle) isSnapshot() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cur.snap != nil
+}
+
+// acquire returns the current leveldb.DB, which must be released.
+func (h *handle) acquire() *ldbRef {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	h.cur.users.Add(1)
+	return h.cur
+}
+
+func (r *ldbRef) release() {
+	r.users.Done()
+}
+
+// swap replaces the current leveldb.DB with db, and closes the old one
+// once it's no longer in use.
+func (h *handle) swap(db *leveldb.DB) error {
+	return h.swapRef(&ldbRef{db: db})
+}
+
+// swapRef replaces the current reference with r, and closes the old
+// one once it's no longer in use.
+func (h *handle) swapRef(r *ldbRef) error {
+	h.mu.Lock()
+	old := h.cur
+	h.cur = r
+	h.mu.Unlock()
+	// acquire can't add a user to old once it's no longer current.
+	old.users.Wait()
+	return old.close()
+}
+
+func (h *handle) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	r := h.acquire()
+	defer r.release()
+	return r.reader().Get(key, ro)
+}
+
+func (h *handle) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	r := h.acquire()
+	defer r.release()
+	return r.reader().Has(key, ro)
+}
+
+// SizeOf is of the leveldb.DB even of a snapshot, whose table files
+// are the same.
+func (h *handle) SizeOf(rngs []util.Range) (leveldb.Sizes, error) {
+	r := h.acquire()
+	defer r.release()
+	return r.db.SizeOf(rngs)
+}
+
+// Put, Write and CompactRange are guarded by the DB's readOnly, which
+// is set for snapshots.
+
+func (h *handle) Put(key, value []byte, wo *opt.WriteOptions) error {
+	r := h.acquire()
+	defer r.release()
+	return r.db.Put(key, value, wo)
+}
+
+func (h *handle) Write(b *leveldb.Batch, wo *opt.WriteOptions) error {
+	r := h.acquire()
+	defer r.release()
+	return r.db.Write(b, wo)
+}
+
+func (h *handle) CompactRange(rng util.Range) error {
+	r := h.acquire()
+	defer r.release()
+	return r.db.CompactRange(rng)
+}
+
+func (h *handle) NewIterator(rng *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	r := h.acquire()
+	return &handleIterator{Iterator: r.reader().NewIterator(rng, ro), ref: r}
+}
+
+// Close closes the current leveldb.DB without waiting for its users,
+// like leveldb.DB.Close. A snapshot is replaced at once by a reference
+// whose reads fail, and released once its users are done.
+func (h *handle) Close() error {
+	h.mu.Lock()
+	r := h.cur
+	switch {
+	case r.closed:
+		h.mu.Unlock()
+		return leveldb.ErrClosed
+	case r.snap != nil:
+		h.cur = &ldbRef{db: r.db, snap: r.snap, closed: true}
+	}
+	h.mu.Unlock()
+	if r.snap == nil {
+		return r.db.Close()
+	}
+	// acquire can't add a user to r once it's no longer current.
+	r.users.Wait()
+	return r.close()
+}
+
+// closedReader is the reader of a closed snapshot.
+type closedReader struct{}
+
+func (closedReader) Get([]byte, *opt.ReadOptions) ([]byte, error) {
+	return nil, leveldb.ErrClosed
+}
+
+func (closedReader) Has([]byte, *opt.ReadOptions) (bool, error) {
+	return false, leveldb.ErrClosed
+}
+
+func (closedReader) NewIterator(*util.Range, *opt.ReadOptions) iterator.Iterator {
+	return iterator.NewEmptyIterator(leveldb.ErrClosed)
+}
+
+// handleIterator holds its leveldb.DB until it's released.
+type handleIterator struct {
+	iterator.Iterator
+	ref  *ldbRef
+	once sync.Once
+}
+
+func (it *handleIterator) Release() {
+	it.Iterator.Release()
+	it.once.Do(it.ref.release)
+}
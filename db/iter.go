@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RefIterator iterates over the refs of an index in order, skipping
+// keys with fewer fields than the index has. Unlike the streaming
+// methods it needs no goroutine, but it must be closed.
+type RefIterator struct {
+	it     iterator.Iterator
+	refPos int
+	ref    string
+	err    error
+}
+
+// NewRefIterator returns an iterator over the refs of one of the
+// "found", "missing", "type", "mime" or "ext" indexes. For found and
+// missing, filter is a prefix the refs must have; otherwise it is the
+// type, MIME type or extension to list, or "" for all of them. As
+// with Missing, a missing ref is repeated for each blob depending on
+// it.
+func (d *DB) NewRefIterator(kind, filter string) *RefIterator {
+	switch kind {
+	case found, missing:
+		return d.newRefIterator(1, util.BytesPrefix(pack(kind, filter)))
+	case extension:
+		filter = normalizeExt(filter)
+		fallthrough
+	case camliType, mimeType:
+		if filter == "" {
+			return d.newRefIterator(2, util.BytesPrefix(pack(kind, "")))
+		}
+		return d.newRefIterator(2, util.BytesPrefix(pack(kind, filter, "")))
+	}
+	return &RefIterator{err: fmt.Errorf("unknown index %q", kind)}
+}
+
+func (d *DB) newRefIterator(refPos int, rng *util.Range) *RefIterator {
+	return &RefIterator{it: d.db.NewIterator(rng, nil), refPos: refPos}
+}
+
+// Next advances the iterator, returning false when it is exhausted or
+// has failed.
+func (r *RefIterator) Next() bool {
+	if r.it == nil || r.err != nil {
+		return false
+	}
+	for r.it.Next() {
+		if parts := unpack(r.it.Key()); len(parts) > r.refPos && !truncated(parts) {
+			r.ref = parts[r.refPos]
+			return true
+		}
+	}
+	r.err = r.it.Error()
+	r.ref = ""
+	return false
+}
+
+// Ref returns the current ref.
+func (r *RefIterator) Ref() string {
+	return r.ref
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (r *RefIterator) Err() error {
+	return r.err
+}
+
+// Close releases the iterator. It may be called more than once.
+func (r *RefIterator) Close() {
+	if r.it != nil {
+		r.it.Release()
+		r.it = nil
+	}
+}
+
+// Blob is a ref streamed by the Blobs methods, or the error that ended
+// the stream early.
+type Blob struct {
+	Ref string
+	Err error
+}
+
+// MissingBlobs is MissingContext, ending the stream with a Blob
+// holding the error if the index can't be read to the end.
+func (d *DB) MissingBlobs(ctx context.Context) <-chan Blob {
+	ch := make(chan Blob)
+	go d.streamResults(ctx, ch, 1, missingRange())
+	return ch
+}
+
+// ListBlobs is ListContext, ending the stream with a Blob holding the
+// error if the index can't be read to the end.
+func (d *DB) ListBlobs(ctx context.Context, ct string) <-chan Blob {
+	ch := make(chan Blob)
+	go d.streamResults(ctx, ch, 2, typeRange(ct))
+	return ch
+}
+
+// ListMIMEBlobs is ListMIMEContext, ending the stream with a Blob
+// holding the error if the index can't be read to the end.
+func (d *DB) ListMIMEBlobs(ctx context.Context, mt string) <-chan Blob {
+	ch := make(chan Blob)
+	go d.streamResults(ctx, ch, 2, mimeRange(mt))
+	return ch
+}
+
+// streamResults is streamBlobs, sending any error on ch.
+func (d *DB) streamResults(ctx context.Context, ch chan<- Blob, refPos int, rng *util.Range) {
+	defer close(ch)
+	send := func(b Blob) bool {
+		select {
+		case ch <- b:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	err := d.scanRefs(refPos, rng, func(ref string) bool {
+		return send(Blob{Ref: ref})
+	})
+	if err != nil {
+		send(Blob{Err: err})
+	}
+}
+
+// RefsPage returns up to limit refs, in order, of one of the indexes
+// of NewRefIterator, starting after cursor, or from the first if
+// cursor is "". filter is as for NewRefIterator, except that a type,
+// MIME type or extension is required. Each missing ref is returned
+// once. next is the cursor for the following page, or "" if there are
+// no more.
+func (d *DB) RefsPage(kind, filter, cursor string, limit int) (refs []string, next string, err error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("db: page limit %d must be positive", limit)
+	}
+	var (
+		rng *util.Range
+		// keys for a ref start with refPrefix and the ref
+		refPrefix string
+		refPos    int
+	)
+	switch kind {
+	case found, missing:
+		rng = util.BytesPrefix(pack(kind, filter))
+		refPrefix, refPos = string(pack(kind, "")), 1
+	case extension:
+		filter = normalizeExt(filter)
+		fallthrough
+	case camliType, mimeType:
+		if filter == "" {
+			return nil, "", fmt.Errorf("db: paging %s requires a filter", kind)
+		}
+		rng = util.BytesPrefix(pack(kind, filter, ""))
+		refPrefix, refPos = string(pack(kind, filter, "")), 2
+	default:
+		return nil, "", fmt.Errorf("unknown index %q", kind)
+	}
+	// after returns a key past every key for ref, but before those of
+	// any greater ref.
+	after := func(ref string) []byte {
+		return []byte(refPrefix + ref + "\x01")
+	}
+	it := d.db.NewIterator(rng, nil)
+	defer it.Release()
+	var ok bool
+	if cursor != "" {
+		ok = it.Seek(after(cursor))
+	} else {
+		ok = it.Next()
+	}
+	for ; ok; ok = it.Seek(after(refs[len(refs)-1])) {
+		if len(refs) == limit {
+			next = refs[len(refs)-1]
+			break
+		}
+		refs = append(refs, unpack(it.Key())[refPos])
+	}
+	err = it.Error()
+	return
+}
+
+// ListPage is RefsPage of the refs of camliType ct, as streamed by
+// List: up to limit of them, starting after the cursor after, and the
+// cursor of the next page, or "" if there are no more.
+func (d *DB) ListPage(ct, after string, limit int) (refs []string, next string, err error) {
+	return d.RefsPage(camliType, ct, after, limit)
+}
+
+// ListMIMEPage is ListPage of the refs of MIME type mt, as streamed by
+// ListMIME.
+func (d *DB) ListMIMEPage(mt, after string, limit int) (refs []string, next string, err error) {
+	return d.RefsPage(mimeType, mt, after, limit)
+}
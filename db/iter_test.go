@@ -0,0 +1,47 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestListPage(t *testing.T) {
+	d := newTestDB(t)
+	var all []string
+	for i := 0; i < 7; i++ {
+		place(t, d, fmt.Sprint(i), "loc", "file")
+		all = append(all, ref(fmt.Sprint(i)))
+	}
+	place(t, d, "dir", "loc", "directory")
+	sort.Strings(all)
+
+	var got []string
+	cursor := ""
+	for _, want := range [][]string{all[:3], all[3:6], all[6:]} {
+		page, next, err := d.ListPage("file", cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page, want) {
+			t.Errorf("ListPage after %q = %q, want %q", cursor, page, want)
+		}
+		got = append(got, page...)
+		cursor = next
+	}
+	if cursor != "" {
+		t.Errorf("final page's next = %q, want none", cursor)
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("pages = %q, want %q", got, all)
+	}
+
+	// a page ending at the last ref has no next either
+	if page, next, err := d.ListPage("file", "", 7); err != nil || len(page) != 7 || next != "" {
+		t.Errorf("ListPage of every ref = %d refs, %q, %v; want 7 and no next", len(page), next, err)
+	}
+	if _, _, err := d.ListPage("file", "", 0); err == nil {
+		t.Error("ListPage with limit 0 succeeded")
+	}
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyFormat is the version of the key grammar below, which New records
+// in the index and checks on opening it. Version 1 separated fields
+// with '|'; see MigrateSeparator. Version 2 had no location index.
+// Version 3 didn't escape fields.
+const KeyFormat = 4
+
+// Every key is a prefix naming its index, followed by zero or more
+// fields, each preceded by sep. The indexes, their fields and their
+// values are:
+//
+//	found        ref                 foundRecord
+//	last                             location
+//	parent       dependency ref      -
+//	child        ref dependency      -
+//	missing      dependency ref      -
+//	type         camliType ref       -
+//	mime         MIME type ref       -
+//	ext          extension ref       -
+//	checkpoint   name                ref, unix nanoseconds
+//	recent       slot                sequence, ref
+//	tombstone    ref                 unix nanoseconds
+//	attr         name value ref      -
+//	source       name ref            -
+//	verified     ref                 unix nanoseconds
+//	lastverified nanoseconds ref     -
+//	derivative   original derived    -
+//	done         scanner ref         -
+//	schema       "version"           KeyFormat, in decimal
+//	geo          ref                 latitude, longitude
+//	taken        UTC time ref        -
+//	location     location ref        -
+//
+// keySpecs encodes the same grammar for ValidateKey; keep the two in
+// sync when adding an index.
+const (
+	found      = "found"
+	missing    = "missing"
+	parent     = "parent"
+	last       = "last"
+	camliType  = "type"
+	mimeType   = "mime"
+	checkpoint = "checkpoint"
+	extension  = "ext"
+	recent     = "recent"
+	child      = "child"
+	tombstone  = "tombstone"
+	attr       = "attr"
+	source     = "source"
+	// verified and lastverified index the same verification times,
+	// by ref and in time order. lastverified's nanoseconds are zero
+	// padded so that they sort.
+	verified     = "verified"
+	lastVerified = "lastverified"
+	derivative   = "derivative"
+	done         = "done"
+	schema       = "schema"
+	geo          = "geo"
+	// taken's times are RFC 3339 in UTC, so that they sort.
+	taken = "taken"
+	// located indexes found blobs by their current location, the
+	// reverse of found.
+	located = "location"
+)
+
+// sep separates the fields of a key. The fields are refs, camliTypes,
+// MIME types, filename extensions, locations, checkpoint and source
+// names; the text ones are taken from schema blobs, sniffers,
+// filenames and callers, and may contain anything, so pack escapes
+// any sep within a field, and esc, so that unpack always splits a key
+// into its fields. Being the smallest byte, sep also keeps the entries
+// for a field value ordered before those of any longer value it
+// prefixes.
+const (
+	sep = '\x00'
+	esc = '\x01'
+)
+
+// field is the kind of a key field.
+type field int
+
+const (
+	refField   field = iota // a blob ref
+	nameField               // non-empty text
+	textField               // possibly empty text
+	digitField              // decimal digits
+)
+
+// keySpec describes the keys of an index.
+type keySpec struct {
+	fields []field
+	// exported is whether Export includes the index.
+	exported bool
+}
+
+var keySpecs = map[string]keySpec{
+	found:        {[]field{refField}, true},
+	last:         {nil, true},
+	parent:       {[]field{refField, refField}, true},
+	child:        {[]field{refField, refField}, true},
+	missing:      {[]field{refField, refField}, true},
+	camliType:    {[]field{nameField, refField}, true},
+	mimeType:     {[]field{nameField, refField}, true},
+	extension:    {[]field{textField, refField}, true},
+	checkpoint:   {[]field{nameField}, true},
+	recent:       {[]field{digitField}, false},
+	tombstone:    {[]field{refField}, true},
+	attr:         {[]field{nameField, nameField, refField}, true},
+	source:       {[]field{nameField, refField}, true},
+	verified:     {[]field{refField}, false},
+	lastVerified: {[]field{digitField, refField}, false},
+	derivative:   {[]field{refField, refField}, true},
+	done:         {[]field{nameField, refField}, false},
+	schema:       {[]field{nameField}, false},
+	geo:          {[]field{refField}, true},
+	taken:        {[]field{nameField, refField}, true},
+	located:      {[]field{nameField, refField}, false},
+}
+
+// keyFields returns the fields of k, and whether there are as many as
+// its index has. Keys of a corrupt index, or a truncated write, may
+// have fewer, and are skipped rather than indexed into; Stats counts
+// them as Malformed.
+func keyFields(k []byte) ([]string, bool) {
+	parts := unpack(k)
+	spec, ok := keySpecs[parts[0]]
+	return parts, ok && len(parts) == len(spec.fields)+1
+}
+
+// truncated reports whether parts, an unpacked key, has fewer fields
+// than its index has, as a key of a truncated write may.
+func truncated(parts []string) bool {
+	spec, ok := keySpecs[parts[0]]
+	return ok && len(parts) <= len(spec.fields)
+}
+
+// ValidateKey returns an error if k isn't a key of any index.
+func ValidateKey(k []byte) error {
+	parts := unpack(k)
+	spec, ok := keySpecs[parts[0]]
+	if !ok {
+		return fmt.Errorf("db: unknown index %q", parts[0])
+	}
+	if len(parts) != len(spec.fields)+1 {
+		return fmt.Errorf("db: %s key has %d fields, want %d", parts[0], len(parts)-1, len(spec.fields))
+	}
+	for i, f := range spec.fields {
+		v := parts[i+1]
+		var ok bool
+		switch f {
+		case refField:
+			ok = validRef(v)
+		case nameField:
+			ok = v != ""
+		case textField:
+			ok = true
+		case digitField:
+			ok = v != "" && strings.Trim(v, "0123456789") == ""
+		}
+		if !ok {
+			return fmt.Errorf("db: %s key has malformed field %d %q", parts[0], i+1, v)
+		}
+	}
+	return nil
+}
+
+// validRef reports whether s looks like a blob ref: a hash name, a
+// dash and lowercase hex digits.
+func validRef(s string) bool {
+	i := strings.IndexByte(s, '-')
+	if i <= 0 || i == len(s)-1 {
+		return false
+	}
+	return strings.Trim(s[i+1:], "0123456789abcdef") == ""
+}
+
+// digestLengths are the lengths in hex digits of the digests of the
+// hashes Camlistore uses, by name.
+var digestLengths = map[string]int{
+	"sha1":   40,
+	"sha224": 56,
+	"sha256": 64,
+}
+
+// normalizeRef returns the canonical form of a blob ref: trimmed of
+// space, with lowercase hex digits. With Options.StrictRefs, a ref
+// that then isn't a known hash with a digest of the right length is an
+// error; otherwise it is used anyway, for legacy data.
+func (d *DB) normalizeRef(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if i := strings.IndexByte(ref, '-'); i > 0 {
+		ref = ref[:i+1] + strings.ToLower(ref[i+1:])
+	}
+	if !d.strictRefs {
+		return ref, nil
+	}
+	i := strings.IndexByte(ref, '-')
+	if i < 0 || len(ref)-i-1 != digestLengths[ref[:i]] || !validRef(ref) {
+		return "", fmt.Errorf("db: malformed blob ref %q", ref)
+	}
+	return ref, nil
+}
+
+// lookupRef returns ref as normalizeRef would have indexed it, for
+// queries. A ref that normalizeRef rejects can't have been indexed, so
+// is returned as is, to be found nowhere.
+func (d *DB) lookupRef(ref string) string {
+	if r, err := d.normalizeRef(ref); err == nil {
+		return r
+	}
+	return ref
+}
+
+// FindInvalidKeys streams every key in the index that fails
+// ValidateKey, such as those counted as Unknown by Stats.
+func (d *DB) FindInvalidKeys() <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(nil, nil)
+		defer it.Release()
+		for it.Next() {
+			if ValidateKey(it.Key()) != nil {
+				ch <- append([]byte(nil), it.Key()...)
+			}
+		}
+	}()
+	return ch
+}
+
+// UnknownKeys streams every key in the index that isn't in any known
+// index, ie, those counted as Unknown by Stats.
+func (d *DB) UnknownKeys() <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		it := d.db.NewIterator(nil, nil)
+		defer it.Release()
+		for it.Next() {
+			if _, ok := keySpecs[unpack(it.Key())[0]]; !ok {
+				ch <- append([]byte(nil), it.Key()...)
+			}
+		}
+	}()
+	return ch
+}
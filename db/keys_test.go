@@ -0,0 +1,313 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var packTests = [][]string{
+	{found, ref("a")},
+	{camliType, "", ref("a")},
+	{attr, "", "", ""},
+	{located, "pack|00001 4096", ref("a")},
+	{located, "a\x00b", ref("a")},
+	{located, "\x00", ""},
+	{located, "\x01\x01\x02", ref("a")},
+	{located, "trailing\x01", ref("a")},
+	{"pre\x00fix|", "\xff"},
+	{last},
+}
+
+func TestPackUnpack(t *testing.T) {
+	for _, parts := range packTests {
+		k := pack(parts[0], parts[1:]...)
+		if got := unpack(k); !reflect.DeepEqual(got, parts) {
+			t.Errorf("unpack(pack(%q)) = %q", parts, got)
+		}
+		if n := bytes.Count(k, []byte{sep}); n != len(parts)-1 {
+			t.Errorf("pack(%q) = %q has %d separators, want %d", parts, k, n, len(parts)-1)
+		}
+	}
+}
+
+func TestPackOrder(t *testing.T) {
+	// sorted by field, then by ref
+	fields := [][]string{
+		{"", ref("b")},
+		{"a", ref("a")},
+		{"a", ref("b")},
+		{"a\x00", ref("a")},
+		{"a\x00\x00", ref("a")},
+		{"a\x01", ref("a")},
+		{"a\x02", ref("a")},
+		{"ab", ref("a")},
+	}
+	var keys []string
+	for _, f := range fields {
+		keys = append(keys, string(pack(located, f...)))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("packed keys %q aren't sorted", keys)
+	}
+}
+
+func TestPlaceEscapedFields(t *testing.T) {
+	d := newTestDB(t)
+	loc := "dir|with\x00odd\x01bytes"
+	place(t, d, "a", loc, "file\x00type")
+	place(t, d, "b", loc+"\x00more", "file")
+	if got, err := d.Location(ref("a")); err != nil || got != loc {
+		t.Errorf("Location = %q, %v; want %q", got, err, loc)
+	}
+	if got := collect(d.BlobsAt(loc)); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("BlobsAt(%q) = %q, want a only", loc, got)
+	}
+	if got := collect(d.List("file\x00type")); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("List = %q, want a only", got)
+	}
+	for k := range d.FindInvalidKeys() {
+		t.Errorf("invalid key %q", k)
+	}
+}
+
+func TestMarkDoneNormalizes(t *testing.T) {
+	d := newTestDB(t)
+	r := ref("a")
+	if err := d.MarkDone("exif", " sha1-"+string(bytes.ToUpper([]byte(r[5:])))); err != nil {
+		t.Fatal(err)
+	}
+	if !d.IsDone("exif", r) {
+		t.Errorf("IsDone(%s) = false after marking its upper case form", r)
+	}
+}
+
+func TestEscapeFieldsMigration(t *testing.T) {
+	// a KeyFormat 3 index, which didn't escape esc
+	loc := "odd\x01location"
+	dir := newRawIndex(t, map[string]string{
+		string(packUnescaped(schema, "version")):       "3",
+		string(packUnescaped(located, loc, ref("a"))):  "",
+		string(packUnescaped(checkpoint, "scan")):      string(packUnescaped("at\x01ref", "1")),
+		string(packUnescaped(camliType, "file", "x")):  "",
+		string(packUnescaped(mimeType, "a\x01b", "y")): "",
+	})
+
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if v, err := d.Version(); err != nil || v != KeyFormat {
+		t.Errorf("Version = %d, %v; want %d", v, err, KeyFormat)
+	}
+	if got := collect(d.BlobsAt(loc)); !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("BlobsAt(%q) = %q, want a", loc, got)
+	}
+	if got, err := d.Checkpoint("scan"); err != nil || got != "at\x01ref" {
+		t.Errorf("Checkpoint = %q, %v; want %q", got, err, "at\x01ref")
+	}
+	if got := collect(d.List("file")); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("List(file) = %q, want x", got)
+	}
+	if got := collect(d.ListMIME("a\x01b")); !reflect.DeepEqual(got, []string{"y"}) {
+		t.Errorf("ListMIME = %q, want y", got)
+	}
+}
+
+func FuzzPackUnpack(f *testing.F) {
+	for _, parts := range packTests {
+		parts = append(parts, "", "")
+		f.Add(parts[0], parts[1], parts[2])
+	}
+	f.Add("type|x", "a|b\x00c\xff", "|")
+	f.Add("\xff", "\x00\x00\x01\x02", "\x01")
+	f.Fuzz(func(t *testing.T, prefix, a, b string) {
+		if got := unpack(pack(prefix, a, b)); !reflect.DeepEqual(got, []string{prefix, a, b}) {
+			t.Errorf("unpack(pack(%q, %q, %q)) = %q", prefix, a, b, got)
+		}
+		// packed keys sort as their fields do
+		ka, kb := pack(prefix, a, ""), pack(prefix, b, "")
+		if (a < b) != (bytes.Compare(ka, kb) < 0) {
+			t.Errorf("pack of %q and %q sort as %q and %q", a, b, ka, kb)
+		}
+	})
+}
+
+func TestWritersProduceValidKeys(t *testing.T) {
+	d := newTestDB(t)
+	a, b, c := ref("a"), ref("b"), ref("c")
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(d.PlaceBlob(PlaceEntry{Ref: a, Location: "pack 0", Type: "file", Dependencies: []string{b, c}, Size: 10, Source: "crawler"}))
+	place(t, d, "b", "pack 10", "bytes")
+	check(d.PlaceMIME(a, "image/jpeg"))
+	check(d.PlaceExtension(a, ".JPG"))
+	check(d.PlaceExtension(b, ""))
+	check(d.SetCheckpoint("scan", a))
+	check(d.PlaceTag(a, "model", "x100"))
+	check(d.PlaceAttr(a, "width", IntAttr(4000)))
+	check(d.Verified(a, time.Unix(1, 0)))
+	check(d.PlaceDerivative(a, b))
+	check(d.MarkDone("exif", a))
+	check(d.PlaceGeo(a, -33.8, 151.2))
+	check(d.PlaceTaken(a, time.Unix(1e9, 0)))
+	check(d.SetLast("pack 10"))
+	if _, err := d.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	for k := range d.FindInvalidKeys() {
+		t.Errorf("invalid key %q", k)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for _, tc := range []struct {
+		key []byte
+		ok  bool
+	}{
+		{pack(found, ref("a")), true},
+		{pack(last), true},
+		{pack(extension, "", ref("a")), true},
+		{pack(recent, "0012"), true},
+		{pack("nonesuch", ref("a")), false},
+		{pack(found), false},
+		{pack(found, ref("a"), ref("b")), false},
+		{pack(found, "sha1-XYZ"), false},
+		{pack(camliType, "", ref("a")), false},
+		{pack(recent, "12a"), false},
+	} {
+		if err := ValidateKey(tc.key); (err == nil) != tc.ok {
+			t.Errorf("ValidateKey(%q) = %v, want ok %v", tc.key, err, tc.ok)
+		}
+	}
+}
+
+func TestReadsNormalizeRefs(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "pack 0", "file", "b")
+	place(t, d, "b", "pack 1", "bytes")
+	if err := d.MarkDone("exif", ref("a")); err != nil {
+		t.Fatal(err)
+	}
+	// as a user might paste them
+	upper := func(name string) string {
+		r := ref(name)
+		return " " + r[:5] + string(bytes.ToUpper([]byte(r[5:]))) + "\n"
+	}
+	a, b := upper("a"), upper("b")
+	if ok, err := d.Has(a); err != nil || !ok {
+		t.Errorf("Has = %v, %v", ok, err)
+	}
+	if got, err := d.Location(a); err != nil || got != "pack 0" {
+		t.Errorf("Location = %q, %v", got, err)
+	}
+	if !d.IsDone("exif", a) {
+		t.Errorf("IsDone = false")
+	}
+	if got, err := d.Parents(b); err != nil || !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("Parents = %q, %v", got, err)
+	}
+	if got, err := d.Ancestors(b); err != nil || !reflect.DeepEqual(got, []string{ref("a")}) {
+		t.Errorf("Ancestors = %q, %v", got, err)
+	}
+	if got, err := d.Children(a); err != nil || !reflect.DeepEqual(got, []string{ref("b")}) {
+		t.Errorf("Children = %q, %v", got, err)
+	}
+	var walked []string
+	if err := d.Walk(a, func(ref string, depth int) error {
+		walked = append(walked, ref)
+		return nil
+	}); err != nil || !reflect.DeepEqual(walked, []string{ref("a"), ref("b")}) {
+		t.Errorf("Walk = %q, %v", walked, err)
+	}
+	if _, err := d.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := d.Has(ref("b")); ok {
+		t.Errorf("b still found after Delete of its upper case form")
+	}
+}
+
+func TestGarbageKeys(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p", "loc", "directory", "c")
+	place(t, d, "c", "loc", "file")
+	c := ref("c")
+	garbage := []string{
+		string(pack(parent)),
+		string(pack(parent, c)),
+		string(pack(child)),
+		string(pack(child, ref("p"))),
+		string(pack(camliType, "file")),
+		string(pack(mimeType)),
+		string(pack(missing, c)),
+		string(pack(found)),
+		"\xfe\xff garbage",
+	}
+	b := new(leveldb.Batch)
+	for _, k := range garbage {
+		b.Put([]byte(k), []byte("garbage"))
+	}
+	if err := d.db.Write(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.Stats()
+	if s.Malformed != uint64(len(garbage)-1) || s.Unknown != 1 {
+		t.Errorf("Stats = %d malformed, %d unknown; want %d and 1", s.Malformed, s.Unknown, len(garbage)-1)
+	}
+	if s.Blobs != 2 || s.Links != 1 || s.Missing != 0 {
+		t.Errorf("Stats = %+v, want the two blobs and their link", s)
+	}
+	if got, err := d.Parents(c); err != nil || !reflect.DeepEqual(got, []string{ref("p")}) {
+		t.Errorf("Parents(c) = %q, %v", got, err)
+	}
+	if got, err := d.Children(ref("p")); err != nil || !reflect.DeepEqual(got, []string{c}) {
+		t.Errorf("Children(p) = %q, %v", got, err)
+	}
+	paths := make(chan []string, 10)
+	if err := d.StreamAllParentPaths(c, paths); err != nil {
+		t.Errorf("StreamAllParentPaths = %v", err)
+	}
+	if got := collect(d.List("file")); !reflect.DeepEqual(got, []string{c}) {
+		t.Errorf("List(file) = %q", got)
+	}
+	if got := collect(d.List("")); len(got) != 2 {
+		t.Errorf("List() = %q, want p and c", got)
+	}
+	if got := collect(d.Missing()); len(got) != 0 {
+		t.Errorf("Missing = %q, want none", got)
+	}
+	for m := range d.MissingWithParents() {
+		t.Errorf("MissingWithParents streamed %+v", m)
+	}
+	for e := range d.Edges(context.Background()) {
+		if e != (Edge{Parent: ref("p"), Child: c}) {
+			t.Errorf("Edges streamed %+v", e)
+		}
+	}
+	if err := d.Export(ioutil.Discard, nil); err != nil {
+		t.Errorf("Export = %v", err)
+	}
+	if ss, err := d.SizeStats(); err != nil || len(ss.CamliTypes) != 2 || len(ss.MIMETypes) != 0 {
+		t.Errorf("SizeStats = %+v, %v; want file and directory only", ss, err)
+	}
+	n := 0
+	for range d.FindInvalidKeys() {
+		n++
+	}
+	if n != len(garbage) {
+		t.Errorf("FindInvalidKeys streamed %d keys, want %d", n, len(garbage))
+	}
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// At most errorLogBurst errors are logged per errorLogWindow; the rest
+// are counted, and the count logged by the first error after the
+// window ends, or returned by Suppressed.
+const (
+	errorLogBurst  = 10
+	errorLogWindow = time.Minute
+)
+
+// Logger receives the messages the package can't return as errors.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logger is where the package logs; see SetLogger.
+var logger Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// SetLogger directs the package's log messages, such as errors ending
+// streams, to l instead of the standard error, or discards them if l is
+// nil. It should be called before the package is used.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = log.New(ioutil.Discard, "", 0)
+	}
+	logger = l
+}
+
+// errorLog is the rate-limited log of errors that can't be returned,
+// such as those ending streams, so that a corrupt index doesn't flood
+// the log with an error for every key.
+var errorLog = &rateLimitedLog{burst: errorLogBurst, window: errorLogWindow}
+
+type rateLimitedLog struct {
+	burst  int
+	window time.Duration
+
+	mu         sync.Mutex
+	start      time.Time
+	logged     int
+	suppressed uint64
+	// total counts every suppressed message.
+	total uint64
+}
+
+// Printf logs to logger, unless burst messages have already been
+// logged this window.
+func (l *rateLimitedLog) Printf(format string, v ...interface{}) {
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.start) >= l.window {
+		if l.suppressed > 0 {
+			logger.Printf("db: suppressed %d errors in the last %s", l.suppressed, now.Sub(l.start).Round(time.Second))
+		}
+		l.start, l.logged, l.suppressed = now, 0, 0
+	}
+	if l.logged >= l.burst {
+		l.suppressed++
+		l.total++
+		l.mu.Unlock()
+		return
+	}
+	l.logged++
+	l.mu.Unlock()
+	logger.Printf(format, v...)
+}
+
+// Suppressed returns the total number of errors the index has declined
+// to log because too many were being logged.
+func Suppressed() uint64 {
+	errorLog.mu.Lock()
+	defer errorLog.mu.Unlock()
+	return errorLog.total
+}
@@ -0,0 +1,89 @@
+// Package metrics exposes the Stats of a db.DB for Prometheus to scrape.
+//
+// The Prometheus client library isn't a dependency, so rather than
+// implement prometheus.Collector, Handler writes the Prometheus text
+// exposition format itself. Every metric is a gauge.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// Handler returns a handler serving the Stats of d in the Prometheus
+// text format. Stats scans the whole index, so scrapes within
+// minInterval of the scan serving the last are served its results.
+// Concurrent scrapes share a scan.
+func Handler(d *db.DB, minInterval time.Duration) http.Handler {
+	return &handler{db: d, minInterval: minInterval}
+}
+
+type handler struct {
+	db          *db.DB
+	minInterval time.Duration
+
+	mu      sync.Mutex
+	scanned time.Time
+	stats   db.Stats
+}
+
+// current returns the Stats of the index as of at most minInterval
+// ago.
+func (h *handler) current() db.Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.scanned.IsZero() || time.Since(h.scanned) >= h.minInterval {
+		h.stats = h.db.Stats()
+		h.scanned = time.Now()
+	}
+	return h.stats
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.current()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b := bufio.NewWriter(w)
+	gauge(b, "cameloff_blobs", "Found blobs.", float64(s.Blobs))
+	gauge(b, "cameloff_links", "Dependencies of found blobs.", float64(s.Links))
+	gauge(b, "cameloff_missing", "Dependencies that aren't found, once per dependent.", float64(s.Missing))
+	gauge(b, "cameloff_unknown_entries", "Index entries of no known index.", float64(s.Unknown))
+	gauge(b, "cameloff_malformed_entries", "Index entries of known indexes with the wrong number of fields.", float64(s.Malformed))
+	gauge(b, "cameloff_duplicates", "Found blobs Placed at more than one location.", float64(s.Duplicates))
+	gauge(b, "cameloff_bytes", "Total size of the found blobs of known size.", float64(s.TotalBytes))
+	gauges(b, "cameloff_camli_type_blobs", "Blobs of each camliType.", "camli_type", s.CamliTypes)
+	gauges(b, "cameloff_mime_type_blobs", "Blobs of each MIME type.", "mime_type", s.MIMETypes)
+	bytes := map[string]int64{}
+	for ct, n := range s.CamliTypeBytes {
+		bytes[ct] = int64(n)
+	}
+	gauges(b, "cameloff_camli_type_bytes", "Total size of the blobs of each camliType of known size.", "camli_type", bytes)
+	b.Flush()
+}
+
+func gauge(w *bufio.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
+
+// gauges writes a gauge with a sample for each key of values, labelled
+// by label.
+func gauges(w *bufio.Writer, name, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escaper.Replace(k), values[k])
+	}
+}
+
+// escaper escapes label values as the text format requires.
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// scrape returns the samples served by h, without comments.
+func scrape(t *testing.T, h *handler) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			samples = append(samples, line)
+		}
+	}
+	return samples
+}
+
+func has(samples []string, sample string) bool {
+	for _, s := range samples {
+		if s == sample {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandler(t *testing.T) {
+	d, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, e := range []db.PlaceEntry{
+		{Ref: "sha1-0000000000000000000000000000000000000001", Location: "loc", Type: "directory", Size: 10,
+			Dependencies: []string{"sha1-0000000000000000000000000000000000000002", "sha1-0000000000000000000000000000000000000003"}},
+		{Ref: "sha1-0000000000000000000000000000000000000002", Location: "loc", Type: "file", Size: 20},
+	} {
+		if err := d.PlaceBlob(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PlaceMIME("sha1-0000000000000000000000000000000000000002", `text/x-"quoted"`); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(d, time.Hour).(*handler)
+	samples := scrape(t, h)
+	for _, want := range []string{
+		"cameloff_blobs 2",
+		"cameloff_links 2",
+		"cameloff_missing 1",
+		"cameloff_bytes 30",
+		`cameloff_camli_type_blobs{camli_type="directory"} 1`,
+		`cameloff_camli_type_blobs{camli_type="file"} 1`,
+		`cameloff_mime_type_blobs{mime_type="text/x-\"quoted\""} 1`,
+		`cameloff_camli_type_bytes{camli_type="file"} 20`,
+	} {
+		if !has(samples, want) {
+			t.Errorf("no sample %s in %q", want, samples)
+		}
+	}
+
+	// a scrape within minInterval is served the last scan
+	if err := d.Place("sha1-0000000000000000000000000000000000000003", "loc", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if samples := scrape(t, h); !has(samples, "cameloff_blobs 2") {
+		t.Errorf("scrape within minInterval = %q, want the cached 2 blobs", samples)
+	}
+	h.minInterval = 0
+	if samples := scrape(t, h); !has(samples, "cameloff_blobs 3") || !has(samples, "cameloff_missing 0") {
+		t.Errorf("scrape after minInterval = %q, want 3 blobs and none missing", samples)
+	}
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrLegacyKeys is returned by NewRO for an index of a key format too
+// old to be read in place, such as one whose keys still use the old '|'
+// separator. Opening it once with New migrates it.
+var ErrLegacyKeys = errors.New("db: index uses an older key format; open it read-write to migrate")
+
+// ErrNewerFormat is returned when opening an index whose keys are of a
+// newer KeyFormat than this version of the package understands.
+var ErrNewerFormat = errors.New("db: index uses a newer key format; upgrade to open it")
+
+// migrations[v] rewrites an index of KeyFormat v into KeyFormat v+1.
+// Each must be safe to interrupt and rerun. Register one whenever
+// KeyFormat is incremented.
+var migrations = map[int]func(*DB) error{
+	1: func(d *DB) error {
+		_, err := d.MigrateSeparator()
+		return err
+	},
+	2: indexLocations,
+	3: escapeFields,
+}
+
+// Version returns the KeyFormat of the index. Indexes that predate
+// the format being recorded report 1 if they still have legacy keys,
+// and KeyFormat otherwise.
+func (d *DB) Version() (int, error) {
+	v, ok, err := d.storedFormat()
+	if err != nil || ok {
+		return v, err
+	}
+	if d.hasLegacyKeys() {
+		return 1, nil
+	}
+	return KeyFormat, nil
+}
+
+// storedFormat returns the KeyFormat recorded in the index, and
+// whether there was one.
+func (d *DB) storedFormat() (int, bool, error) {
+	data, err := d.db.Get(pack(schema, "version"), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	v, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, false, errors.New("db: malformed key format version " + strconv.Quote(string(data)))
+	}
+	return v, true, nil
+}
+
+// checkFormat checks that d's keys are of KeyFormat as it is opened,
+// and sets d.format. A read-write index of an older format is migrated
+// first, and the format recorded. A read-only one is read as it is,
+// unless it still has legacy keys; one that predates the record is
+// taken to be of the oldest format without them, as it may be.
+func (d *DB) checkFormat() error {
+	stored, ok, err := d.storedFormat()
+	if err != nil {
+		return err
+	}
+	v, err := d.Version()
+	if err != nil {
+		return err
+	}
+	switch {
+	case v > KeyFormat:
+		return ErrNewerFormat
+	case d.readOnly && v == 1:
+		return ErrLegacyKeys
+	case d.readOnly && !ok:
+		atomic.StoreInt32(&d.format, 2)
+		return nil
+	case d.readOnly:
+		atomic.StoreInt32(&d.format, int32(v))
+		return nil
+	}
+	atomic.StoreInt32(&d.format, KeyFormat)
+	if !ok {
+		// Indexes that predate the record may have been partly
+		// migrated, so rerun every migration.
+		v = 1
+	}
+	for ; v < KeyFormat; v++ {
+		if err := migrations[v](d); err != nil {
+			return err
+		}
+	}
+	if ok && stored == KeyFormat {
+		return nil
+	}
+	return d.db.Put(pack(schema, "version"), []byte(strconv.Itoa(KeyFormat)), nil)
+}
+
+// legacySep separated the fields of keys before sep.
+const legacySep = "|"
+
+// legacyPrefixes are the indexes whose keys had fields separated by
+// legacySep. The last pointer has no fields and needs no migration.
+var legacyPrefixes = []string{found, missing, parent, camliType, mimeType, checkpoint, extension, recent, child}
+
+// migrateBatch is the number of keys MigrateSeparator rewrites at
+// once.
+const migrateBatch = 1000
+
+func (d *DB) hasLegacyKeys() bool {
+	for _, prefix := range legacyPrefixes {
+		it := d.db.NewIterator(util.BytesPrefix([]byte(prefix+legacySep)), nil)
+		ok := it.Next()
+		it.Release()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateSeparator rewrites every key using the legacy '|' separator
+// to use sep, returning the number of keys rewritten. It is safe to
+// interrupt and rerun.
+func (d *DB) MigrateSeparator() (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	n := 0
+	b := new(leveldb.Batch)
+	for _, prefix := range legacyPrefixes {
+		it := d.db.NewIterator(util.BytesPrefix([]byte(prefix+legacySep)), nil)
+		for it.Next() {
+			k, v := it.Key(), it.Value()
+			fields := legacyFields(prefix, string(k[len(prefix)+1:]))
+			if prefix == recent {
+				// the value is itself packed: sequence|ref
+				v = []byte(strings.Replace(string(v), legacySep, string(sep), 1))
+			}
+			b.Put(packUnescaped(prefix, fields...), v)
+			b.Delete(k)
+			n++
+			if b.Len() >= migrateBatch {
+				if err := d.db.Write(b, nil); err != nil {
+					it.Release()
+					return n, err
+				}
+				b.Reset()
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return n, err
+		}
+	}
+	return n, d.db.Write(b, nil)
+}
+
+// MigrateChildren adds the child entry for every dependency in the
+// parent index that lacks one, returning the number added. Indexes
+// built before the child index was introduced need this once for
+// Children, Closure and their users to see their older dependencies.
+// It is safe to interrupt and rerun.
+func (d *DB) MigrateChildren() (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	n := 0
+	b := new(leveldb.Batch)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(parent, start),
+		Limit: pack(parent, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts, ok := keyFields(it.Key())
+		if !ok {
+			continue
+		}
+		k := pack(child, parts[2], parts[1])
+		if ok, _ := d.db.Has(k, nil); ok {
+			continue
+		}
+		b.Put(k, nil)
+		n++
+		if b.Len() >= migrateBatch {
+			if err := d.db.Write(b, nil); err != nil {
+				return n, err
+			}
+			b.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return n, err
+	}
+	return n, d.db.Write(b, nil)
+}
+
+// indexLocations adds the location entry of every found blob, for
+// BlobsAt, to an index of KeyFormat 2. Rewriting existing entries is
+// harmless, so it is safe to interrupt and rerun.
+func indexLocations(d *DB) error {
+	b := new(leveldb.Batch)
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(found, start),
+		Limit: pack(found, limit),
+	}, nil)
+	defer it.Release()
+	for it.Next() {
+		parts, ok := keyFields(it.Key())
+		if !ok {
+			continue
+		}
+		r, err := decodeFound(it.Value())
+		if err != nil || r.Location == "" || strings.IndexByte(r.Location, sep) >= 0 {
+			continue
+		}
+		b.Put(packUnescaped(located, r.Location, parts[1]), nil)
+		if b.Len() >= migrateBatch {
+			if err := d.db.Write(b, nil); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return d.db.Write(b, nil)
+}
+
+// escapeFields rewrites the keys of an index of KeyFormat 3 whose
+// fields contain esc, which wasn't escaped, as pack now writes them,
+// along with the packed values of checkpoints and recent entries. Such
+// keys are rare, so it writes them all in one batch with the new
+// format, and so can't be rerun once done.
+func escapeFields(d *DB) error {
+	b := new(leveldb.Batch)
+	it := d.db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		k, v := it.Key(), it.Value()
+		parts := strings.Split(string(k), string(sep))
+		rekey := bytes.IndexByte(k, esc) >= 0
+		revalue := (parts[0] == checkpoint || parts[0] == recent) && bytes.IndexByte(v, esc) >= 0
+		if !rekey && !revalue {
+			continue
+		}
+		if revalue {
+			fields := strings.Split(string(v), string(sep))
+			v = pack(fields[0], fields[1:]...)
+		}
+		if rekey {
+			b.Delete(k)
+		}
+		b.Put(pack(parts[0], parts[1:]...), v)
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	b.Put(pack(schema, "version"), []byte("4"))
+	return d.db.Write(b, nil)
+}
+
+// packUnescaped packs fields as KeyFormat 3 did, for the migrations
+// to it.
+func packUnescaped(prefix string, fields ...string) []byte {
+	return []byte(strings.Join(append([]string{prefix}, fields...), string(sep)))
+}
+
+// legacyFields splits the fields following the prefix of a legacy key.
+// A trailing ref never contains '|', but a leading type, MIME type or
+// extension might, so for three-part keys only the last '|' separates.
+func legacyFields(prefix, rest string) []string {
+	switch prefix {
+	case missing, parent, child, camliType, mimeType, extension:
+		if i := strings.LastIndex(rest, legacySep); i >= 0 {
+			return []string{rest[:i], rest[i+1:]}
+		}
+	}
+	return []string{rest}
+}
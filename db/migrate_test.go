@@ -0,0 +1,160 @@
+package db
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newRawIndex returns the directory of an index holding just the
+// given keys and values, written as is.
+func newRawIndex(t *testing.T, kvs map[string]string) string {
+	dir := t.TempDir()
+	l, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for k, v := range kvs {
+		if err := l.Put([]byte(k), []byte(v), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMigrateSeparatorPipes(t *testing.T) {
+	a, b := ref("a"), ref("b")
+	dir := newRawIndex(t, map[string]string{
+		// a legacy found value is a bare location
+		"found|" + a:             "pack|00001 4096",
+		"found|" + b:             "pack|00002 0",
+		"type|odd|type|" + a:     "",
+		"mime|text/x|y|" + a:     "",
+		"ext|a|b|" + a:           "",
+		"parent|" + b + "|" + a:  "",
+		"child|" + a + "|" + b:   "",
+		"recent|0001":            "1|" + a,
+		"checkpoint|scan|resume": a,
+		"last":                   "pack|00002 0",
+	})
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if got, err := d.Location(a); err != nil || got != "pack|00001 4096" {
+		t.Errorf("Location(a) = %q, %v", got, err)
+	}
+	if got := collect(d.BlobsAt("pack|00002 0")); !reflect.DeepEqual(got, []string{b}) {
+		t.Errorf("BlobsAt = %q, want b", got)
+	}
+	if got := collect(d.List("odd|type")); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("List(odd|type) = %q, want a", got)
+	}
+	if got := collect(d.ListMIME("text/x|y")); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("ListMIME(text/x|y) = %q, want a", got)
+	}
+	if got := collect(d.ListExtension(".a|b")); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("ListExtension(.a|b) = %q, want a", got)
+	}
+	if got, err := d.Parents(b); err != nil || !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("Parents(b) = %q, %v; want a", got, err)
+	}
+	if got, err := d.Recent(1); err != nil || !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("Recent = %q, %v; want a", got, err)
+	}
+	if got, err := d.Checkpoint("scan|resume"); err != nil || got != a {
+		t.Errorf("Checkpoint = %q, %v; want a", got, err)
+	}
+	if got, err := d.Last(); err != nil || got != "pack|00002 0" {
+		t.Errorf("Last = %q, %v", got, err)
+	}
+	for k := range d.FindInvalidKeys() {
+		t.Errorf("invalid key %q after migration", k)
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	a := ref("a")
+	dir := newRawIndex(t, map[string]string{
+		"found|" + a:     "pack 4096",
+		"type|file|" + a: "",
+	})
+	if _, err := NewRO(dir); err != ErrLegacyKeys {
+		t.Errorf("NewRO of a legacy index = %v, want ErrLegacyKeys", err)
+	}
+	d, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Version(); err != nil || v != KeyFormat {
+		t.Errorf("Version = %d, %v after New; want %d", v, err, KeyFormat)
+	}
+	if got := collect(d.List("file")); !reflect.DeepEqual(got, []string{a}) {
+		t.Errorf("List(file) = %q, want a", got)
+	}
+	d.Close()
+
+	d, err = NewRO(dir)
+	if err != nil {
+		t.Fatalf("NewRO of the migrated index: %v", err)
+	}
+	defer d.Close()
+	if got, err := d.Location(a); err != nil || got != "pack 4096" {
+		t.Errorf("Location(a) = %q, %v", got, err)
+	}
+}
+
+func TestOpenOlderFormatRO(t *testing.T) {
+	a, b, c := ref("a"), ref("b"), ref("c")
+	kvs := map[string]string{
+		// found values of KeyFormat 2 are bare locations, and there's
+		// no index of them
+		string(pack(found, a)):             "pack1",
+		string(pack(found, b)):             "pack1",
+		string(pack(found, c)):             "pack10",
+		string(pack(camliType, "file", a)): "",
+	}
+	unversioned := newRawIndex(t, kvs)
+	kvs[string(pack(schema, "version"))] = "2"
+	for name, dir := range map[string]string{"version 2": newRawIndex(t, kvs), "unversioned": unversioned} {
+		d, err := NewRO(dir)
+		if err != nil {
+			t.Errorf("%s: NewRO = %v", name, err)
+			continue
+		}
+		if got := collect(d.BlobsAt("pack1")); !reflect.DeepEqual(got, refs("a", "b")) {
+			t.Errorf("%s: BlobsAt(pack1) = %q, want a and b", name, got)
+		}
+		if got := collect(d.BlobsAt("pack10")); !reflect.DeepEqual(got, []string{c}) {
+			t.Errorf("%s: BlobsAt(pack10) = %q, want c", name, got)
+		}
+		if got := collect(d.List("file")); !reflect.DeepEqual(got, []string{a}) {
+			t.Errorf("%s: List(file) = %q, want a", name, got)
+		}
+		d.Close()
+	}
+}
+
+func TestOpenNewerFormat(t *testing.T) {
+	dir := newRawIndex(t, map[string]string{
+		string(pack(schema, "version")): strconv.Itoa(KeyFormat + 1),
+	})
+	if _, err := New(dir); err != ErrNewerFormat {
+		t.Errorf("New = %v, want ErrNewerFormat", err)
+	}
+	if _, err := NewRO(dir); err != ErrNewerFormat {
+		t.Errorf("NewRO = %v, want ErrNewerFormat", err)
+	}
+	d, err := NewRO(newRawIndex(t, map[string]string{
+		string(pack(schema, "version")): "bogus",
+	}))
+	if err == nil {
+		d.Close()
+		t.Error("NewRO of a malformed version succeeded")
+	}
+}
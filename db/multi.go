@@ -0,0 +1,166 @@
+package db
+
+import "sort"
+
+// MultiDB answers queries against several indexes as though they were
+// one, such as an old and a new index during a migration. A blob found
+// in any of them is found. MultiDB can't modify the indexes.
+type MultiDB struct {
+	dbs []*DB
+}
+
+// NewMulti returns a MultiDB querying dbs, earlier ones taking
+// precedence where they disagree, such as over a blob's location.
+func NewMulti(dbs ...*DB) *MultiDB {
+	return &MultiDB{dbs}
+}
+
+// Close closes every index, returning the first error.
+func (m *MultiDB) Close() (err error) {
+	for _, d := range m.dbs {
+		if cerr := d.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Has returns true if any of the indexes has found ref.
+func (m *MultiDB) Has(ref string) bool {
+	for _, d := range m.dbs {
+		if ok, _ := d.db.Has(pack(found, ref), nil); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Location returns the location of ref in the first index that has
+// found it, or ErrNotFound.
+func (m *MultiDB) Location(ref string) (string, error) {
+	for _, d := range m.dbs {
+		loc, err := d.Location(ref)
+		if err != ErrNotFound {
+			return loc, err
+		}
+	}
+	return "", ErrNotFound
+}
+
+// List streams, in order and once each, the blobs of a particular type
+// in any of the indexes. As for DB.List, ct "" lists blobs of every
+// type, but then neither ordered nor once each.
+func (m *MultiDB) List(ct string) <-chan string {
+	return m.merge(func(d *DB) <-chan string { return d.List(ct) })
+}
+
+// ListMIME is List for MIME types.
+func (m *MultiDB) ListMIME(mt string) <-chan string {
+	return m.merge(func(d *DB) <-chan string { return d.ListMIME(mt) })
+}
+
+// ListExtension is List for file extensions.
+func (m *MultiDB) ListExtension(ext string) <-chan string {
+	return m.merge(func(d *DB) <-chan string { return d.ListExtension(ext) })
+}
+
+// Missing streams, in order and once each, the blobs that are missing
+// from any of the indexes and found in none.
+func (m *MultiDB) Missing() <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for ref := range m.merge((*DB).Missing) {
+			if !m.Has(ref) {
+				ch <- ref
+			}
+		}
+	}()
+	return ch
+}
+
+// Parents returns the distinct immediate parents of ref in any of the
+// indexes, in sorted order.
+func (m *MultiDB) Parents(ref string) ([]string, error) {
+	return m.union(func(d *DB) ([]string, error) { return d.Parents(ref) })
+}
+
+// Children returns the distinct immediate dependencies of ref in any
+// of the indexes, in sorted order.
+func (m *MultiDB) Children(ref string) ([]string, error) {
+	return m.union(func(d *DB) ([]string, error) { return d.Children(ref) })
+}
+
+// Stats sums the Stats of every index, so blobs in more than one are
+// counted more than once.
+func (m *MultiDB) Stats() (s Stats) {
+	s = newStats()
+	for _, d := range m.dbs {
+		s.add(d.Stats())
+	}
+	return s
+}
+
+// union returns the distinct refs returned by query for every index,
+// in sorted order.
+func (m *MultiDB) union(query func(*DB) ([]string, error)) ([]string, error) {
+	seen := map[string]bool{}
+	var refs []string
+	for _, d := range m.dbs {
+		rs, err := query(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range rs {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// merge streams the refs streamed by query for every index, each of
+// which must be ordered by ref, as a single ordered stream without
+// duplicates.
+func (m *MultiDB) merge(query func(*DB) <-chan string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		var chs []<-chan string
+		var refs []string
+		for _, d := range m.dbs {
+			c := query(d)
+			if ref, ok := <-c; ok {
+				chs = append(chs, c)
+				refs = append(refs, ref)
+			}
+		}
+		for len(chs) > 0 {
+			min := 0
+			for i := range refs {
+				if refs[i] < refs[min] {
+					min = i
+				}
+			}
+			ref := refs[min]
+			ch <- ref
+			// advance every stream past ref
+			for i := 0; i < len(chs); i++ {
+				for refs[i] == ref {
+					next, ok := <-chs[i]
+					if !ok {
+						chs = append(chs[:i], chs[i+1:]...)
+						refs = append(refs[:i], refs[i+1:]...)
+						i--
+						break
+					}
+					refs[i] = next
+				}
+			}
+		}
+	}()
+	return ch
+}
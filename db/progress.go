@@ -0,0 +1,57 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TrackProgress makes long scans of the index, such as Stats, Export,
+// DumpCSV and the streams of List, RangeFound and similar methods, call
+// fn with the number of entries they have scanned so far each time it
+// reaches a multiple of every, and once more when they finish.
+// Concurrent scans count separately, but call the same fn. It must be
+// called before any scan starts.
+func (d *DB) TrackProgress(every uint64, fn func(scanned uint64)) {
+	if every == 0 {
+		every = 1
+	}
+	d.progressEvery, d.progress = every, fn
+}
+
+// scanProgress counts the entries of a single scan, which may tick
+// from several goroutines.
+type scanProgress struct {
+	fn      func(uint64)
+	every   uint64
+	scanned uint64
+	// mu serializes calls of fn.
+	mu sync.Mutex
+}
+
+// newProgress returns the counter for a scan, which is nil, and does
+// nothing, unless TrackProgress was called.
+func (d *DB) newProgress() *scanProgress {
+	if d.progress == nil {
+		return nil
+	}
+	return &scanProgress{fn: d.progress, every: d.progressEvery}
+}
+
+// tick counts an entry.
+func (p *scanProgress) tick() {
+	if p == nil {
+		return
+	}
+	if n := atomic.AddUint64(&p.scanned, 1); n%p.every == 0 {
+		p.mu.Lock()
+		p.fn(n)
+		p.mu.Unlock()
+	}
+}
+
+// done reports the final count, unless tick just did.
+func (p *scanProgress) done() {
+	if p != nil && p.scanned%p.every != 0 {
+		p.fn(p.scanned)
+	}
+}
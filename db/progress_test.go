@@ -0,0 +1,41 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestTrackProgress(t *testing.T) {
+	d := newTestDB(t)
+	var mu sync.Mutex
+	var calls []uint64
+	d.TrackProgress(10, func(scanned uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, scanned)
+	})
+	for i := 0; i < 25; i++ {
+		place(t, d, fmt.Sprint(i), "loc", "file")
+	}
+	if got := collect(d.List("file")); len(got) != 25 {
+		t.Fatalf("List streamed %d refs, want 25", len(got))
+	}
+	if want := []uint64{10, 20, 25}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("List progress = %v, want %v", calls, want)
+	}
+
+	calls = nil
+	collect(d.RangeFound("", ""))
+	if want := []uint64{10, 20, 25}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("RangeFound progress = %v, want %v", calls, want)
+	}
+
+	// Stats scans every entry, in parallel, as a single scan
+	calls = nil
+	d.Stats()
+	if len(calls) == 0 || calls[len(calls)-1] < 25*4 {
+		t.Errorf("Stats progress = %v, want a final count of every entry", calls)
+	}
+}
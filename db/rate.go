@@ -0,0 +1,77 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// rateCounter counts events in one-second buckets over a sliding
+// window.
+type rateCounter struct {
+	mu      sync.Mutex
+	buckets []rateBucket
+}
+
+type rateBucket struct {
+	sec           int64
+	places, bytes uint64
+}
+
+func newRateCounter(window time.Duration) *rateCounter {
+	secs := int(window / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return &rateCounter{buckets: make([]rateBucket, secs)}
+}
+
+// add counts places written in bytes.
+func (r *rateCounter) add(now time.Time, places, bytes int) {
+	sec := now.Unix()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := &r.buckets[sec%int64(len(r.buckets))]
+	if b.sec != sec {
+		*b = rateBucket{sec: sec}
+	}
+	b.places += uint64(places)
+	b.bytes += uint64(bytes)
+}
+
+// rate returns the per-second averages over the window ending at now.
+func (r *rateCounter) rate(now time.Time) (places, bytes float64) {
+	sec := now.Unix()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range r.buckets {
+		if b.sec > sec-int64(len(r.buckets)) && b.sec <= sec {
+			places += float64(b.places)
+			bytes += float64(b.bytes)
+		}
+	}
+	n := float64(len(r.buckets))
+	return places / n, bytes / n
+}
+
+// TrackWriteRate starts measuring the rate of Place calls, averaged
+// over window, for WriteRate. It may be called while Places are in
+// progress.
+func (d *DB) TrackWriteRate(window time.Duration) {
+	d.rate.Store(newRateCounter(window))
+}
+
+// writeRate returns the counter set by TrackWriteRate, or nil.
+func (d *DB) writeRate() *rateCounter {
+	r, _ := d.rate.Load().(*rateCounter)
+	return r
+}
+
+// WriteRate returns the recent rates of Place calls and of bytes they
+// wrote. Both are zero unless TrackWriteRate was called.
+func (d *DB) WriteRate() (placesPerSec, bytesPerSec float64) {
+	r := d.writeRate()
+	if r == nil {
+		return 0, 0
+	}
+	return r.rate(time.Now())
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteRate(t *testing.T) {
+	d := newTestDB(t)
+	if p, b := d.WriteRate(); p != 0 || b != 0 {
+		t.Errorf("untracked WriteRate = %v, %v; want 0, 0", p, b)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := d.Place(ref(fmt.Sprint(i)), "loc", "", nil); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	// tracking starts while Places are in progress
+	d.TrackWriteRate(time.Minute)
+	wg.Wait()
+	place(t, d, "last", "loc", "")
+	if p, b := d.WriteRate(); p <= 0 || b <= 0 {
+		t.Errorf("WriteRate = %v, %v; want both positive", p, b)
+	}
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ExportFormat is the version of the Export format, written in every
+// record. Records without a version are from before it was written,
+// and are otherwise the same as version 1.
+const ExportFormat = 1
+
+// RecordHeader is common to every line of the Export format. Kind is
+// the name of the index the entry came from.
+type RecordHeader struct {
+	Kind   string `json:"kind"`
+	Format int    `json:"format,omitempty"`
+}
+
+// Header returns h, so that every record (which embeds a RecordHeader)
+// implements Record.
+func (h RecordHeader) Header() RecordHeader {
+	return h
+}
+
+// Record is a decoded line of the Export format: a *FoundRecord,
+// *ParentRecord, *MissingRecord, *TypeRecord, *MIMERecord, *GeoRecord,
+// *TakenRecord or, for the other kinds, an *OtherRecord. The typed
+// records marshal to the same JSON as Export writes.
+type Record interface {
+	Header() RecordHeader
+}
+
+// FoundRecord is a found blob.
+type FoundRecord struct {
+	RecordHeader
+	Ref      string `json:"ref"`
+	Location string `json:"location,omitempty"`
+	// Size is nil if unknown.
+	Size *int64 `json:"size,omitempty"`
+	// First is where the blob was first Placed, if not Location.
+	First string `json:"first,omitempty"`
+	// Duplicates are the blob's other locations.
+	Duplicates []string `json:"duplicates,omitempty"`
+	// Time is when the blob was indexed, if known.
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// ParentRecord is a dependency of Ref on Dep. Both the parent and the
+// child index are exported as ParentRecords, distinguished by Kind.
+type ParentRecord struct {
+	RecordHeader
+	Ref string `json:"ref"`
+	Dep string `json:"dep"`
+}
+
+// MissingRecord notes that Ref depends on Dep, which isn't found.
+type MissingRecord struct {
+	RecordHeader
+	Ref string `json:"ref"`
+	Dep string `json:"dep"`
+}
+
+// TypeRecord is the camliType of a blob.
+type TypeRecord struct {
+	RecordHeader
+	Ref  string `json:"ref"`
+	Type string `json:"type"`
+}
+
+// MIMERecord is the MIME type of a blob.
+type MIMERecord struct {
+	RecordHeader
+	Ref  string `json:"ref"`
+	MIME string `json:"mime"`
+}
+
+// GeoRecord is where a blob, such as a photo, was taken, as noted by
+// PlaceGeo.
+type GeoRecord struct {
+	RecordHeader
+	Ref string  `json:"ref"`
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// TakenRecord is when a blob, such as a photo, was taken, as noted by
+// PlaceTaken.
+type TakenRecord struct {
+	RecordHeader
+	Ref  string    `json:"ref"`
+	Time time.Time `json:"time"`
+}
+
+// OtherRecord is a record of a kind without a type of its own, such as
+// an extension, checkpoint or tombstone. Raw is the whole line.
+type OtherRecord struct {
+	RecordHeader
+	Raw json.RawMessage `json:"-"`
+}
+
+// DecodeRecord decodes a line of the Export format, dispatching on its
+// kind. It returns an error for records of a newer format.
+func DecodeRecord(data []byte) (Record, error) {
+	var h RecordHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	var r Record
+	switch h.Kind {
+	case found:
+		r = new(FoundRecord)
+	case parent, child:
+		r = new(ParentRecord)
+	case missing:
+		r = new(MissingRecord)
+	case camliType:
+		r = new(TypeRecord)
+	case mimeType:
+		r = new(MIMERecord)
+	case geo:
+		r = new(GeoRecord)
+	case taken:
+		r = new(TakenRecord)
+	default:
+		raw := append(json.RawMessage(nil), data...)
+		return &OtherRecord{RecordHeader: h, Raw: raw}, nil
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// check returns an error if h is from a format this package can't
+// read.
+func (h RecordHeader) check() error {
+	if h.Kind == "" {
+		return errors.New("db: record has no kind")
+	}
+	if h.Format > ExportFormat {
+		return fmt.Errorf("db: %s record is format %d; this version reads up to %d", h.Kind, h.Format, ExportFormat)
+	}
+	return nil
+}
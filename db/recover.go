@@ -0,0 +1,59 @@
+package db
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Recover opens an index that can't be opened because its leveldb
+// MANIFEST is missing or corrupt, such as after an unclean shutdown,
+// by rebuilding the MANIFEST from whatever tables can be read. This is
+// a last resort: corrupt blocks and unreadable tables are dropped, and
+// the entries in them lost. leveldb's account of what it recovered and
+// dropped is logged.
+//
+// Dropped entries can leave the index inconsistent, so after
+// recovering, run ResolveMissing to rebuild the missing index and
+// FindInvalidKeys to look for damaged keys, and consider rescanning
+// the blobs from the start to Place any that were lost.
+func Recover(path string) (*DB, error) {
+	logPath := filepath.Join(path, "LOG")
+	var offset int64
+	if fi, err := os.Stat(logPath); err == nil {
+		offset = fi.Size()
+	}
+	o := &opt.Options{}
+	db, err := leveldb.RecoverFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	logRecovery(logPath, offset)
+	return wrap(db, Options{}, o)
+}
+
+// logRecovery logs the lines about recovery leveldb wrote to its LOG
+// file after offset.
+func logRecovery(logPath string, offset int64) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		logger.Printf("db: recovery log: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		logger.Printf("db: recovery log: %s", err)
+		return
+	}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if strings.Contains(lines.Text(), "@recovery") {
+			logger.Printf("%s", lines.Text())
+		}
+	}
+}
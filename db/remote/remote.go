@@ -0,0 +1,189 @@
+// Package remote serves the read methods of a db.DB over net/rpc.
+//
+// leveldb allows only one process to open an index at a time, so the
+// process that writes to it (eg. a scan) serves it, and any other
+// process queries it through a Client. Writes remain single-process:
+// only the owning server writes to the index.
+package remote
+
+import (
+	"net"
+	"net/rpc"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// name is the net/rpc service name.
+const name = "DB"
+
+// Server is the net/rpc service wrapping a db.DB. Its methods are only
+// exported for net/rpc's benefit; use Client instead.
+type Server struct {
+	db *db.DB
+}
+
+// Serve answers requests for d on connections accepted from l until l
+// fails.
+func Serve(l net.Listener, d *db.DB) error {
+	s := rpc.NewServer()
+	if err := s.RegisterName(name, &Server{d}); err != nil {
+		return err
+	}
+	s.Accept(l)
+	return nil
+}
+
+func collect(ch <-chan string) []string {
+	refs := []string{}
+	for ref := range ch {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func (s *Server) List(ct string, refs *[]string) error {
+	*refs = collect(s.db.List(ct))
+	return nil
+}
+
+func (s *Server) ListMIME(mt string, refs *[]string) error {
+	*refs = collect(s.db.ListMIME(mt))
+	return nil
+}
+
+func (s *Server) ListExtension(ext string, refs *[]string) error {
+	*refs = collect(s.db.ListExtension(ext))
+	return nil
+}
+
+func (s *Server) Missing(_ bool, refs *[]string) error {
+	*refs = collect(s.db.Missing())
+	return nil
+}
+
+func (s *Server) Recent(n int, refs *[]string) (err error) {
+	*refs, err = s.db.Recent(n)
+	return
+}
+
+func (s *Server) Parents(ref string, refs *[]string) (err error) {
+	*refs, err = s.db.Parents(ref)
+	return
+}
+
+func (s *Server) Children(ref string, refs *[]string) (err error) {
+	*refs, err = s.db.Children(ref)
+	return
+}
+
+func (s *Server) Closure(ref string, refs *[]string) (err error) {
+	*refs, err = s.db.Closure(ref)
+	return
+}
+
+func (s *Server) RootsOf(ref string, refs *[]string) (err error) {
+	*refs, err = s.db.RootsOf(ref)
+	return
+}
+
+func (s *Server) Info(refs []string, infos *[]db.RefInfo) error {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, ref := range refs {
+			ch <- ref
+		}
+	}()
+	*infos = []db.RefInfo{}
+	for info := range s.db.Info(ch) {
+		*infos = append(*infos, info)
+	}
+	return nil
+}
+
+func (s *Server) Last(_ bool, location *string) (err error) {
+	*location, err = s.db.Last()
+	return
+}
+
+func (s *Server) Checkpoint(cp string, ref *string) (err error) {
+	*ref, err = s.db.Checkpoint(cp)
+	return
+}
+
+func (s *Server) Stats(_ bool, stats *db.Stats) error {
+	*stats = s.db.Stats()
+	return nil
+}
+
+func (s *Server) SizeStats(_ bool, stats *db.SizeStats) (err error) {
+	*stats, err = s.db.SizeStats()
+	return
+}
+
+// Client queries a db.DB served by Serve. Its methods mirror those of
+// db.DB, except that streams are returned whole.
+type Client struct {
+	c *rpc.Client
+}
+
+// Dial connects to the server at address on the named network.
+func Dial(network, address string) (*Client, error) {
+	c, err := rpc.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c}, nil
+}
+
+func (c *Client) refs(method string, args interface{}) (refs []string, err error) {
+	err = c.c.Call(name+"."+method, args, &refs)
+	return
+}
+
+func (c *Client) List(ct string) ([]string, error) { return c.refs("List", ct) }
+
+func (c *Client) ListMIME(mt string) ([]string, error) { return c.refs("ListMIME", mt) }
+
+func (c *Client) ListExtension(ext string) ([]string, error) { return c.refs("ListExtension", ext) }
+
+func (c *Client) Missing() ([]string, error) { return c.refs("Missing", false) }
+
+func (c *Client) Recent(n int) ([]string, error) { return c.refs("Recent", n) }
+
+func (c *Client) Parents(ref string) ([]string, error) { return c.refs("Parents", ref) }
+
+func (c *Client) Children(ref string) ([]string, error) { return c.refs("Children", ref) }
+
+func (c *Client) Closure(ref string) ([]string, error) { return c.refs("Closure", ref) }
+
+func (c *Client) RootsOf(ref string) ([]string, error) { return c.refs("RootsOf", ref) }
+
+func (c *Client) Info(refs []string) (infos []db.RefInfo, err error) {
+	err = c.c.Call(name+".Info", refs, &infos)
+	return
+}
+
+func (c *Client) Last() (location string, err error) {
+	err = c.c.Call(name+".Last", false, &location)
+	return
+}
+
+func (c *Client) Checkpoint(cp string) (ref string, err error) {
+	err = c.c.Call(name+".Checkpoint", cp, &ref)
+	return
+}
+
+func (c *Client) Stats() (s db.Stats, err error) {
+	err = c.c.Call(name+".Stats", false, &s)
+	return
+}
+
+func (c *Client) SizeStats() (s db.SizeStats, err error) {
+	err = c.c.Call(name+".SizeStats", false, &s)
+	return
+}
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Reopen switches d to the index at path, which is opened as d was,
+// without interrupting its use: calls and iterators already in
+// progress finish against the old index, which is closed once they
+// have. Reopen waits for this, so returns only once the old index is
+// closed.
+//
+// To reindex a running server without downtime, build the new index
+// in a fresh directory and Reopen the server there, alternating
+// between two directories; the live directory can't be replaced by
+// SwapIndex while it's open.
+func (d *DB) Reopen(path string) error {
+	if d.db.isSnapshot() {
+		return ErrSnapshot
+	}
+	db, err := leveldb.OpenFile(path, d.options)
+	if err != nil {
+		return err
+	}
+	check := &DB{db: newHandle(db), readOnly: d.readOnly}
+	if err := check.checkFormat(); err != nil {
+		db.Close()
+		return err
+	}
+	// The ring of recently placed blobs is reloaded from the new index.
+	d.recentMu.Lock()
+	d.recentSeq = 0
+	d.recentMu.Unlock()
+	// Until the swap, calls may be against either index, so must not
+	// rely on what only the newer of them has.
+	format := atomic.LoadInt32(&check.format)
+	if format < atomic.LoadInt32(&d.format) {
+		atomic.StoreInt32(&d.format, format)
+	}
+	err = d.db.swap(db)
+	atomic.StoreInt32(&d.format, format)
+	return err
+}
+
+// backupSuffix is appended to the live index's directory by SwapIndex.
+const backupSuffix = ".old"
+
+// SwapIndex replaces the index directory livePath, if any, with the
+// index directory newPath, keeping the old index as livePath+".old"
+// and removing any previous index there. If the second rename fails,
+// the old index is moved back.
+//
+// Neither index may be open, by this or any other process, and
+// SwapIndex returns an error if either is. leveldb opens table files
+// by name as it needs them, so an index open across the renames would
+// read the other index's files; and some platforms, such as Windows,
+// don't allow renaming a directory with open files at all. livePath
+// and newPath must be on the same filesystem for the renames to be
+// atomic.
+func SwapIndex(livePath, newPath string) error {
+	if err := checkClosed(newPath); err != nil {
+		return fmt.Errorf("new index %s: %s", newPath, err)
+	}
+	backup := filepath.Clean(livePath) + backupSuffix
+	_, err := os.Stat(livePath)
+	live := err == nil
+	switch {
+	case live:
+		if err := checkClosed(livePath); err != nil {
+			return fmt.Errorf("live index %s: %s", livePath, err)
+		}
+		if err := os.RemoveAll(backup); err != nil {
+			return err
+		}
+		if err := os.Rename(livePath, backup); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := os.Rename(newPath, livePath); err != nil {
+		if live {
+			if rerr := os.Rename(backup, livePath); rerr != nil {
+				return fmt.Errorf("%s; restoring %s: %s", err, livePath, rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// checkClosed returns an error unless path is an existing index that
+// nothing has open, which leveldb's lock file detects.
+func checkClosed(path string) error {
+	db, err := leveldb.OpenFile(path, &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
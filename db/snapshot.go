@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSnapshot is returned by methods that can't be used on a
+// SnapshotReader.
+var ErrSnapshot = errors.New("db: not supported by a snapshot")
+
+// SnapshotReader offers the read methods of a DB against a snapshot of
+// it, so that concurrent readers, such as the handlers of a server,
+// all see the same consistent index however it's being written. Its
+// write methods return ErrReadOnly.
+//
+// The snapshot holds the DB's leveldb.DB, so a Reopen of the DB waits
+// until the reader is refreshed or closed.
+type SnapshotReader struct {
+	*DB
+	parent *DB
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Reader returns a SnapshotReader of d as it is now.
+func (d *DB) Reader() (*SnapshotReader, error) {
+	if d.db.isSnapshot() {
+		return nil, ErrSnapshot
+	}
+	r, err := d.db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotReader{
+		DB: &DB{
+			db:            &handle{cur: r},
+			readOnly:      true,
+			format:        atomic.LoadInt32(&d.format),
+			progress:      d.progress,
+			progressEvery: d.progressEvery,
+			strictRefs:    d.strictRefs,
+		},
+		parent: d,
+	}, nil
+}
+
+// frozen returns d as it is now, for reads that must all see the same
+// index, and a func to call once they're done. If d is already a
+// snapshot, it is returned as is.
+func (d *DB) frozen() (*DB, func(), error) {
+	if d.db.isSnapshot() {
+		return d, func() {}, nil
+	}
+	r, err := d.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.DB, func() { r.Close() }, nil
+}
+
+// Refresh moves the reader to a snapshot of the DB as it is now. Reads
+// in progress finish against the old snapshot, which is released once
+// they have.
+func (s *SnapshotReader) Refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSnapshot
+	}
+	r, err := s.parent.db.snapshot()
+	if err != nil {
+		return err
+	}
+	return s.DB.db.swapRef(r)
+}
+
+// Close releases the snapshot once reads in progress are done. It
+// doesn't close the DB, and may be called more than once.
+func (s *SnapshotReader) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.DB.db.Close()
+}
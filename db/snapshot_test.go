@@ -0,0 +1,89 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestReader(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "p1", "loc", "directory", "c")
+	r, err := d.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	place(t, d, "p2", "loc", "directory", "c")
+	if err := d.Forget(ref("p1")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Parents(ref("c")); err != nil || !reflect.DeepEqual(got, refs("p1")) {
+		t.Errorf("snapshot Parents(c) = %q, %v; want p1", got, err)
+	}
+	if got, err := r.Children(ref("p1")); err != nil || !reflect.DeepEqual(got, refs("c")) {
+		t.Errorf("snapshot Children(p1) = %q, %v; want c", got, err)
+	}
+	if got := collect(r.List("directory")); !reflect.DeepEqual(got, refs("p1")) {
+		t.Errorf("snapshot List(directory) = %q, want p1", got)
+	}
+	if got, err := d.Parents(ref("c")); err != nil || !reflect.DeepEqual(got, refs("p2")) {
+		t.Errorf("Parents(c) = %q, %v; want p2", got, err)
+	}
+	if err := r.Place(ref("x"), "loc", "", nil); err != ErrReadOnly {
+		t.Errorf("snapshot Place = %v, want ErrReadOnly", err)
+	}
+
+	if err := r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Parents(ref("c")); err != nil || !reflect.DeepEqual(got, refs("p2")) {
+		t.Errorf("refreshed Parents(c) = %q, %v; want p2", got, err)
+	}
+	r.Close()
+	if err := r.Refresh(); err != ErrSnapshot {
+		t.Errorf("Refresh after Close = %v, want ErrSnapshot", err)
+	}
+}
+
+func TestReaderCloseConcurrent(t *testing.T) {
+	d := newTestDB(t)
+	place(t, d, "a", "loc", "file")
+	for i := 0; i < 20; i++ {
+		r, err := d.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan bool)
+		for g := 0; g < 4; g++ {
+			go func() {
+				defer func() { done <- true }()
+				for {
+					// reads either see the snapshot or fail once it's closed
+					ok, err := r.Has(ref("a"))
+					if err == leveldb.ErrClosed {
+						return
+					}
+					if err != nil || !ok {
+						t.Errorf("snapshot Has(a) = %t, %v", ok, err)
+						return
+					}
+				}
+			}()
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for g := 0; g < 4; g++ {
+			<-done
+		}
+		if got := collect(r.List("file")); len(got) != 0 {
+			t.Errorf("List of a closed snapshot = %q, want none", got)
+		}
+	}
+	if ok, err := d.Has(ref("a")); err != nil || !ok {
+		t.Errorf("Has(a) after closing snapshots = %t, %v", ok, err)
+	}
+}
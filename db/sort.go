@@ -0,0 +1,104 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// SortKey orders the results of ListSorted.
+type SortKey struct {
+	// Attr names the attribute to sort by, such as a capture date
+	// Placed with PlaceAttr. If empty, blobs are sorted by size.
+	Attr string
+	// Descending sorts largest or latest first.
+	Descending bool
+}
+
+// ListSorted streams all known blobs of a particular type, as List,
+// ordered by the chosen key. Blobs of unknown size, or without the
+// attribute, follow the rest in ref order. A blob with several values
+// of the attribute is ordered by the first in the chosen order.
+//
+// Unlike List, ListSorted holds every ref of the type in memory, and
+// streams nothing until it has read them all. Sorting by size also
+// looks up every blob's size; sorting by attribute instead walks the
+// attribute's index in order, which is cheaper if the attribute is
+// rare, and costlier if the type is.
+func (d *DB) ListSorted(ct string, by SortKey) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		var (
+			refs []string
+			seen = make(map[string]bool)
+		)
+		for ref := range d.List(ct) {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+		sort.Strings(refs)
+		if by.Attr == "" {
+			d.sortBySize(ch, refs, by.Descending)
+		} else {
+			d.sortByAttr(ch, refs, seen, by)
+		}
+	}()
+	return ch
+}
+
+func (d *DB) sortBySize(ch chan<- string, refs []string, descending bool) {
+	sizes := make(map[string]int64, len(refs))
+	for _, ref := range refs {
+		r, err := d.getFound(ref)
+		if err != nil {
+			r.Size = -1
+		}
+		sizes[ref] = r.Size
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		a, b := sizes[refs[i]], sizes[refs[j]]
+		if a < 0 || b < 0 {
+			return b < 0 && a >= 0
+		}
+		if descending {
+			return a > b
+		}
+		return a < b
+	})
+	for _, ref := range refs {
+		ch <- ref
+	}
+}
+
+// sortByAttr streams refs in order of by.Attr. pending holds refs, and
+// is emptied as they are streamed.
+func (d *DB) sortByAttr(ch chan<- string, refs []string, pending map[string]bool, by SortKey) {
+	it := d.db.NewIterator(&util.Range{
+		Start: pack(attr, by.Attr, start),
+		Limit: pack(attr, by.Attr, limit),
+	}, nil)
+	next, ok := it.Next, it.First()
+	if by.Descending {
+		next, ok = it.Prev, it.Last()
+	}
+	for ; ok; ok = next() {
+		if parts, valid := keyFields(it.Key()); valid && pending[parts[3]] {
+			ref := parts[3]
+			delete(pending, ref)
+			ch <- ref
+		}
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		errorLog.Printf("db: ListSorted by %s: %s", by.Attr, err)
+	}
+	for _, ref := range refs {
+		if pending[ref] {
+			ch <- ref
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// sqlBatch is the number of rows ExportSQL inserts per statement.
+	sqlBatch = 500
+	// sqlTxn is the number of statements per transaction.
+	sqlTxn = 100
+)
+
+// sqlSchema is the schema written by ExportSQL.
+const sqlSchema = `CREATE TABLE blobs (ref TEXT PRIMARY KEY, location TEXT NOT NULL, size INTEGER, indexed INTEGER);
+CREATE TABLE edges (parent TEXT NOT NULL, child TEXT NOT NULL);
+CREATE TABLE types (ref TEXT NOT NULL, type TEXT NOT NULL);
+CREATE TABLE mimes (ref TEXT NOT NULL, mime TEXT NOT NULL);
+CREATE TABLE exts (ref TEXT NOT NULL, ext TEXT NOT NULL);
+`
+
+// sqlIndexes are created once the tables are loaded, which is faster
+// than maintaining them during the inserts.
+const sqlIndexes = `CREATE INDEX edges_child ON edges (child);
+CREATE INDEX edges_parent ON edges (parent);
+CREATE INDEX types_type ON types (type);
+CREATE INDEX mimes_mime ON mimes (mime);
+CREATE INDEX exts_ext ON exts (ext);
+`
+
+// ExportSQL writes the inventory as a SQL script that creates and
+// fills tables of found blobs, with their sizes and times of indexing
+// in unix nanoseconds, where known; of dependency edges; and of
+// camliTypes, MIME types and extensions. Loading it, such as with
+//
+//	sqlite3 inventory.db < inventory.sql
+//
+// or DuckDB's .read, allows queries the index can't answer
+// efficiently. Rows are inserted in batches within transactions, and
+// streamed from a scan of each index, so memory is bounded.
+func (d *DB) ExportSQL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(sqlSchema)
+	p := d.newProgress()
+	defer p.done()
+	tables := []struct {
+		table, prefix string
+		row           func(parts []string, value []byte) ([]string, error)
+	}{
+		{"blobs", found, func(parts []string, value []byte) ([]string, error) {
+			f, err := decodeFound(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", parts[1], err)
+			}
+			size, indexed := "NULL", "NULL"
+			if f.Size >= 0 {
+				size = strconv.FormatInt(f.Size, 10)
+			}
+			if !f.Indexed.IsZero() {
+				indexed = strconv.FormatInt(f.Indexed.UnixNano(), 10)
+			}
+			return []string{sqlQuote(parts[1]), sqlQuote(f.Location), size, indexed}, nil
+		}},
+		{"edges", child, func(parts []string, _ []byte) ([]string, error) {
+			return []string{sqlQuote(parts[1]), sqlQuote(parts[2])}, nil
+		}},
+		{"types", camliType, kindRow},
+		{"mimes", mimeType, kindRow},
+		{"exts", extension, kindRow},
+	}
+	for _, t := range tables {
+		it := d.db.NewIterator(&util.Range{
+			Start: pack(t.prefix, start),
+			Limit: pack(t.prefix, limit),
+		}, nil)
+		n := 0
+		for it.Next() {
+			p.tick()
+			parts, ok := keyFields(it.Key())
+			if !ok {
+				continue
+			}
+			row, err := t.row(parts, it.Value())
+			if err != nil {
+				it.Release()
+				return err
+			}
+			if n%sqlBatch == 0 {
+				if n > 0 {
+					bw.WriteString(";\n")
+				}
+				if n%(sqlBatch*sqlTxn) == 0 {
+					if n > 0 {
+						bw.WriteString("COMMIT;\n")
+					}
+					bw.WriteString("BEGIN;\n")
+				}
+				fmt.Fprintf(bw, "INSERT INTO %s VALUES\n(", t.table)
+			} else {
+				bw.WriteString(",\n(")
+			}
+			bw.WriteString(strings.Join(row, ", "))
+			bw.WriteString(")")
+			n++
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+		if n > 0 {
+			bw.WriteString(";\nCOMMIT;\n")
+		}
+	}
+	bw.WriteString(sqlIndexes)
+	return bw.Flush()
+}
+
+// kindRow is the row of a type, MIME type or extension entry.
+func kindRow(parts []string, _ []byte) ([]string, error) {
+	return []string{sqlQuote(parts[2]), sqlQuote(parts[1])}, nil
+}
+
+// sqlQuote returns s as a SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
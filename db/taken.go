@@ -0,0 +1,55 @@
+package db
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// takenKey returns the taken index key prefix of t.
+func takenKey(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// PlaceTaken notes when a blob, such as a photo, was taken, to the
+// second. The index is by time, so a blob Placed with several times is
+// listed at each.
+func (d *DB) PlaceTaken(ref string, t time.Time) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := d.normalizeRef(ref)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(pack(taken, takenKey(t), ref), nil, nil)
+}
+
+// ListTakenBetween streams the found blobs Placed by PlaceTaken as
+// taken at or after from and before to, in order of time. The taken
+// times of blobs that aren't found, such as those Forgotten since, are
+// skipped.
+func (d *DB) ListTakenBetween(from, to time.Time) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		var prev string
+		err := d.scanRefs(2, &util.Range{
+			Start: pack(taken, takenKey(from)),
+			Limit: pack(taken, takenKey(to)),
+		}, func(ref string) bool {
+			if ref == prev {
+				return true
+			}
+			prev = ref
+			if ok, err := d.db.Has(pack(found, ref), nil); err == nil && ok {
+				ch <- ref
+			}
+			return true
+		})
+		if err != nil {
+			errorLog.Printf("db: ListTakenBetween: %s", err)
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListTakenBetween(t *testing.T) {
+	d := newTestDB(t)
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2014, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	for name, taken := range map[string]time.Time{
+		"july":      day(time.July, 31),
+		"august 1":  day(time.August, 1),
+		"august 15": day(time.August, 15),
+		"august 31": day(time.September, 1).Add(-13 * time.Hour),
+		"september": day(time.September, 1),
+	} {
+		place(t, d, name, "loc", "file")
+		if err := d.PlaceTaken(ref(name), taken); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same instant in another zone
+	sydney := time.FixedZone("AEST", 10*60*60)
+	august := func() []string {
+		return collect(d.ListTakenBetween(time.Date(2014, time.August, 1, 10, 0, 0, 0, sydney), day(time.September, 1).Add(-12*time.Hour)))
+	}
+	want := []string{ref("august 1"), ref("august 15"), ref("august 31")}
+	if got := august(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTakenBetween(August) = %q, want %q", got, want)
+	}
+
+	if err := d.Forget(ref("august 15")); err != nil {
+		t.Fatal(err)
+	}
+	if got := august(); !reflect.DeepEqual(got, []string{ref("august 1"), ref("august 31")}) {
+		t.Errorf("ListTakenBetween(August) after Forget = %q, want it skipped", got)
+	}
+	place(t, d, "august 15", "loc", "file")
+	if got := august(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTakenBetween(August) after Placing again = %q, want %q", got, want)
+	}
+
+	// taken times are exported, as TakenRecords, and imported
+	var buf bytes.Buffer
+	if err := d.Export(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	var takens int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		r, err := DecodeRecord([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := r.(*TakenRecord); ok {
+			takens++
+			if r.Ref == ref("july") && !r.Time.Equal(day(time.July, 31)) {
+				t.Errorf("TakenRecord = %+v, want July 31", r)
+			}
+		}
+	}
+	if takens != 5 {
+		t.Errorf("exported %d TakenRecords, want 5", takens)
+	}
+	imported := newTestDB(t)
+	if err := imported.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	d = imported
+	if got := august(); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported ListTakenBetween(August) = %q, want %q", got, want)
+	}
+}
@@ -1,34 +1,73 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	"camlistore.org/pkg/blobserver/dir"
-	"github.com/rwcarlsen/goexif/exif"
 
 	"github.com/dichro/cameloff/db"
+	"github.com/dichro/cameloff/exif"
 	"github.com/dichro/cameloff/fsck"
 )
 
+// scanned is the -print output for a file.
+type scanned struct {
+	Ref      string `json:"ref"`
+	FileName string `json:"filename,omitempty"`
+	Model    string `json:"model,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 func main() {
 	dbDir := flag.String("db_dir", "", "FSCK state database directory")
 	blobDir := flag.String("blob_dir", "", "Camlistore blob directory")
-	mimeType := flag.String("mime_type", "image/jpeg", "MIME type of files to scan")
+	mimeType := flag.String("mime_type", "image/jpeg", "Comma-separated MIME types of files to scan")
 	print := flag.Bool("print", false, "Print ref and camera model")
+	output := flag.String("output", "text", `Format of -print: "text", or "json" for a JSON object per line for every file, including those that failed`)
+	restart := flag.Bool("restart", false, "Restart scan from start, ignoring prior progress")
+	maxErrors := flag.Int64("max_errors", 0, "Abort after this many undecodable files; 0 for no limit")
+	limit := flag.Int("limit", 0, "Scan at most this many files; 0 for no limit")
+	skipDone := flag.Bool("skip_done", false, "Skip files this scan has processed before, and remember those it processes")
+	indexXMP := flag.Bool("xmp", true, "Index XMP titles, keywords and ratings as the title, keyword and rating attributes")
+	requireGPS := flag.Bool("require_gps", false, "Skip files without GPS coordinates")
+	indexTags := flag.Bool("index_tags", false, "Index camera makes and models as the make and model tags")
+	retries := flag.Int("retries", 1, "Attempts to read each file before counting it as failed")
+	retryBackoff := flag.Duration("retry_backoff", time.Second, "Wait before the second attempt to read a file, doubling for each after")
 	workers := fsck.Parallel{Workers: 32}
 	flag.Var(workers, "workers", "parallel worker goroutines")
 	flag.Parse()
+	if *output != "text" && *output != "json" {
+		log.Fatalf("unknown -output %q", *output)
+	}
+
+	// an abort after too many errors exits non-zero, but only once the
+	// scan has stopped, progress is saved and the index closed.
+	aborted := make(chan string, 1)
+	defer func() {
+		select {
+		case msg := <-aborted:
+			log.Fatal(msg)
+		default:
+		}
+	}()
 
 	fdb, err := db.New(*dbDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer fdb.Close()
 	bs, err := dir.New(*blobDir)
 	if err != nil {
 		log.Fatal(err)
@@ -38,50 +77,259 @@ func main() {
 	defer stats.LogTopNEvery(10, 10*time.Second).Stop()
 	defer log.Print(stats)
 
+	// scans resume after the greatest ref before which every ref was
+	// processed. Refs are listed in order, so files indexed since
+	// with refs before the checkpoint are only scanned after -restart.
+	checkpoint := "exif:" + *mimeType
+	resume := ""
+	if *restart {
+		if err := fdb.ResetDone(checkpoint); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if resume, err = fdb.Checkpoint(checkpoint); err != nil {
+			log.Fatal(err)
+		}
+		if resume != "" {
+			log.Print("resuming scan after ", resume)
+		}
+	}
+	progress := fsck.NewProgress()
+	saveProgress := func() {
+		if last := progress.Last(); last != "" {
+			if err := fdb.SetCheckpoint(checkpoint, last); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	defer saveProgress()
+	go func() {
+		for _ = range time.Tick(10 * time.Second) {
+			saveProgress()
+		}
+	}()
+
+	// an interrupt, or too many errors, stops the scan once the files
+	// being read are done, saving progress and closing the index.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if *maxErrors > 0 {
+		stats.AlertWhen("error", *maxErrors, func(name string, v int64) {
+			select {
+			case aborted <- fmt.Sprintf("aborting after %d errors", v):
+			default:
+			}
+			cancel()
+		})
+	}
+
 	files := fsck.NewFiles(bs)
+	files.Retry(*retries, *retryBackoff)
+	files.Stats = stats
 	go func() {
-		files.ReadRefs(fdb.ListMIME(*mimeType))
+		refs := fdb.ListMIMEsAfter(ctx, resume, strings.Split(*mimeType, ",")...)
+		if *skipDone {
+			refs = fsck.Skip(refs, func(ref string) bool {
+				return fdb.IsDone(checkpoint, ref)
+			})
+		}
+		files.ReadRefs(fsck.Limit(progress.Track(refs, resume), *limit))
 		files.Close()
 	}()
-	go files.LogErrors()
+	go files.LogErrorsFunc(progress.Done)
 
-	workers.Go(func() {
-		for r := range files.Readers {
-			ex, err := exif.Decode(r)
-			if err != nil {
-				stats.Add("error")
-				continue
+	scanXMP := func(r fsck.File) {
+		if _, err := r.Seek(0, 0); err != nil {
+			stats.Add("xmp-error")
+			return
+		}
+		x, err := exif.DecodeXMP(r)
+		switch {
+		case err == exif.ErrNoXMP:
+			stats.Add("xmp-none")
+			return
+		case err != nil:
+			stats.Add("xmp-error")
+			return
+		}
+		ref := r.BlobRef().String()
+		place := func(name string, v db.AttrValue) {
+			if err := fdb.PlaceAttr(ref, name, v); err != nil {
+				log.Printf("%s: %s: %s", ref, name, err)
+				stats.Add("xmp-error")
 			}
-			tag, err := ex.Get(exif.Model)
+		}
+		if x.Title != "" {
+			place("title", db.StringAttr(x.Title))
+		}
+		for _, k := range x.Keywords {
+			place("keyword", db.StringAttr(k))
+		}
+		if x.Rating != 0 {
+			place("rating", db.IntAttr(int64(x.Rating)))
+		}
+		stats.Add("xmp")
+	}
+
+	// scanTaken indexes when r was taken, if it says.
+	scanTaken := func(r fsck.File, ex *exif.Data) {
+		t, err := ex.Taken()
+		if err != nil {
+			stats.Add("no-date")
+			return
+		}
+		if err := fdb.PlaceTaken(r.BlobRef().String(), t); err != nil {
+			log.Printf("%s: %s", r.BlobRef(), err)
+			stats.Add("date-error")
+			return
+		}
+		stats.Add("date")
+	}
+
+	// scanTags indexes the camera make and model of r, if it says.
+	scanTags := func(r fsck.File, ex *exif.Data) {
+		ref := r.BlobRef().String()
+		for _, t := range []struct {
+			name string
+			get  func() (string, error)
+		}{
+			{"make", ex.Make},
+			{"model", ex.Model},
+		} {
+			v, err := t.get()
 			if err != nil {
-				stats.Add("missing")
 				continue
 			}
-			stats.Add(tag.String())
-			if *print {
-				id := "unknown"
-				if tag, err := ex.Get(exif.ImageUniqueID); err == nil {
-					id = tag.String()
-					stats.Add("unique-id-exif")
-				} else if thumb, err := ex.JpegThumbnail(); err == nil {
-					hash := sha1.Sum(thumb)
-					id = hex.EncodeToString(hash[:20])
-					stats.Add("unique-id-thumb")
-				} else if r.PartsSize() < 1e7 {
-					if _, err := r.Seek(0, 0); err == nil {
-						hash := sha1.New()
-						io.Copy(hash, r)
-						id = hex.EncodeToString(hash.Sum(nil))
-						stats.Add("unique-id-sha1")
-					} else {
-						id = "read-error"
-						stats.Add("unique-id-sha1-error")
-					}
+			if err := fdb.PlaceTag(ref, t.name, v); err != nil {
+				log.Printf("%s: %s: %s", ref, t.name, err)
+				stats.Add("tag-error")
+			}
+		}
+	}
+
+	// scanGeo indexes the coordinates of r, if it has any, returning
+	// false if it doesn't.
+	scanGeo := func(r fsck.File, ex *exif.Data) bool {
+		lat, lng, err := ex.LatLong()
+		switch {
+		case err == exif.ErrMissing:
+			stats.Add("no-gps")
+			return false
+		case err != nil:
+			stats.Add("gps-error")
+			return false
+		}
+		if err := fdb.PlaceGeo(r.BlobRef().String(), lat, lng); err != nil {
+			log.Printf("%s: %s", r.BlobRef(), err)
+			stats.Add("gps-error")
+			return false
+		}
+		stats.Add("gps")
+		return true
+	}
+
+	// printed writes each scanned file as -output says, one at a time
+	// for the workers.
+	var printMu sync.Mutex
+	jsonOut := fsck.NewJSONLines(os.Stdout)
+	printed := func(res *scanned) {
+		if *output == "json" {
+			if err := jsonOut.Encode(res); err != nil {
+				log.Fatal(err)
+			}
+		} else if res.Error == "" {
+			printMu.Lock()
+			defer printMu.Unlock()
+			fmt.Printf("%s %s %q %q\n", res.Ref, res.ID, res.FileName, res.Model)
+		}
+	}
+
+	scan := func(r fsck.File) {
+		// r is replaced by any reopening of it by Reread.
+		defer func() { r.Close() }()
+		skip := false
+		if *indexXMP {
+			defer func() {
+				if !skip {
+					scanXMP(r)
+				}
+			}()
+		}
+		res := &scanned{Ref: r.BlobRef().String(), FileName: r.FileName()}
+		if *print {
+			defer func() {
+				if !skip {
+					printed(res)
+				}
+			}()
+		}
+		var ex *exif.Data
+		r, err := files.Reread(r, func(f fsck.File) (err error) {
+			ex, err = exif.Decode(f)
+			return err
+		})
+		if err != nil {
+			stats.Add("error")
+			res.Error = err.Error()
+			return
+		}
+		if !scanGeo(r, ex) && *requireGPS {
+			skip = true
+			return
+		}
+		scanTaken(r, ex)
+		if *indexTags {
+			scanTags(r, ex)
+		}
+		model, err := ex.Model()
+		if err != nil {
+			stats.Add("missing")
+			res.Error = "no camera model"
+			return
+		}
+		stats.Add(model)
+		res.Model = model
+		if *print {
+			id, source, err := ex.UniqueID()
+			switch {
+			case err == nil:
+				stats.Add("unique-id-" + source)
+			case r.PartsSize() < 1e7:
+				if _, err := r.Seek(0, 0); err == nil {
+					hash := sha1.New()
+					io.Copy(hash, r)
+					id = hex.EncodeToString(hash.Sum(nil))
+					stats.Add("unique-id-sha1")
 				} else {
-					stats.Add("unique-id-too-big")
+					id = "read-error"
+					stats.Add("unique-id-sha1-error")
+				}
+			default:
+				id = "unknown"
+				stats.Add("unique-id-too-big")
+			}
+			res.ID = id
+		}
+	}
+
+	workers.GoContext(ctx, func(ctx context.Context) {
+		for r := range files.Readers {
+			// files already being read are drained and closed,
+			// unscanned, so that progress stops before them.
+			if ctx.Err() != nil {
+				r.Close()
+				continue
+			}
+			scan(r)
+			ref := r.BlobRef().String()
+			if *skipDone {
+				if err := fdb.MarkDone(checkpoint, ref); err != nil {
+					log.Print(err)
 				}
-				fmt.Printf("%s %s %q %q\n", r.BlobRef(), id, r.FileName(), tag)
 			}
+			progress.Done(ref)
 		}
 	})
 	workers.Wait()
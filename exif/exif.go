@@ -0,0 +1,113 @@
+// Package exif extracts the EXIF and XMP metadata that cameloff's tools use
+// from image files.
+package exif
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	goexif "github.com/rwcarlsen/goexif/exif"
+)
+
+// ErrMissing is returned for tags an image doesn't have.
+var ErrMissing = errors.New("exif: tag not present")
+
+// Data is the decoded EXIF metadata of an image.
+type Data struct {
+	x *goexif.Exif
+}
+
+// Decode reads the EXIF metadata from the start of r.
+func Decode(r io.Reader) (*Data, error) {
+	x, err := goexif.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Data{x}, nil
+}
+
+// tag returns the named tag as a string, or ErrMissing.
+func (d *Data) tag(name goexif.FieldName) (string, error) {
+	t, err := d.x.Get(name)
+	if err != nil {
+		return "", ErrMissing
+	}
+	return t.String(), nil
+}
+
+// Model returns the camera model, or ErrMissing.
+func (d *Data) Model() (string, error) {
+	return d.tag(goexif.Model)
+}
+
+// Make returns the camera manufacturer, or ErrMissing.
+func (d *Data) Make() (string, error) {
+	return d.tag(goexif.Make)
+}
+
+// LatLong returns the GPS coordinates of the image in decimal degrees,
+// negative to the south and west, or ErrMissing if it has none.
+func (d *Data) LatLong() (lat, lng float64, err error) {
+	lat, lng, err = d.x.LatLong()
+	if goexif.IsTagNotPresentError(err) {
+		err = ErrMissing
+	}
+	return lat, lng, err
+}
+
+// Taken returns when the image was taken, from its DateTimeOriginal or
+// else DateTime tag, or ErrMissing if it has neither. EXIF times have
+// no zone, so are in time.Local unless the camera's maker notes say.
+func (d *Data) Taken() (time.Time, error) {
+	t, err := d.x.DateTime()
+	if goexif.IsTagNotPresentError(err) {
+		err = ErrMissing
+	}
+	return t, err
+}
+
+// Sources of a UniqueID.
+const (
+	// IDTag is an ImageUniqueID tag.
+	IDTag = "exif"
+	// IDThumbnail is the SHA-1 of the embedded thumbnail.
+	IDThumbnail = "thumb"
+)
+
+// UniqueID returns an identifier for the image, and which of IDTag or
+// IDThumbnail it came from, or ErrMissing if the image has neither.
+// Copies of an image share the identifier even if their metadata has
+// since been edited.
+func (d *Data) UniqueID() (id, source string, err error) {
+	if id, err := d.tag(goexif.ImageUniqueID); err == nil {
+		return id, IDTag, nil
+	}
+	if thumb, err := d.x.JpegThumbnail(); err == nil {
+		hash := sha1.Sum(thumb)
+		return hex.EncodeToString(hash[:]), IDThumbnail, nil
+	}
+	return "", "", ErrMissing
+}
+
+// ExtractModel returns the camera model of the image read from r, or
+// ErrMissing if it doesn't say.
+func ExtractModel(r io.Reader) (string, error) {
+	d, err := Decode(r)
+	if err != nil {
+		return "", err
+	}
+	return d.Model()
+}
+
+// ExtractMake returns the camera manufacturer of the image read from
+// r, or ErrMissing if it doesn't say.
+func ExtractMake(r io.Reader) (string, error) {
+	d, err := Decode(r)
+	if err != nil {
+		return "", err
+	}
+	return d.Make()
+}
@@ -0,0 +1,124 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ErrNoXMP is returned by DecodeXMP for images without an XMP packet.
+var ErrNoXMP = errors.New("exif: no XMP packet")
+
+// xmpScanLimit is how far into an image DecodeXMP looks for an XMP
+// packet. JPEGs carry it in a segment near the start.
+const xmpScanLimit = 1 << 20
+
+// Namespaces of the XMP properties DecodeXMP reads.
+const (
+	nsRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC  = "http://purl.org/dc/elements/1.1/"
+	nsXMP = "http://ns.adobe.com/xap/1.0/"
+)
+
+// XMP is the part of an image's embedded XMP metadata that cameloff
+// indexes.
+type XMP struct {
+	Title    string
+	Keywords []string
+	// Rating runs from -1, rejected, through 5; 0 is unrated.
+	Rating int
+}
+
+// DecodeXMP reads the XMP packet embedded within the first megabyte
+// of r. It returns ErrNoXMP if there is none, or an error if the
+// packet is malformed.
+func DecodeXMP(r io.Reader) (*XMP, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, xmpScanLimit))
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.Index(data, []byte("<x:xmpmeta"))
+	if i < 0 {
+		return nil, ErrNoXMP
+	}
+	data = data[i:]
+	end := []byte("</x:xmpmeta>")
+	if j := bytes.Index(data, end); j >= 0 {
+		data = data[:j+len(end)]
+	}
+	return parseXMP(data)
+}
+
+// parseXMP extracts the dc:title, dc:subject and xmp:Rating properties
+// from an xmpmeta element. Titles and keywords are the rdf:li items of
+// their properties; the first title is taken. Ratings may be written
+// as attributes of rdf:Description or as elements.
+func parseXMP(data []byte) (*XMP, error) {
+	x := new(XMP)
+	var (
+		stack []xml.Name
+		text  strings.Builder
+	)
+	inside := func(space, local string) bool {
+		for _, n := range stack {
+			if n.Space == space && n.Local == local {
+				return true
+			}
+		}
+		return false
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return x, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				if a.Name.Space == nsXMP && a.Name.Local == "Rating" {
+					if err := x.setRating(a.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+			stack = append(stack, t.Name)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			v := strings.TrimSpace(text.String())
+			text.Reset()
+			switch {
+			case v == "":
+			case t.Name.Space == nsXMP && t.Name.Local == "Rating":
+				if err := x.setRating(v); err != nil {
+					return nil, err
+				}
+			case t.Name.Space != nsRDF || t.Name.Local != "li":
+			case inside(nsDC, "subject"):
+				x.Keywords = append(x.Keywords, v)
+			case inside(nsDC, "title") && x.Title == "":
+				x.Title = v
+			}
+		}
+	}
+}
+
+func (x *XMP) setRating(v string) error {
+	// Some writers use decimals, such as "3.0".
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return err
+	}
+	x.Rating = int(f)
+	return nil
+}
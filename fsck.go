@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"sync"
@@ -14,6 +19,7 @@ import (
 	"camlistore.org/pkg/blob"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/dir"
+	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/context"
 	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/magic"
@@ -21,6 +27,7 @@ import (
 	"github.com/gonuts/commander"
 
 	"github.com/dichro/cameloff/db"
+	"github.com/dichro/cameloff/db/remote"
 	fs "github.com/dichro/cameloff/fsck"
 )
 
@@ -46,11 +53,100 @@ func main() {
 		UsageLine: "scan scans a diskpacked blobstore",
 	}
 	restart := scan.Flag.Bool("restart", false, "Restart scan from start, ignoring prior progress")
+	rpcAddr := scan.Flag.String("rpc", "", "Serve the index to other processes on this TCP address while scanning")
 	scan.Run = func(*commander.Command, []string) error {
-		scanBlobs(dbDir, blobDir, *restart)
+		scanBlobs(dbDir, blobDir, *restart, *rpcAddr)
 		return nil
 	}
 
+	ingest := &commander.Command{
+		UsageLine: "ingest indexes JSON records read from stdin",
+	}
+	ingestDefer := ingest.Flag.Bool("defer_missing", false, "Note missing dependencies in a single pass once all records are read")
+	ingest.Run = func(*commander.Command, []string) error {
+		return ingestRecords(dbDir, os.Stdin, *ingestDefer)
+	}
+
+	prune := &commander.Command{
+		UsageLine: "prune removes blobs under a location prefix from the index",
+		Run: func(cmd *commander.Command, args []string) error {
+			return pruneBlobs(dbDir, args)
+		},
+	}
+
+	diff := &commander.Command{
+		UsageLine: "diff compares an older index, or an export of one, with the index",
+		Run: func(cmd *commander.Command, args []string) error {
+			return diffIndex(dbDir, args)
+		},
+	}
+
+	remap := &commander.Command{
+		UsageLine: "remap replaces a location prefix in the index, such as after moving a blob store",
+		Run: func(cmd *commander.Command, args []string) error {
+			return remapLocations(dbDir, args)
+		},
+	}
+
+	migrateChildren := &commander.Command{
+		UsageLine: "children adds child index entries missing from indexes built before it",
+		Run: func(*commander.Command, []string) error {
+			return backfillChildren(dbDir)
+		},
+	}
+
+	compact := &commander.Command{
+		UsageLine: "compact compacts the index, reclaiming space after deletions",
+		Run: func(*commander.Command, []string) error {
+			return compactIndex(dbDir)
+		},
+	}
+
+	purgeType := &commander.Command{
+		UsageLine: "purgetype removes every blob of a camliType from the index",
+		Run: func(cmd *commander.Command, args []string) error {
+			return purgeBlobType(dbDir, args)
+		},
+	}
+
+	export := &commander.Command{
+		UsageLine: "export writes the index to stdout as JSON",
+	}
+	exportGzip := export.Flag.Bool("gzip", false, "Compress output with gzip")
+	exportRoot := export.Flag.String("root", "", "Export only the subtree rooted at this blob")
+	exportSince := export.Flag.String("since", "", "Export only changes since this RFC 3339 time; not with -root")
+	export.Run = func(*commander.Command, []string) error {
+		return exportIndex(dbDir, os.Stdout, *exportRoot, *exportSince, *exportGzip)
+	}
+
+	dumpSQL := &commander.Command{
+		UsageLine: "sql writes the inventory to stdout as a SQL script, eg, for sqlite3",
+		Run: func(*commander.Command, []string) error {
+			return dumpIndexSQL(dbDir, os.Stdout)
+		},
+	}
+
+	recoverCmd := &commander.Command{
+		UsageLine: "recover rebuilds the leveldb MANIFEST of a damaged index",
+		Run: func(*commander.Command, []string) error {
+			return recoverIndex(dbDir)
+		},
+	}
+
+	dumpCSV := &commander.Command{
+		UsageLine: "csv writes a row per found blob to stdout as CSV",
+		Run: func(*commander.Command, []string) error {
+			return dumpIndexCSV(dbDir, os.Stdout)
+		},
+	}
+
+	importCmd := &commander.Command{
+		UsageLine: "import reads an exported index from stdin",
+		Run: func(*commander.Command, []string) error {
+			return importIndex(dbDir, os.Stdin)
+		},
+	}
+
 	missing := &commander.Command{
 		UsageLine: "missing prints unresolved references",
 		Run: func(*commander.Command, []string) error {
@@ -60,9 +156,11 @@ func main() {
 
 	stats := &commander.Command{
 		UsageLine: "stats prints index stats",
-		Run: func(*commander.Command, []string) error {
-			return statsBlobs(dbDir)
-		},
+	}
+	statsSizes := stats.Flag.Bool("sizes", false, "Also print blob sizes by type")
+	statsDisk := stats.Flag.Bool("disk", false, "Also print the approximate disk space taken by each index")
+	stats.Run = func(*commander.Command, []string) error {
+		return statsBlobs(dbDir, *statsSizes, *statsDisk)
 	}
 
 	list := &commander.Command{
@@ -75,11 +173,65 @@ func main() {
 	var workers int
 	mimeScan := &commander.Command{
 		UsageLine: "mime scans indexed blobs for mime types",
+	}
+	mimeScan.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+	mimeRestart := mimeScan.Flag.Bool("restart", false, "Restart scan from start, ignoring prior progress")
+	mimeLimit := mimeScan.Flag.Int("limit", 0, "Scan at most this many files; 0 for no limit")
+	mimeScan.Run = func(*commander.Command, []string) error {
+		return mimeScanBlobs(dbDir, blobDir, workers, *mimeRestart, *mimeLimit)
+	}
+
+	extScan := &commander.Command{
+		UsageLine: "ext indexes file blobs by file name extension",
 		Run: func(*commander.Command, []string) error {
-			return mimeScanBlobs(dbDir, blobDir, workers)
+			return extScanBlobs(dbDir, blobDir, workers)
 		},
 	}
-	mimeScan.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+	extScan.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+
+	sizes := &commander.Command{
+		UsageLine: "sizes reports files whose contents are truncated",
+	}
+	sizes.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+	sizesRefs := sizes.Flag.String("refs_file", "", "Check only the refs at the start of each line of this file, eg, a previous -retry_file")
+	sizesRetry := sizes.Flag.String("retry_file", "", "Append each file that fails its check, and why, to this file")
+	sizes.Run = func(*commander.Command, []string) error {
+		return verifySizes(dbDir, blobDir, workers, *sizesRefs, *sizesRetry)
+	}
+
+	sniff := &commander.Command{
+		UsageLine: "sniff guesses mime types for blobs with neither a camliType nor a mime type",
+		Run: func(*commander.Command, []string) error {
+			return sniffBlobs(dbDir, blobDir, workers)
+		},
+	}
+	sniff.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+
+	verify := &commander.Command{
+		UsageLine: "verify checks the digests of blobs under location prefixes",
+	}
+	verifyStale := verify.Flag.Duration("stale", 0, "Instead of location prefixes, check blobs not verified within this long, oldest first")
+	verify.Run = func(cmd *commander.Command, locations []string) error {
+		return verifyLocations(dbDir, blobDir, workers, locations, *verifyStale)
+	}
+	verify.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
+
+	reconcileCmd := &commander.Command{
+		UsageLine: "reconcile compares the index with a Camlistore server's blobs",
+	}
+	server := reconcileCmd.Flag.String("server", "", "Camlistore server URL; defaults to --blob_dir")
+	reconcileCmd.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines checking --blob_dir")
+	reconcileCmd.Run = func(*commander.Command, []string) error {
+		return reconcile(dbDir, blobDir, *server, workers)
+	}
+
+	retype := &commander.Command{
+		UsageLine: "retype rereads schema blobs and corrects their indexed camliTypes",
+		Run: func(*commander.Command, []string) error {
+			return retypeBlobs(dbDir, blobDir, workers)
+		},
+	}
+	retype.Flag.IntVar(&workers, "workers", 8, "number of i/o goroutines")
 
 	filePath := &commander.Command{
 		UsageLine: "filepath prints paths to file blobs",
@@ -88,15 +240,62 @@ func main() {
 		},
 	}
 
+	roots := &commander.Command{
+		UsageLine: "roots prints the parentless ancestors of blobs",
+		Run: func(cmd *commander.Command, refs []string) error {
+			return rootsOf(dbDir, refs)
+		},
+	}
+
+	dupes := &commander.Command{
+		UsageLine: "dupes prints blobs found at more than one location",
+		Run: func(*commander.Command, []string) error {
+			return duplicateLocations(dbDir)
+		},
+	}
+
+	share := &commander.Command{
+		UsageLine: "share writes a JSON manifest of the blobs needed to share a tree",
+	}
+	shareMaxBlobs := share.Flag.Int("max_blobs", 100000, "Refuse trees of more blobs than this; 0 for no limit")
+	shareMaxBytes := share.Flag.Int64("max_bytes", 1<<30, "Refuse trees of more bytes than this; 0 for no limit")
+	share.Run = func(cmd *commander.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("require a single root blob ref")
+		}
+		return shareManifest(dbDir, args[0], *shareMaxBlobs, *shareMaxBytes, os.Stdout)
+	}
+
 	top := &commander.Command{
 		UsageLine: os.Args[0],
 		Subcommands: []*commander.Command{
 			scan,
+			ingest,
+			prune,
+			purgeType,
+			migrateChildren,
+			remap,
+			diff,
+			compact,
+			export,
+			dumpCSV,
+			dumpSQL,
+			recoverCmd,
+			importCmd,
 			missing,
 			stats,
 			list,
 			mimeScan,
+			extScan,
+			sizes,
+			sniff,
+			retype,
+			verify,
+			reconcileCmd,
 			filePath,
+			roots,
+			dupes,
+			share,
 		},
 	}
 
@@ -106,7 +305,7 @@ func main() {
 	}
 
 	// add --blob_dir as appropriate
-	for _, cmd := range []*commander.Command{scan, mimeScan, missing, filePath} {
+	for _, cmd := range []*commander.Command{scan, mimeScan, extScan, sizes, sniff, retype, verify, reconcileCmd, missing, filePath} {
 		cmd.Flag.StringVar(&blobDir, "blob_dir", "", "Camlistore blob directory")
 	}
 
@@ -126,8 +325,10 @@ func listBlobs(dbDir string, args []string) error {
 		ch = fsck.List(args[1])
 	case "mime":
 		ch = fsck.ListMIME(args[1])
+	case "ext":
+		ch = fsck.ListExtension(args[1])
 	default:
-		return errors.New(`unknown index, use "camli" or "mime"`)
+		return errors.New(`unknown index, use "camli", "mime" or "ext"`)
 	}
 	for ref := range ch {
 		fmt.Println(ref)
@@ -135,6 +336,206 @@ func listBlobs(dbDir string, args []string) error {
 	return nil
 }
 
+func pruneBlobs(dbDir string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("require a single location prefix")
+	}
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	pruned, blocked, err := fsck.Prune(args[0])
+	fmt.Println("pruned", pruned, "blocked", blocked)
+	return err
+}
+
+// diffIndex prints the found blobs added to the index since the older
+// index or export at args[0] with a +, those removed with a -, and
+// those moved with a ~ and both locations.
+func diffIndex(dbDir string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("require a single older index directory or export file")
+	}
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fi, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	ch := make(chan db.DiffRecord)
+	errc := make(chan error, 1)
+	if fi.IsDir() {
+		older, err := db.NewRO(args[0])
+		if err != nil {
+			return err
+		}
+		defer older.Close()
+		go func() {
+			errc <- db.Diff(older, fsck, ch)
+			close(ch)
+		}()
+	} else {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		go func() {
+			errc <- db.DiffDump(f, fsck, ch)
+			close(ch)
+		}()
+	}
+	for r := range ch {
+		switch r.Kind {
+		case db.Added:
+			fmt.Println("+", r.Ref, r.NewLocation)
+		case db.Removed:
+			fmt.Println("-", r.Ref, r.OldLocation)
+		case db.Moved:
+			fmt.Println("~", r.Ref, r.OldLocation, r.NewLocation)
+		}
+	}
+	return <-errc
+}
+
+func remapLocations(dbDir string, args []string) error {
+	if len(args) != 2 {
+		return errors.New("require an old and a new location prefix")
+	}
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fsck.TrackProgress(progressEvery, logProgress)
+	n, err := fsck.RemapLocations(args[0], args[1])
+	fmt.Println("remapped", n)
+	return err
+}
+
+func backfillChildren(dbDir string) error {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	n, err := fsck.MigrateChildren()
+	log.Printf("added %d child entries", n)
+	return err
+}
+
+func compactIndex(dbDir string) error {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	return fsck.Compact()
+}
+
+func purgeBlobType(dbDir string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("require a single camliType")
+	}
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fsck.TrackProgress(progressEvery, logProgress)
+	removed, kept, err := fsck.PurgeType(args[0])
+	fmt.Println("removed", removed, "kept under another type", kept)
+	return err
+}
+
+func exportIndex(dbDir string, w io.Writer, root, since string, gzip bool) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fsck.TrackProgress(progressEvery, logProgress)
+	opts := &db.ExportOptions{Gzip: gzip}
+	if since != "" {
+		if root != "" {
+			return errors.New("-since and -root can't be combined")
+		}
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return err
+		}
+		return fsck.ExportSince(t, w, opts)
+	}
+	if root != "" {
+		return fsck.ExportSubtree(root, w, opts)
+	}
+	return fsck.Export(w, opts)
+}
+
+func dumpIndexSQL(dbDir string, w io.Writer) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fsck.TrackProgress(progressEvery, logProgress)
+	return fsck.ExportSQL(w)
+}
+
+func recoverIndex(dbDir string) error {
+	fsck, err := db.Recover(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	pruned, err := fsck.PruneMissing()
+	if err != nil {
+		return err
+	}
+	added, removed, err := fsck.ResolveMissing()
+	if err != nil {
+		return err
+	}
+	log.Printf("noted %d missing dependencies; forgot %d, and %d orphaned", added, removed, pruned)
+	if removed+pruned > 0 {
+		if err := fsck.CompactMissing(); err != nil {
+			return err
+		}
+	}
+	invalid := 0
+	for range fsck.FindInvalidKeys() {
+		invalid++
+	}
+	log.Printf("%d invalid keys; consider rescanning from the start", invalid)
+	return nil
+}
+
+func dumpIndexCSV(dbDir string, w io.Writer) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	fsck.TrackProgress(progressEvery, logProgress)
+	return fsck.DumpCSV(w)
+}
+
+func importIndex(dbDir string, r io.Reader) error {
+	fsck, err := db.BulkLoad(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	if err := fsck.Import(r); err != nil {
+		return err
+	}
+	return fsck.Finish()
+}
+
 func missingBlobs(dbDir, blobDir string) error {
 	fsck, err := db.NewRO(dbDir)
 	if err != nil {
@@ -214,45 +615,117 @@ func printHierarchy(fsck *db.DB, bs blob.Fetcher, depth int, suffix string, node
 	}
 }
 
-func statsBlobs(dbDir string) error {
+// progressEvery is how many index entries long scans log progress
+// after.
+const progressEvery = 1000000
+
+func logProgress(scanned uint64) {
+	log.Printf("scanned %d index entries", scanned)
+}
+
+func statsBlobs(dbDir string, sizes, disk bool) error {
 	fsck, err := db.NewRO(dbDir)
 	if err != nil {
 		return err
 	}
+	fsck.TrackProgress(progressEvery, logProgress)
 	s := fsck.Stats()
 	fmt.Println(s)
-	if len(s.CamliTypes) != 0 {
-		fmt.Println("camliTypes:")
-		camliTypes := []string{}
-		for t := range s.CamliTypes {
-			camliTypes = append(camliTypes, t)
+	printCounts("camliTypes", s.CamliTypes)
+	printCounts("MIMETypes", s.MIMETypes)
+	printCounts("extensions", s.Extensions)
+	if disk {
+		ds, err := fsck.Sizes()
+		if err != nil {
+			return err
 		}
-		sort.Strings(camliTypes)
-		for _, t := range camliTypes {
-			fmt.Printf("\t%q: %d\n", t, s.CamliTypes[t])
+		bytes := make(map[string]int64, len(ds))
+		for prefix, n := range ds {
+			bytes[prefix] = int64(n)
 		}
+		printCounts("index bytes on disk", bytes)
 	}
-	if len(s.MIMETypes) != 0 {
-		fmt.Println("MIMETypes:")
-		types := []string{}
-		for t := range s.MIMETypes {
-			types = append(types, t)
-		}
-		sort.Strings(types)
-		for _, t := range types {
-			fmt.Printf("\t%q: %d\n", t, s.MIMETypes[t])
-		}
+	if !sizes {
+		return nil
+	}
+	ss, err := fsck.SizeStats()
+	if err != nil {
+		return err
 	}
+	printSizes("camliType sizes", ss.CamliTypes)
+	printSizes("MIMEType sizes", ss.MIMETypes)
 	return nil
 }
 
-func scanBlobs(dbDir, blobDir string, restart bool) {
+func printSizes(name string, sizes map[string]*db.SizeStat) {
+	if len(sizes) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n", name)
+	keys := []string{}
+	for k := range sizes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("\t%q: %s\n", k, sizes[k])
+	}
+}
+
+func printCounts(name string, counts map[string]int64) {
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n", name)
+	keys := []string{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("\t%q: %d\n", k, counts[k])
+	}
+}
+
+// rpcRefresh is how often the index served by scan --rpc is refreshed.
+const rpcRefresh = 10 * time.Second
+
+// placeBatch is the number of entries scan and ingest write at once.
+const placeBatch = 1000
+
+func scanBlobs(dbDir, blobDir string, restart bool, rpcAddr string) {
 	fsck, err := db.New(dbDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if rpcAddr != "" {
+		l, err := net.Listen("tcp", rpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// queries see a consistent snapshot of the index being
+		// written, refreshed periodically.
+		r, err := fsck.Reader()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+		go func() {
+			for range time.Tick(rpcRefresh) {
+				if err := r.Refresh(); err != nil {
+					log.Print(err)
+				}
+			}
+		}()
+		go func() {
+			log.Print(remote.Serve(l, r.DB))
+		}()
+	}
 
-	last := fsck.Last()
+	last, err := fsck.Last()
+	if err != nil {
+		log.Fatal(err)
+	}
 	if last != "" {
 		if restart {
 			fmt.Println("overwriting blob scan resume marker at", last)
@@ -264,6 +737,7 @@ func scanBlobs(dbDir, blobDir string, restart bool) {
 
 	blobCh := streamBlobs(blobDir, last)
 
+	bt := fsck.NewBatcher(placeBatch, rpcRefresh)
 	stats := fs.NewStats()
 	defer stats.LogEvery(10 * time.Second).Stop()
 	defer log.Print(stats)
@@ -276,64 +750,135 @@ func scanBlobs(dbDir, blobDir string, restart bool) {
 		body := b.Open()
 		s, ok := parseSchema(ref, body)
 		body.Close()
-		if !ok {
+		e := db.PlaceEntry{
+			Ref:      ref.String(),
+			Location: b.Token,
+			Size:     int64(b.Size()),
+		}
+		if ok {
+			e.Type = s.Type()
+			e.Dependencies = fs.Dependencies(s)
+			stats.Add(e.Type)
+		} else {
 			stats.Add("data")
-			if err := fsck.Place(ref.String(), b.Token, "", nil); err != nil {
-				log.Fatal(err)
-			}
-			continue
 		}
-		needs := indexSchemaBlob(fsck, s)
-		t := s.Type()
-		stats.Add(t)
-		if err := fsck.Place(ref.String(), b.Token, t, needs); err != nil {
+		if err := bt.Add(e); err != nil {
 			log.Fatal(err)
 		}
 	}
+	if err := bt.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func indexSchemaBlob(fsck *db.DB, s *schema.Blob) (needs []string) {
-	camliType := s.Type()
-	switch camliType {
-	case "static-set":
-		for _, r := range s.StaticSetMembers() {
-			needs = append(needs, r.String())
-		}
-	case "bytes":
-		fallthrough
-	case "file":
-		for i, bp := range s.ByteParts() {
-			ok := false
-			if r := bp.BlobRef; r.Valid() {
-				needs = append(needs, r.String())
-				ok = true
-			}
-			if r := bp.BytesRef; r.Valid() {
-				needs = append(needs, r.String())
-				ok = true
-			}
-			if !ok {
-				log.Printf("%s (%s): no valid ref in part %d", s.BlobRef(), camliType, i)
-			}
-		}
-	case "directory":
-		switch r, ok := s.DirectoryEntries(); {
-		case !ok:
-			log.Printf("%s (%s): bad entries", s.BlobRef(), camliType)
-		case !r.Valid():
-			log.Printf("%s (%s): invalid entries", s.BlobRef(), camliType)
-		default:
-			needs = append(needs, r.String())
+// record is a single blob description as produced by an external
+// crawler for ingestRecords.
+type record struct {
+	Ref      string   `json:"ref"`
+	Location string   `json:"location"`
+	Type     string   `json:"type"`
+	Deps     []string `json:"deps"`
+}
+
+func (r record) validate() error {
+	if _, ok := blob.Parse(r.Ref); !ok {
+		return fmt.Errorf("%q: unparseable blob ref", r.Ref)
+	}
+	if r.Location == "" {
+		return fmt.Errorf("%s: no location", r.Ref)
+	}
+	for _, dep := range r.Deps {
+		if _, ok := blob.Parse(dep); !ok {
+			return fmt.Errorf("%s: unparseable dependency %q", r.Ref, dep)
 		}
 	}
-	return
+	return nil
 }
 
-func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
-	sn := index.NewBlobSniffer(ref)
-	io.Copy(sn, body)
-	sn.Parse()
-	return sn.SchemaBlob()
+// ingestRecords Places every newline-delimited JSON record read from
+// in. Malformed lines are logged, counted and skipped.
+func ingestRecords(dbDir string, in io.Reader, deferMissing bool) error {
+	var opts db.Options
+	if deferMissing {
+		opts.Missing = db.MissingDeferred
+	}
+	fsck, err := db.NewWithOptions(dbDir, opts)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	bt := fsck.NewBatcher(placeBatch, 0)
+	// records needn't arrive in location order, so note the greatest
+	// location once at the end rather than with every Place.
+	var lastLocation string
+	lines := bufio.NewScanner(in)
+	// schema blobs with many parts make for long lines
+	lines.Buffer(nil, 16<<20)
+	for line := 1; lines.Scan(); line++ {
+		var r record
+		if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+			log.Printf("line %d: %s", line, err)
+			stats.Add("malformed")
+			continue
+		}
+		if err := r.validate(); err != nil {
+			log.Printf("line %d: %s", line, err)
+			stats.Add("invalid")
+			continue
+		}
+		if err := bt.Add(db.PlaceEntry{
+			Ref:          r.Ref,
+			Location:     r.Location,
+			Type:         r.Type,
+			Dependencies: r.Deps,
+			Size:         -1,
+			SkipLast:     true,
+		}); err != nil {
+			return err
+		}
+		if r.Location > lastLocation {
+			lastLocation = r.Location
+		}
+		if r.Type == "" {
+			stats.Add("data")
+		} else {
+			stats.Add(r.Type)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	if err := bt.Close(); err != nil {
+		return err
+	}
+	if deferMissing {
+		added, removed, err := fsck.ResolveMissing()
+		if err != nil {
+			return err
+		}
+		log.Printf("noted %d missing dependencies; forgot %d", added, removed)
+		if removed > 0 {
+			if err := fsck.CompactMissing(); err != nil {
+				return err
+			}
+		}
+	}
+	if lastLocation == "" {
+		return nil
+	}
+	return fsck.SetLast(lastLocation)
+}
+
+func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
+	sn := index.NewBlobSniffer(ref)
+	io.Copy(sn, body)
+	sn.Parse()
+	return sn.SchemaBlob()
 }
 
 func streamBlobs(path, resume string) <-chan blobserver.BlobAndToken {
@@ -356,11 +901,12 @@ func streamBlobs(path, resume string) <-chan blobserver.BlobAndToken {
 	return ch
 }
 
-func mimeScanBlobs(dbDir, blobDir string, workers int) error {
-	fsck, err := db.NewRO(dbDir)
+func mimeScanBlobs(dbDir, blobDir string, workers int, restart bool, limit int) error {
+	fsck, err := db.New(dbDir)
 	if err != nil {
 		return err
 	}
+	defer fsck.Close()
 	bs, err := dir.New(blobDir)
 	if err != nil {
 		return err
@@ -375,6 +921,90 @@ func mimeScanBlobs(dbDir, blobDir string, workers int) error {
 		}
 	}()
 
+	const checkpoint = "mime"
+	resume := ""
+	if !restart {
+		if resume, err = fsck.Checkpoint(checkpoint); err != nil {
+			return err
+		}
+		if resume != "" {
+			fmt.Println("resuming mime scan after", resume)
+		}
+	}
+	progress := fs.NewProgress()
+	saveProgress := func() {
+		if last := progress.Last(); last != "" {
+			if err := fsck.SetCheckpoint(checkpoint, last); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	defer saveProgress()
+	go func() {
+		for _ = range time.Tick(10 * time.Second) {
+			saveProgress()
+		}
+	}()
+
+	blobCh := fs.Limit(progress.Track(fsck.List("file"), resume), limit)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range blobCh {
+				stats.Add(placeMIME(fsck, bs, ref))
+				progress.Done(ref)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// placeMIME detects and indexes the MIME type of the file schema blob
+// ref, returning the MIME type or a description of failure.
+func placeMIME(fsck *db.DB, bs blob.Fetcher, ref string) string {
+	s, err := schemaFromBlobRef(bs, ref)
+	if err != nil {
+		log.Printf("%s: previously indexed; now missing", ref)
+		return "badschema"
+	}
+	file, err := s.NewFileReader(bs)
+	if err != nil {
+		log.Printf("%s: unreadable: %s", ref, err)
+		return "unreadable"
+	}
+	mime, _ := magic.MIMETypeFromReader(file)
+	file.Close()
+	if mime == "" {
+		return "unknown"
+	}
+	if pos := strings.Index(mime, "; charset="); pos >= 0 {
+		mime = mime[:pos]
+	}
+	if err := fsck.PlaceMIME(ref, mime); err != nil {
+		log.Printf("%s: PlaceMIME(): %s", ref, err)
+		return "error"
+	}
+	return mime
+}
+
+func extScanBlobs(dbDir, blobDir string, workers int) error {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
 	blobCh := fsck.List("file")
 	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
@@ -384,30 +1014,161 @@ func mimeScanBlobs(dbDir, blobDir string, workers int) error {
 			for ref := range blobCh {
 				s, err := schemaFromBlobRef(bs, ref)
 				if err != nil {
-					log.Printf("%s: previously indexed; now missing", ref)
+					log.Print(err)
 					stats.Add("badschema")
 					continue
 				}
-				file, err := s.NewFileReader(bs)
+				ext := path.Ext(s.FileName())
+				if ext == "" {
+					stats.Add("none")
+					continue
+				}
+				if err := fsck.PlaceExtension(ref, ext); err != nil {
+					log.Printf("%s: PlaceExtension(): %s", ref, err)
+					stats.Add("error")
+					continue
+				}
+				stats.Add(strings.ToLower(ext))
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func verifySizes(dbDir, blobDir string, workers int, refsFile, retryFile string) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	files := fs.NewFiles(bs)
+	if retryFile != "" {
+		f, err := os.OpenFile(retryFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files.WriteFailures(f)
+	}
+	go files.LogErrorsFunc(func(string) { stats.Add("failed") })
+
+	blobCh := fsck.List("file")
+	if refsFile != "" {
+		if blobCh, err = readRefsFile(refsFile); err != nil {
+			return err
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files.VerifySizes(blobCh)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// readRefsFile streams the first tab-separated field of every
+// non-empty line of the named file.
+func readRefsFile(name string) (<-chan string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		defer f.Close()
+		lines := bufio.NewScanner(f)
+		for lines.Scan() {
+			if ref := strings.SplitN(lines.Text(), "\t", 2)[0]; ref != "" {
+				ch <- ref
+			}
+		}
+		if err := lines.Err(); err != nil {
+			log.Printf("%s: %s", name, err)
+		}
+	}()
+	return ch, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func verifyLocations(dbDir, blobDir string, workers int, locations []string, stale time.Duration) error {
+	if len(locations) == 0 && stale == 0 {
+		return errors.New("require at least one location prefix")
+	}
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	var refs <-chan string
+	if stale != 0 {
+		refs = fsck.StaleVerifications(time.Now().Add(-stale))
+	} else {
+		refs = fsck.RefsInLocations(locations...)
+	}
+	infos := fsck.Info(refs)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range infos {
+				body, _, err := bs.Fetch(blob.MustParse(info.Ref))
 				if err != nil {
-					log.Printf("%s: unreadable: %s", ref, err)
-					stats.Add("unreadable")
+					log.Printf("%s: indexed at %q but unfetchable: %s", info.Ref, info.Location, err)
+					stats.Add("missing")
 					continue
 				}
-				mime, _ := magic.MIMETypeFromReader(file)
-				file.Close()
-				if mime != "" {
-					if pos := strings.Index(mime, "; charset="); pos >= 0 {
-						mime = mime[:pos]
-					}
-					if err := fsck.PlaceMIME(ref, mime); err != nil {
-						log.Printf("%s: PlaceMIME(): %s", ref, mime)
-						mime = "error"
+				cr := &countingReader{Reader: body}
+				err = fs.CheckDigest(info.Ref, cr)
+				body.Close()
+				switch {
+				case err != nil:
+					log.Print(err)
+					stats.Add("corrupt")
+				case info.Size >= 0 && info.Size != cr.n:
+					log.Printf("%s: indexed with size %d but read %d", info.Ref, info.Size, cr.n)
+					stats.Add("size mismatch")
+				default:
+					stats.Add("ok")
+					if err := fsck.Verified(info.Ref, time.Now()); err != nil {
+						log.Printf("%s: recording verification: %s", info.Ref, err)
 					}
-				} else {
-					mime = "unknown"
 				}
-				stats.Add(mime)
 			}
 		}()
 	}
@@ -415,6 +1176,215 @@ func mimeScanBlobs(dbDir, blobDir string, workers int) error {
 	return nil
 }
 
+func sniffBlobs(dbDir, blobDir string, workers int) error {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	files := fs.NewFiles(bs)
+	go files.LogErrors()
+
+	// blobs with a MIME type, as from an earlier run or the exif
+	// tool, are left as they are. http.DetectContentType considers at
+	// most 512 bytes.
+	refs := fsck.Unclassified()
+	heads := make(chan fs.Head, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files.ReadHeads(refs, 512, heads)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(heads)
+	}()
+
+	classified := 0
+	for h := range heads {
+		mime := http.DetectContentType(h.Data)
+		if pos := strings.Index(mime, "; charset="); pos >= 0 {
+			mime = mime[:pos]
+		}
+		if mime == "application/octet-stream" {
+			// DetectContentType's fallback; no better than untyped.
+			stats.Add("unknown")
+			continue
+		}
+		if err := fsck.PlaceMIME(h.Ref, mime); err != nil {
+			log.Printf("%s: PlaceMIME(): %s", h.Ref, err)
+			stats.Add("error")
+			continue
+		}
+		stats.Add(mime)
+		classified++
+	}
+	fmt.Println("classified", classified)
+	return nil
+}
+
+func retypeBlobs(dbDir, blobDir string, workers int) error {
+	fsck, err := db.New(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	bs, err := dir.New(blobDir)
+	if err != nil {
+		return err
+	}
+
+	stats := fs.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	files := fs.NewFiles(bs)
+	go files.LogErrors()
+
+	reclassified := 0
+	for _, ct := range fsck.CamliTypes() {
+		refs := fsck.List(ct)
+		schemas := make(chan fs.Schema, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				files.ReadSchemas(refs, schemas)
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(schemas)
+		}()
+		for s := range schemas {
+			newType := ""
+			if s.Blob != nil {
+				newType = s.Type()
+			}
+			if newType == ct {
+				continue
+			}
+			if err := fsck.RetypeBlob(s.Ref, newType); err != nil {
+				log.Printf("%s: RetypeBlob(): %s", s.Ref, err)
+				stats.Add("error")
+				continue
+			}
+			if newType == "" {
+				newType = "data"
+			}
+			stats.Add(ct + " -> " + newType)
+			reclassified++
+		}
+	}
+	fmt.Println("reclassified", reclassified)
+	return nil
+}
+
+// enumerateBatch is the number of refs requested from a blobserver at
+// once.
+const enumerateBatch = 1000
+
+// enumerateRefs streams every ref in src, in order.
+func enumerateRefs(src blobserver.BlobEnumerator) <-chan string {
+	refs := make(chan string)
+	go func() {
+		defer close(refs)
+		ctx := context.New()
+		defer ctx.Cancel()
+		for after := ""; ; {
+			ch := make(chan blob.SizedRef)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- src.EnumerateBlobs(ctx, ch, after, enumerateBatch)
+			}()
+			n := 0
+			for sr := range ch {
+				after = sr.Ref.String()
+				refs <- after
+				n++
+			}
+			if err := <-errc; err != nil {
+				log.Fatal(err)
+			}
+			if n < enumerateBatch {
+				return
+			}
+		}
+	}()
+	return refs
+}
+
+// reconcile compares the blobs in the index with those in a Camlistore
+// server, at server if set or else in blobDir, printing those only in
+// the server with a + and those only in the index with a -. A server
+// is enumerated alongside the index, in ref order; blobDir is checked
+// by fs.Verify, with workers goroutines, in no particular order.
+func reconcile(dbDir, blobDir, server string, workers int) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	if server == "" {
+		bs, err := dir.New(blobDir)
+		if err != nil {
+			return err
+		}
+		v := fs.Verify(fsck, bs, workers)
+		defer log.Print(v.Stats)
+		absent := make(chan struct{})
+		go func() {
+			defer close(absent)
+			for ref := range v.Absent {
+				fmt.Println("-", ref)
+			}
+		}()
+		for ref := range v.Unindexed {
+			fmt.Println("+", ref)
+		}
+		<-absent
+		return v.Wait()
+	}
+	src := client.New(server)
+
+	stats := fs.NewStats()
+	defer log.Print(stats)
+
+	theirs, ours := enumerateRefs(src), fsck.RangeFound("", "")
+	t, tok := <-theirs
+	o, ook := <-ours
+	for tok || ook {
+		switch {
+		case !ook || tok && t < o:
+			fmt.Println("+", t)
+			stats.Add("server only")
+			t, tok = <-theirs
+		case !tok || o < t:
+			fmt.Println("-", o)
+			stats.Add("index only")
+			o, ook = <-ours
+		default:
+			stats.Add("both")
+			t, tok = <-theirs
+			o, ook = <-ours
+		}
+	}
+	return nil
+}
+
 func filePath(dbDir, blobDir string, refs []string) error {
 	fsck, err := db.NewRO(dbDir)
 	if err != nil {
@@ -428,7 +1398,9 @@ func filePath(dbDir, blobDir string, refs []string) error {
 	for _, r := range refs {
 		ch := make(chan []string, 10)
 		go func() {
-			fsck.StreamAllParentPaths(r, ch)
+			if err := fsck.StreamAllParentPaths(r, ch); err != nil {
+				log.Printf("%s: %s", r, err)
+			}
 			close(ch)
 		}()
 		// TODO(dichro): print something if there's no paths
@@ -471,6 +1443,115 @@ func filePath(dbDir, blobDir string, refs []string) error {
 	return nil
 }
 
+func rootsOf(dbDir string, refs []string) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	for _, ref := range refs {
+		roots, err := fsck.RootsOf(ref)
+		if err != nil {
+			return err
+		}
+		fmt.Println(ref)
+		for _, root := range roots {
+			fmt.Println("  -", root)
+		}
+	}
+	return nil
+}
+
+func duplicateLocations(dbDir string) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	for g := range fsck.DuplicateLocations() {
+		fmt.Println(g.Ref)
+		for _, loc := range g.Locations {
+			fmt.Println("  -", loc)
+		}
+	}
+	savings, skipped, err := fsck.DedupSavings()
+	if err != nil {
+		return err
+	}
+	log.Printf("collapsing duplicates would reclaim %d bytes (%d blobs of unknown size not counted)", savings, skipped)
+	return nil
+}
+
+// manifest lists the blobs a recipient needs to fetch to have a tree.
+type manifest struct {
+	Root  string          `json:"root"`
+	Blobs []manifestEntry `json:"blobs"`
+	// Size is the total size of Blobs, not counting those of unknown
+	// size.
+	Size int64 `json:"size"`
+	// Missing are blobs of the tree that aren't found, so can't be
+	// shared.
+	Missing []string `json:"missing,omitempty"`
+}
+
+type manifestEntry struct {
+	Ref      string `json:"ref"`
+	Location string `json:"location"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// shareManifest writes a manifest of the Closure of root, refusing
+// trees larger than maxBlobs or maxBytes, where these aren't 0.
+func shareManifest(dbDir, root string, maxBlobs int, maxBytes int64, w io.Writer) error {
+	fsck, err := db.NewRO(dbDir)
+	if err != nil {
+		return err
+	}
+	defer fsck.Close()
+	refs, err := fsck.Closure(root)
+	if err != nil {
+		return err
+	}
+	if maxBlobs > 0 && len(refs) > maxBlobs {
+		return fmt.Errorf("%s: tree of %d blobs exceeds --max_blobs=%d", root, len(refs), maxBlobs)
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, ref := range refs {
+			ch <- ref
+		}
+	}()
+	m := manifest{Root: root}
+	// Info streams in order, skipping refs that aren't found.
+	infos := fsck.Info(ch)
+	info, more := <-infos
+	for _, ref := range refs {
+		if !more || info.Ref != ref {
+			m.Missing = append(m.Missing, ref)
+			continue
+		}
+		e := manifestEntry{Ref: ref, Location: info.Location}
+		if info.Size >= 0 {
+			e.Size = info.Size
+			m.Size += info.Size
+		}
+		m.Blobs = append(m.Blobs, e)
+		info, more = <-infos
+	}
+	if maxBytes > 0 && m.Size > maxBytes {
+		return fmt.Errorf("%s: tree of %d bytes exceeds --max_bytes=%d", root, m.Size, maxBytes)
+	}
+	if len(m.Missing) > 0 {
+		log.Printf("%d blobs of the tree are missing and can't be shared", len(m.Missing))
+	}
+	// Signing needs the owner's key, so is left to Camlistore.
+	log.Printf("create the share claim with: camput share -transitive %s", root)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
 func schemaFromBlobRef(bs blob.Fetcher, ref string) (*schema.Blob, error) {
 	br, ok := blob.Parse(ref)
 	if !ok {
@@ -1,20 +1,40 @@
 package fsck
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"sync"
+	"time"
 
 	"camlistore.org/pkg/blob"
 	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/schema"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer is a no-op unless the application installs an OpenTelemetry
+// TracerProvider.
+var tracer = otel.Tracer("github.com/dichro/cameloff/fsck")
+
 // File is an opened file from the repo.
 type File struct {
 	io.ReadSeeker
 	*schema.Blob
 }
 
+// Close releases the reader of f's contents.
+func (f File) Close() error {
+	if c, ok := f.ReadSeeker.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // Files provides a stream of open file readers from the repo.
 type Files struct {
 	// Blob source
@@ -23,6 +43,34 @@ type Files struct {
 	Readers chan File
 	// Channels reporting various errors
 	Missing, Invalid, Unreadable chan string
+	Truncated                    chan Truncation
+	// Stats, if not nil, counts "retry-recovered" for each read that
+	// succeeded only after failing, and "retry-exhausted" for each
+	// that failed every attempt of Retry.
+	Stats *Stats
+
+	failures *failureLog
+	retry    retryPolicy
+}
+
+// retryPolicy is how many times, and how patiently, reads are tried.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+}
+
+// failureLog writes one line per failed ref to a writer shared by
+// every worker.
+type failureLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Truncation describes a file whose contents don't match the size
+// declared by its schema blob.
+type Truncation struct {
+	Ref              string
+	Expected, Actual int64
 }
 
 func NewFiles(fetcher blob.Fetcher) *Files {
@@ -32,6 +80,80 @@ func NewFiles(fetcher blob.Fetcher) *Files {
 		make(chan string),
 		make(chan string),
 		make(chan string),
+		make(chan Truncation),
+		nil,
+		nil,
+		retryPolicy{},
+	}
+}
+
+// Retry makes f try each fetch of a blob, each opening of a file's
+// contents, and each read of them by Reread, up to attempts times
+// before reporting the ref as failed, waiting base before the second
+// attempt and twice as long before each one after. Every attempt
+// fetches the blob afresh. Refs that aren't schema blobs aren't
+// retried.
+func (f *Files) Retry(attempts int, base time.Duration) {
+	f.retry = retryPolicy{attempts, base}
+}
+
+// try calls fn until it succeeds or Retry's attempts are exhausted,
+// returning its last error, noting the attempts if there were several.
+func (f Files) try(fn func() error) error {
+	wait := f.retry.base
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		switch {
+		case err == nil:
+			if attempt > 1 {
+				f.count("retry-recovered")
+			}
+			return nil
+		case attempt >= f.retry.attempts:
+			if attempt > 1 {
+				f.count("retry-exhausted")
+				return fmt.Errorf("%s (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (f Files) count(name string) {
+	if f.Stats != nil {
+		f.Stats.Add(name)
+	}
+}
+
+// fetch fetches ref, trying as often as Retry allows.
+func (f Files) fetch(ref blob.Ref) (body io.ReadCloser, size uint32, err error) {
+	err = f.try(func() (err error) {
+		body, size, err = f.Fetcher.Fetch(ref)
+		return err
+	})
+	return body, size, err
+}
+
+// WriteFailures directs f to write every ref it fails to read to w as
+// it happens, as a line holding the ref, a tab and the reason. Each
+// line is a single Write, so lines from concurrent readers don't
+// interleave. The first field of each line is a ref, so the result can
+// be fed back in to retry just those refs.
+func (f *Files) WriteFailures(w io.Writer) {
+	f.failures = &failureLog{w: w}
+}
+
+// fail records that ref couldn't be read, if WriteFailures was called.
+func (f Files) fail(ref string, reason interface{}) {
+	if f.failures == nil {
+		return
+	}
+	f.failures.mu.Lock()
+	defer f.failures.mu.Unlock()
+	if _, err := fmt.Fprintf(f.failures.w, "%s\t%s\n", ref, reason); err != nil {
+		log.Printf("%s: writing failure: %s", ref, err)
 	}
 }
 
@@ -39,25 +161,183 @@ func NewFiles(fetcher blob.Fetcher) *Files {
 // provided channel.
 func (f Files) ReadRefs(refs <-chan string) {
 	for ref := range refs {
-		ref := ref
+		if file, ok := f.readRef(ref); ok {
+			f.Readers <- file
+		}
+	}
+}
+
+// readRef opens the file corresponding to ref, reporting any error on
+// the appropriate channel.
+func (f Files) readRef(ref string) (File, bool) {
+	_, span := tracer.Start(context.Background(), "fsck.Files.readRef",
+		trace.WithAttributes(attribute.String("ref", ref)))
+	defer span.End()
+	br := blob.MustParse(ref)
+	body, size, err := f.fetch(br)
+	if err != nil {
+		span.RecordError(err)
+		f.fail(ref, err)
+		f.Missing <- ref
+		return File{}, false
+	}
+	span.SetAttributes(attribute.Int64("size", int64(size)))
+	s, ok := ParseSchema(br, body)
+	body.Close()
+	if !ok {
+		f.fail(ref, "not a schema blob")
+		f.Invalid <- ref
+		return File{}, false
+	}
+	var file *schema.FileReader
+	err = f.try(func() (err error) {
+		file, err = s.NewFileReader(f.Fetcher)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		f.fail(ref, err)
+		f.Unreadable <- ref
+		return File{}, false
+	}
+	return File{ReadSeeker: file, Blob: s}, true
+}
+
+// open fetches and opens the file ref once, for Reread.
+func (f Files) open(ref blob.Ref) (File, error) {
+	body, _, err := f.Fetcher.Fetch(ref)
+	if err != nil {
+		return File{}, err
+	}
+	s, ok := ParseSchema(ref, body)
+	body.Close()
+	if !ok {
+		return File{}, fmt.Errorf("%s: not a schema blob", ref)
+	}
+	file, err := s.NewFileReader(f.Fetcher)
+	if err != nil {
+		return File{}, err
+	}
+	return File{ReadSeeker: file, Blob: s}, nil
+}
+
+// Reread calls fn with file, such as one from Readers, to read and
+// decode its contents, and, as often as Retry allows, again with the
+// file opened afresh each time fn fails, so that a read failing partway
+// is retried from the start rather than against a consumed reader.
+// Each file that fn fails with is closed before the next is opened. It
+// returns the file fn last read, which the caller must close, and fn's
+// last error, or the error reopening the file.
+func (f Files) Reread(file File, fn func(File) error) (File, error) {
+	ref := file.BlobRef()
+	attempt := 0
+	err := f.try(func() error {
+		if attempt++; attempt > 1 {
+			file.Close()
+			var err error
+			if file, err = f.open(ref); err != nil {
+				return err
+			}
+		}
+		return fn(file)
+	})
+	return file, err
+}
+
+// VerifySizes reads all files corresponding to the refs supplied on
+// the provided channel, reporting those whose length differs from that
+// declared by their schema blob (including zero-length reads) on
+// Truncated.
+func (f Files) VerifySizes(refs <-chan string) {
+	for ref := range refs {
+		f.verifySize(ref)
+	}
+}
+
+func (f Files) verifySize(ref string) {
+	file, ok := f.readRef(ref)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	n, err := io.Copy(ioutil.Discard, file)
+	if err != nil {
+		f.fail(ref, err)
+		f.Unreadable <- ref
+		return
+	}
+	if size := file.PartsSize(); n != size {
+		f.fail(ref, fmt.Sprintf("read %d of %d bytes", n, size))
+		f.Truncated <- Truncation{ref, size, n}
+	}
+}
+
+// Head is the leading bytes of a blob from the repo.
+type Head struct {
+	Ref  string
+	Data []byte
+}
+
+// ReadHeads reads up to n leading bytes of every blob corresponding
+// to the refs supplied on the provided channel. Unlike ReadRefs, the
+// blobs need not be schema blobs.
+func (f Files) ReadHeads(refs <-chan string, n int, heads chan<- Head) {
+	for ref := range refs {
+		if head, ok := f.readHead(ref, n); ok {
+			heads <- head
+		}
+	}
+}
+
+func (f Files) readHead(ref string, n int) (Head, bool) {
+	_, span := tracer.Start(context.Background(), "fsck.Files.readHead",
+		trace.WithAttributes(attribute.String("ref", ref)))
+	defer span.End()
+	body, size, err := f.fetch(blob.MustParse(ref))
+	if err != nil {
+		span.RecordError(err)
+		f.fail(ref, err)
+		f.Missing <- ref
+		return Head{}, false
+	}
+	span.SetAttributes(attribute.Int64("size", int64(size)))
+	data := make([]byte, n)
+	m, err := io.ReadFull(body, data)
+	body.Close()
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		span.RecordError(err)
+		f.fail(ref, err)
+		f.Unreadable <- ref
+		return Head{}, false
+	}
+	return Head{Ref: ref, Data: data[:m]}, true
+}
+
+// Schema is a blob from the repo that was, and may still be, a schema
+// blob.
+type Schema struct {
+	Ref string
+	// Blob is nil if the blob no longer parses as a schema blob.
+	*schema.Blob
+}
+
+// ReadSchemas parses all blobs corresponding to the refs supplied on
+// the provided channel as schema blobs.
+func (f Files) ReadSchemas(refs <-chan string, schemas chan<- Schema) {
+	for ref := range refs {
 		br := blob.MustParse(ref)
-		body, _, err := f.Fetcher.Fetch(br)
+		body, _, err := f.fetch(br)
 		if err != nil {
+			f.fail(ref, err)
 			f.Missing <- ref
 			continue
 		}
-		s, ok := parseSchema(br, body)
+		s, ok := ParseSchema(br, body)
 		body.Close()
 		if !ok {
-			f.Invalid <- ref
-			continue
+			s = nil
 		}
-		file, err := s.NewFileReader(f.Fetcher)
-		if err != nil {
-			f.Unreadable <- ref
-			continue
-		}
-		f.Readers <- File{ReadSeeker: file, Blob: s}
+		schemas <- Schema{ref, s}
 	}
 }
 
@@ -65,7 +345,9 @@ func (f Files) Close() {
 	close(f.Readers)
 }
 
-func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
+// ParseSchema parses body as the schema blob ref, returning false if it
+// isn't one.
+func ParseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
 	sn := index.NewBlobSniffer(ref)
 	io.Copy(sn, body)
 	sn.Parse()
@@ -75,23 +357,34 @@ func parseSchema(ref blob.Ref, body io.Reader) (*schema.Blob, bool) {
 // LogErrors is a utility routine for dumping all encountered errors
 // to logs.
 func (f Files) LogErrors() {
+	f.LogErrorsFunc(nil)
+}
+
+// LogErrorsFunc is LogErrors, additionally calling fn (if not nil)
+// with each failed ref.
+func (f Files) LogErrorsFunc(fn func(ref string)) {
 	for {
+		var (
+			ref, msg string
+			ok       bool
+		)
 		select {
-		case ref, ok := <-f.Missing:
-			if !ok {
-				return
-			}
-			log.Printf("%s: previously indexed; now missing", ref)
-		case ref, ok := <-f.Invalid:
-			if !ok {
-				return
-			}
-			log.Printf("%s: previously schema blob; now unparseable", ref)
-		case ref, ok := <-f.Unreadable:
-			if !ok {
-				return
-			}
-			log.Printf("%s: unreadable", ref)
+		case ref, ok = <-f.Missing:
+			msg = "previously indexed; now missing"
+		case ref, ok = <-f.Invalid:
+			msg = "previously schema blob; now unparseable"
+		case ref, ok = <-f.Unreadable:
+			msg = "unreadable"
+		case t, tok := <-f.Truncated:
+			ref, ok = t.Ref, tok
+			msg = fmt.Sprintf("read %d of %d bytes", t.Actual, t.Expected)
+		}
+		if !ok {
+			return
+		}
+		log.Printf("%s: %s", ref, msg)
+		if fn != nil {
+			fn(ref)
 		}
 	}
 }
@@ -0,0 +1,119 @@
+package fsck
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/schema"
+)
+
+// flakyFetcher fails each ref's first fetches, as many as fails holds
+// for it, and then returns the ref's name as its contents.
+type flakyFetcher struct {
+	mu    sync.Mutex
+	fails map[string]int
+	calls map[string]int
+}
+
+func (f *flakyFetcher) Fetch(ref blob.Ref) (io.ReadCloser, uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := ref.String()
+	f.calls[name]++
+	if f.fails[name] > 0 {
+		f.fails[name]--
+		return nil, 0, errors.New("transient failure")
+	}
+	return ioutil.NopCloser(strings.NewReader(name)), uint32(len(name)), nil
+}
+
+func TestFilesRetry(t *testing.T) {
+	fetcher := &flakyFetcher{fails: map[string]int{"flaky": 2, "broken": 10}, calls: map[string]int{}}
+	f := NewFiles(fetcher)
+	f.Retry(3, time.Millisecond)
+	f.Stats = NewStats()
+
+	refs := make(chan string, 3)
+	refs <- "flaky"
+	refs <- "broken"
+	refs <- "fine"
+	close(refs)
+	heads := make(chan Head)
+	go func() {
+		f.ReadHeads(refs, 4, heads)
+		close(heads)
+	}()
+	var got []string
+	var missing []string
+	for heads != nil {
+		select {
+		case h, ok := <-heads:
+			if !ok {
+				heads = nil
+				continue
+			}
+			got = append(got, h.Ref+"="+string(h.Data))
+		case ref := <-f.Missing:
+			missing = append(missing, ref)
+		}
+	}
+	if want := []string{"flaky=flak", "fine=fine"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("heads = %q, want %q", got, want)
+	}
+	if want := []string{"broken"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %q, want %q", missing, want)
+	}
+	if want := map[string]int{"flaky": 3, "broken": 3, "fine": 1}; !reflect.DeepEqual(fetcher.calls, want) {
+		t.Errorf("fetches = %v, want %v", fetcher.calls, want)
+	}
+	if want := map[string]int{"retry-recovered": 1, "retry-exhausted": 1}; !reflect.DeepEqual(f.Stats.counts(), want) {
+		t.Errorf("stats = %v, want %v", f.Stats.counts(), want)
+	}
+}
+
+// closeCounter is a file's contents that count their Closes.
+type closeCounter struct {
+	io.ReadSeeker
+	closes *int
+}
+
+func (c closeCounter) Close() error {
+	*c.closes++
+	return nil
+}
+
+func TestFilesReread(t *testing.T) {
+	fetcher := &flakyFetcher{calls: map[string]int{}}
+	f := NewFiles(fetcher)
+	f.Retry(2, 0)
+	f.Stats = NewStats()
+	var closes int
+	file := File{ReadSeeker: closeCounter{strings.NewReader(""), &closes}, Blob: &schema.Blob{}}
+
+	// a read that succeeds is of the file given
+	got, err := f.Reread(file, func(File) error { return nil })
+	if err != nil || got != file || closes != 0 || len(fetcher.calls) != 0 {
+		t.Errorf("Reread of a good file = %v, %v, with %d closes and fetches %v", got, err, closes, fetcher.calls)
+	}
+
+	// a failed read is retried with the file fetched afresh, which
+	// the fake schema package can't parse
+	var reads int
+	_, err = f.Reread(file, func(File) error {
+		reads++
+		return errors.New("decode failed")
+	})
+	if err == nil || reads != 1 || closes != 1 || len(fetcher.calls) != 1 {
+		t.Errorf("Reread of a bad file = %v, with %d reads, %d closes and fetches %v", err, reads, closes, fetcher.calls)
+	}
+	if want := map[string]int{"retry-exhausted": 1}; !reflect.DeepEqual(f.Stats.counts(), want) {
+		t.Errorf("stats = %v, want %v", f.Stats.counts(), want)
+	}
+}
@@ -0,0 +1,58 @@
+package fsck
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]func() hash.Hash{
+		"sha1":   sha1.New,
+		"sha224": sha256.New224,
+	}
+)
+
+// RegisterHasher makes a hash algorithm available for refs of the form
+// name-<hex digest>.
+func RegisterHasher(name string, fn func() hash.Hash) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[name] = fn
+}
+
+// Hasher returns a new hash for the algorithm named by ref's prefix.
+func Hasher(ref string) (hash.Hash, error) {
+	pos := strings.Index(ref, "-")
+	if pos < 0 {
+		return nil, fmt.Errorf("%q: no hash algorithm prefix", ref)
+	}
+	hashersMu.RLock()
+	fn, ok := hashers[ref[:pos]]
+	hashersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: no hasher registered for %q", ref, ref[:pos])
+	}
+	return fn(), nil
+}
+
+// CheckDigest verifies that the contents of r hash to ref.
+func CheckDigest(ref string, r io.Reader) error {
+	h, err := Hasher(ref)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != ref[strings.Index(ref, "-")+1:] {
+		return fmt.Errorf("%s: contents hash to %s", ref, got)
+	}
+	return nil
+}
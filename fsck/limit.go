@@ -0,0 +1,37 @@
+package fsck
+
+// Limit passes through at most n refs from in, or all of them if n is
+// 0, closing the returned channel after the last. Once the limit is
+// reached in is no longer read, so whatever feeds it may block.
+func Limit(in <-chan string, n int) <-chan string {
+	if n <= 0 {
+		return in
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for i := 0; i < n; i++ {
+			ref, ok := <-in
+			if !ok {
+				return
+			}
+			out <- ref
+		}
+	}()
+	return out
+}
+
+// Skip passes through the refs from in for which skip returns false,
+// closing the returned channel after the last.
+func Skip(in <-chan string, skip func(ref string) bool) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for ref := range in {
+			if !skip(ref) {
+				out <- ref
+			}
+		}
+	}()
+	return out
+}
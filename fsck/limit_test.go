@@ -0,0 +1,63 @@
+package fsck
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// refs streams n sorted refs.
+func refs(n int) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			ch <- fmt.Sprintf("sha1-%040d", i)
+		}
+	}()
+	return ch
+}
+
+func drain(ch <-chan string) []string {
+	got := []string{}
+	for ref := range ch {
+		got = append(got, ref)
+	}
+	return got
+}
+
+func TestLimit(t *testing.T) {
+	for _, tc := range []struct{ refs, limit, want int }{
+		{5, 0, 5},
+		{5, -1, 5},
+		{5, 3, 3},
+		{5, 5, 5},
+		{3, 5, 3},
+		{0, 5, 0},
+	} {
+		if got := drain(Limit(refs(tc.refs), tc.limit)); len(got) != tc.want {
+			t.Errorf("Limit of %d refs to %d passed %d, want %d", tc.refs, tc.limit, len(got), tc.want)
+		}
+	}
+}
+
+func TestLimitCheckpoint(t *testing.T) {
+	// the checkpoint of a limited scan is the last ref scanned, so
+	// that the next run resumes just after it
+	p := NewProgress()
+	got := []string{}
+	for ref := range Limit(p.Track(refs(10), ""), 4) {
+		got = append(got, ref)
+		p.Done(ref)
+	}
+	if len(got) != 4 {
+		t.Fatalf("scanned %d refs, want 4", len(got))
+	}
+	if last := p.Last(); last != got[3] {
+		t.Errorf("Last = %q, want %q", last, got[3])
+	}
+	rest := drain(Limit(NewProgress().Track(refs(10), p.Last()), 0))
+	if want := drain(refs(10))[4:]; !reflect.DeepEqual(rest, want) {
+		t.Errorf("resumed scan = %q, want %q", rest, want)
+	}
+}
@@ -0,0 +1,27 @@
+package fsck
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// JSONLines writes values as newline-delimited JSON for many
+// goroutines, such as the workers of a scan, one line at a time so
+// that lines don't interleave.
+type JSONLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLines returns a JSONLines writing to w.
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{enc: json.NewEncoder(w)}
+}
+
+// Encode writes v as a line of JSON.
+func (j *JSONLines) Encode(v interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(v)
+}
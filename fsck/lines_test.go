@@ -0,0 +1,62 @@
+package fsck
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJSONLinesConcurrent(t *testing.T) {
+	type line struct {
+		Worker, N int
+		Text      string
+	}
+	// a bytes.Buffer isn't safe for concurrent writes, so -race
+	// catches any Encodes that aren't serialized
+	var buf bytes.Buffer
+	j := NewJSONLines(&buf)
+	const workers, lines = 32, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < lines; n++ {
+				if err := j.Encode(line{w, n, strings.Repeat(fmt.Sprint(w), 1000)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	seen := map[[2]int]bool{}
+	s := bufio.NewScanner(&buf)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var l line
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("line %q: %v", s.Text(), err)
+		}
+		if l.Text != strings.Repeat(fmt.Sprint(l.Worker), 1000) {
+			t.Errorf("worker %d line %d garbled", l.Worker, l.N)
+		}
+		seen[[2]int{l.Worker, l.N}] = true
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != workers*lines {
+		t.Errorf("read %d distinct lines, want %d", len(seen), workers*lines)
+	}
+}
@@ -1,6 +1,7 @@
 package fsck
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -24,6 +25,13 @@ func (p *Parallel) Go(f func()) {
 	}
 }
 
+// GoContext is Go, passing ctx to f. Each f should stop taking new work
+// once ctx is done, finishing what it has, so that Wait returns soon
+// after.
+func (p *Parallel) GoContext(ctx context.Context, f func(ctx context.Context)) {
+	p.Go(func() { f(ctx) })
+}
+
 func (p *Parallel) Wait() {
 	p.wg.Wait()
 }
@@ -0,0 +1,51 @@
+package fsck
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelGoContext(t *testing.T) {
+	const items = 1000
+	work := make(chan int)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer close(work)
+		for i := 0; i < items; i++ {
+			select {
+			case work <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var ran int64
+	p := &Parallel{Workers: 4}
+	p.GoContext(ctx, func(ctx context.Context) {
+		for range work {
+			if ctx.Err() != nil {
+				return
+			}
+			if atomic.AddInt64(&ran, 1) == 10 {
+				cancel()
+			}
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after cancel")
+	}
+	if n := atomic.LoadInt64(&ran); n < 10 || n >= items {
+		t.Errorf("%d of %d items ran, want some but not all", n, items)
+	}
+}
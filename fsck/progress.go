@@ -0,0 +1,57 @@
+package fsck
+
+import "sync"
+
+// Progress tracks a sorted stream of refs that are processed out of
+// order, such as by several workers. Last reports the greatest ref at
+// or before which every ref has been processed, which is safe to
+// resume from.
+type Progress struct {
+	mu       sync.Mutex
+	inflight []string
+	done     map[string]bool
+	last     string
+}
+
+func NewProgress() *Progress {
+	return &Progress{done: make(map[string]bool)}
+}
+
+// Track passes the refs from in after resume through to the returned
+// channel, noting each as in flight. in must be sorted.
+func (p *Progress) Track(in <-chan string, resume string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for ref := range in {
+			if ref <= resume {
+				continue
+			}
+			p.mu.Lock()
+			p.inflight = append(p.inflight, ref)
+			p.mu.Unlock()
+			out <- ref
+		}
+	}()
+	return out
+}
+
+// Done notes that ref has been processed.
+func (p *Progress) Done(ref string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[ref] = true
+	for len(p.inflight) > 0 && p.done[p.inflight[0]] {
+		p.last = p.inflight[0]
+		delete(p.done, p.last)
+		p.inflight = p.inflight[1:]
+	}
+}
+
+// Last returns the greatest ref such that it and every ref before it
+// have been processed.
+func (p *Progress) Last() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
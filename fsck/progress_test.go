@@ -0,0 +1,49 @@
+package fsck
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgressResume(t *testing.T) {
+	all := []string{"a", "b", "c", "d", "e", "f"}
+	feed := func() <-chan string {
+		ch := make(chan string)
+		go func() {
+			defer close(ch)
+			for _, ref := range all {
+				ch <- ref
+			}
+		}()
+		return ch
+	}
+
+	// a run that is killed with a, b and d processed, out of order
+	p := NewProgress()
+	out := p.Track(feed(), "")
+	var started []string
+	for i := 0; i < 4; i++ {
+		started = append(started, <-out)
+	}
+	for _, ref := range []string{"b", "d", "a"} {
+		p.Done(ref)
+	}
+	if !reflect.DeepEqual(started, all[:4]) {
+		t.Fatalf("Track passed %q, want %q", started, all[:4])
+	}
+	last := p.Last()
+	if last != "b" {
+		t.Fatalf("Last = %q, want b, before the unfinished c", last)
+	}
+	for range out {
+	}
+
+	// the next run resumes after it, redoing d
+	var resumed []string
+	for ref := range NewProgress().Track(feed(), last) {
+		resumed = append(resumed, ref)
+	}
+	if want := []string{"c", "d", "e", "f"}; !reflect.DeepEqual(resumed, want) {
+		t.Errorf("resumed with %q, want %q", resumed, want)
+	}
+}
@@ -0,0 +1,150 @@
+package fsck
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// refSetMagic starts every ref set.
+const refSetMagic = "camlirefs\x01"
+
+// A ref set is refSetMagic followed by one entry per ref, each
+// starting with a tag byte:
+//
+//	0           a uvarint length and that many bytes of ref, for refs
+//	            that aren't a hash name, a dash and lowercase hex
+//	1           a uvarint length and that many bytes of a new hash
+//	            name, assigned the next unused tag from 2, then a
+//	            digest
+//	2 and above a digest of the hash name assigned that tag
+//
+// where a digest is a uvarint length and that many bytes of the hex
+// digest, decoded. A sha1 ref thus takes 22 bytes rather than 46.
+const (
+	refRaw     = 0
+	refNewName = 1
+	refMaxTag  = 255
+)
+
+var errBadRefSet = errors.New("fsck: malformed ref set")
+
+// WriteRefSet writes the refs from refs to w in a compact binary
+// format, for ReadRefSet. Consecutive duplicate refs, which sorting a
+// stream makes of all duplicates, are written once.
+func WriteRefSet(w io.Writer, refs <-chan string) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(refSetMagic); err != nil {
+		return err
+	}
+	tags := map[string]byte{}
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		bw.Write(buf[:n])
+		bw.Write(b)
+	}
+	prev := ""
+	for ref := range refs {
+		if ref == prev {
+			continue
+		}
+		prev = ref
+		i := strings.IndexByte(ref, '-')
+		digest, err := hex.DecodeString(ref[i+1:])
+		if i <= 0 || err != nil || hex.EncodeToString(digest) != ref[i+1:] {
+			bw.WriteByte(refRaw)
+			writeBytes([]byte(ref))
+			continue
+		}
+		name := ref[:i]
+		tag, ok := tags[name]
+		switch {
+		case ok:
+			bw.WriteByte(tag)
+		case len(tags) < refMaxTag-1:
+			tags[name] = byte(len(tags) + 2)
+			bw.WriteByte(refNewName)
+			writeBytes([]byte(name))
+		default:
+			bw.WriteByte(refRaw)
+			writeBytes([]byte(ref))
+			continue
+		}
+		writeBytes(digest)
+	}
+	return bw.Flush()
+}
+
+// ReadRefSet streams the refs written to r by WriteRefSet. Reading
+// stops, and the error is logged, if r is malformed.
+func ReadRefSet(r io.Reader) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		if err := readRefSet(bufio.NewReader(r), ch); err != nil {
+			log.Print(err)
+		}
+	}()
+	return ch
+}
+
+func readRefSet(br *bufio.Reader, ch chan<- string) error {
+	magic := make([]byte, len(refSetMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != refSetMagic {
+		return errBadRefSet
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > 1<<16 {
+			return nil, errBadRefSet
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+	var names []string
+	for {
+		tag, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if tag == refRaw {
+			ref, err := readBytes()
+			if err != nil {
+				return fmt.Errorf("%s: %s", errBadRefSet, err)
+			}
+			ch <- string(ref)
+			continue
+		}
+		var name string
+		if tag == refNewName {
+			b, err := readBytes()
+			if err != nil {
+				return fmt.Errorf("%s: %s", errBadRefSet, err)
+			}
+			name = string(b)
+			names = append(names, name)
+		} else if i := int(tag) - 2; i < len(names) {
+			name = names[i]
+		} else {
+			return errBadRefSet
+		}
+		digest, err := readBytes()
+		if err != nil {
+			return fmt.Errorf("%s: %s", errBadRefSet, err)
+		}
+		ch <- name + "-" + hex.EncodeToString(digest)
+	}
+}
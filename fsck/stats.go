@@ -1,38 +1,154 @@
 package fsck
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Stats is a set of named counters, safe for concurrent use. Each
+// counter is sharded so that concurrent Adds rarely touch the same
+// memory, and is summed when read.
 type Stats struct {
-	mu     sync.Mutex
-	counts map[string]int
+	counters sync.Map // string to *counter
+
+	// mu guards the alerts of every counter.
+	mu sync.Mutex
+}
+
+// counterShards is the number of shards of each counter.
+const counterShards = 16
+
+type counter struct {
+	shards [counterShards]struct {
+		n int64
+		// pad each shard to its own cache line
+		_ [56]byte
+	}
+	// alerting is non-zero if alerts is not empty.
+	alerting int32
+	alerts   []*alert
+}
+
+// shards hands out the *uint32 number of the shard an Add should use.
+// A sync.Pool caches its items per P, so each Add usually gets back
+// the number last used on its own P, and concurrent Adds pick
+// different shards without sharing any memory to do it.
+var shards = sync.Pool{New: func() interface{} {
+	n := atomic.AddUint32(&nextShard, 1)
+	return &n
+}}
+
+// nextShard numbers the shards handed out by shards.
+var nextShard uint32
+
+func (c *counter) add(shard uint32, n int64) {
+	atomic.AddInt64(&c.shards[shard%counterShards].n, n)
+}
+
+func (c *counter) sum() (n int64) {
+	for i := range c.shards {
+		n += atomic.LoadInt64(&c.shards[i].n)
+	}
+	return
+}
+
+// alert is a callback registered with AlertWhen.
+type alert struct {
+	threshold int64
+	fn        func(string, int64)
+	fired     bool
 }
 
 func NewStats() *Stats {
-	return &Stats{counts: make(map[string]int)}
+	return &Stats{}
+}
+
+func (s *Stats) counter(name string) *counter {
+	if c, ok := s.counters.Load(name); ok {
+		return c.(*counter)
+	}
+	c, _ := s.counters.LoadOrStore(name, new(counter))
+	return c.(*counter)
+}
+
+// counts returns the current value of every counter.
+func (s *Stats) counts() map[string]int {
+	counts := map[string]int{}
+	s.counters.Range(func(k, v interface{}) bool {
+		counts[k.(string)] = int(v.(*counter).sum())
+		return true
+	})
+	return counts
 }
 
 func (s *Stats) String() string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	parts := []string{}
-	for t, c := range s.counts {
+	for t, c := range s.counts() {
 		parts = append(parts, fmt.Sprintf("%s: %d", t, c))
 	}
 	sort.Strings(parts)
 	return strings.Join(parts, ", ")
 }
 
+// MarshalJSON encodes the counters as a JSON object.
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.counts())
+}
+
 func (s *Stats) Add(entry string) {
+	s.add(entry, 1)
+}
+
+func (s *Stats) add(name string, n int64) {
+	c := s.counter(name)
+	shard := shards.Get().(*uint32)
+	c.add(*shard, n)
+	shards.Put(shard)
+	if atomic.LoadInt32(&c.alerting) == 0 {
+		return
+	}
+	s.mu.Lock()
+	v := c.sum()
+	var fire []*alert
+	for _, a := range c.alerts {
+		if !a.fired && v > a.threshold {
+			a.fired = true
+			fire = append(fire, a)
+		}
+	}
+	s.mu.Unlock()
+	for _, a := range fire {
+		a.fn(name, v)
+	}
+}
+
+// Merge adds the value of every counter of other to the counter of
+// the same name in s, creating any s lacks, and fires the alerts of s
+// that the sums cross. Merging s into itself does nothing.
+func (s *Stats) Merge(other *Stats) {
+	if other == s {
+		return
+	}
+	for k, v := range other.counts() {
+		s.add(k, int64(v))
+	}
+}
+
+// AlertWhen arranges for fn to be called, once, when the named
+// counter first exceeds threshold. fn is called from the Add that
+// crossed it, without holding any lock.
+func (s *Stats) AlertWhen(name string, threshold int64, fn func(name string, v int64)) {
+	c := s.counter(name)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.counts[entry]++
+	c.alerts = append(c.alerts, &alert{threshold: threshold, fn: fn})
+	atomic.StoreInt32(&c.alerting, 1)
 }
 
 func (s *Stats) LogEvery(interval time.Duration) *time.Ticker {
@@ -45,47 +161,59 @@ func (s *Stats) LogEvery(interval time.Duration) *time.Ticker {
 	return t
 }
 
-func (s *Stats) entries() entries {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	e := make(entries, 0, len(s.counts))
-	for k, v := range s.counts {
-		e = append(e, entry{k, v})
+// TopN returns up to n of the highest counts, in descending order of
+// count and then ascending order of name. It returns none for n <= 0.
+func (s *Stats) TopN(n int) Counts {
+	if n <= 0 {
+		return Counts{}
+	}
+	counts := s.counts()
+	c := make(Counts, 0, len(counts))
+	for k, v := range counts {
+		c = append(c, Count{k, v})
+	}
+	sort.Sort(byCount(c))
+	if n < len(c) {
+		c = c[:n]
 	}
-	return e
+	return c
 }
 
 func (s *Stats) LogTopNEvery(n int, interval time.Duration) *time.Ticker {
 	t := time.NewTicker(interval)
 	go func() {
 		for _ = range t.C {
-			e := s.entries()
-			sort.Sort(byValue(e))
-			log.Print(e[:n])
+			log.Print(s.TopN(n))
 		}
 	}()
 	return t
 }
 
-type entry struct {
-	key string
-	val int
+// Count is a single named counter.
+type Count struct {
+	Name  string
+	Value int
 }
 
-func (e entry) String() string { return fmt.Sprintf("%q: %d", e.key, e.val) }
+func (c Count) String() string { return fmt.Sprintf("%q: %d", c.Name, c.Value) }
 
-type entries []entry
+type Counts []Count
 
-func (e entries) String() string {
-	s := make([]string, len(e))
-	for i, e := range e {
-		s[i] = e.String()
+func (c Counts) String() string {
+	s := make([]string, len(c))
+	for i, c := range c {
+		s[i] = c.String()
 	}
 	return strings.Join(s, ", ")
 }
 
-type byValue []entry
+type byCount []Count
 
-func (b byValue) Len() int           { return len(b) }
-func (b byValue) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b byValue) Less(i, j int) bool { return b[j].val < b[i].val }
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if b[i].Value != b[j].Value {
+		return b[j].Value < b[i].Value
+	}
+	return b[i].Name < b[j].Name
+}
@@ -0,0 +1,87 @@
+package fsck
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTopN(t *testing.T) {
+	s := NewStats()
+	for name, n := range map[string]int{"file": 3, "bytes": 2, "data": 3, "directory": 1} {
+		for i := 0; i < n; i++ {
+			s.Add(name)
+		}
+	}
+	for _, tc := range []struct {
+		n    int
+		want Counts
+	}{
+		{-1, Counts{}},
+		{0, Counts{}},
+		{2, Counts{{"data", 3}, {"file", 3}}},
+		{10, Counts{{"data", 3}, {"file", 3}, {"bytes", 2}, {"directory", 1}}},
+	} {
+		if got := s.TopN(tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("TopN(%d) = %v, want %v", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestStatsConcurrentAdd(t *testing.T) {
+	s := NewStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Add("file")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.TopN(1); !reflect.DeepEqual(got, Counts{{"file", 8000}}) {
+		t.Errorf("TopN(1) = %v, want file: 8000", got)
+	}
+}
+
+// lockedStats is a map of counters under a single mutex, as Stats
+// was before it was sharded.
+type lockedStats struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (s *lockedStats) Add(name string) {
+	s.mu.Lock()
+	s.counts[name]++
+	s.mu.Unlock()
+}
+
+// BenchmarkStatsAdd compares concurrent Adds of one counter, as by
+// the workers of a scan, to those picking a shard with a shared atomic
+// counter, and to those of a single locked map. The differences only
+// show with several CPUs.
+func BenchmarkStatsAdd(b *testing.B) {
+	shared := NewStats()
+	var next uint32
+	for _, bc := range []struct {
+		name string
+		add  func(string)
+	}{
+		{"sharded", NewStats().Add},
+		{"shared-next", func(name string) { shared.counter(name).add(atomic.AddUint32(&next, 1), 1) }},
+		{"locked", (&lockedStats{counts: map[string]int{}}).Add},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bc.add("file")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package fsck
+
+// teeBuffer is the number of refs buffered for each consumer of Tee.
+const teeBuffer = 64
+
+// Tee copies every ref from in to each of n returned channels, which
+// are closed once in is. Each consumer has a small buffer, beyond
+// which the slowest consumer paces the source; every consumer must
+// therefore drain its channel.
+func Tee(in <-chan string, n int) []<-chan string {
+	return tee(in, n, teeBuffer, nil)
+}
+
+// TeeDropping is Tee, except that a ref is dropped for any consumer
+// whose buffer of size buffer is full, rather than waiting for it. If
+// dropped is not nil, it is called with the index of the consumer and
+// the ref it missed.
+func TeeDropping(in <-chan string, n, buffer int, dropped func(i int, ref string)) []<-chan string {
+	if dropped == nil {
+		dropped = func(int, string) {}
+	}
+	return tee(in, n, buffer, dropped)
+}
+
+func tee(in <-chan string, n, buffer int, dropped func(int, string)) []<-chan string {
+	outs := make([]chan string, n)
+	ret := make([]<-chan string, n)
+	for i := range outs {
+		outs[i] = make(chan string, buffer)
+		ret[i] = outs[i]
+	}
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for ref := range in {
+			for i, out := range outs {
+				if dropped == nil {
+					out <- ref
+					continue
+				}
+				select {
+				case out <- ref:
+				default:
+					dropped(i, ref)
+				}
+			}
+		}
+	}()
+	return ret
+}
@@ -0,0 +1,190 @@
+package fsck
+
+import (
+	"sync"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/context"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// verifyBatch is the number of refs Verify enumerates from, or stats
+// in, the blob server at once.
+const verifyBatch = 1000
+
+// Verification reports the discrepancies between an index and a blob
+// server found by Verify. Both channels must be drained.
+type Verification struct {
+	// Unindexed streams the refs of blobs in the blob server that
+	// the index has no record of.
+	Unindexed <-chan string
+	// Absent streams the refs of found blobs that the blob server
+	// doesn't have.
+	Absent <-chan string
+	// Stats counts "unindexed" and "absent", as streamed, and
+	// "indexed" and "present" for the blobs found on either side.
+	Stats *Stats
+
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+	done chan struct{}
+}
+
+// Verify reconciles d against bs: the blobs bs enumerates are looked
+// up in d, and the blobs d has found are statted in bs, each by
+// workers goroutines, or one if workers is less than 1. Discrepancies
+// are streamed in no particular order. The scan of d's found blobs
+// reports its progress to any func set by d.TrackProgress, and Stats
+// counts the blobs of bs as they're looked up.
+func Verify(d *db.DB, bs blobserver.Storage, workers int) *Verification {
+	if workers < 1 {
+		workers = 1
+	}
+	unindexed, absent := make(chan string), make(chan string)
+	v := &Verification{
+		Unindexed: unindexed,
+		Absent:    absent,
+		Stats:     NewStats(),
+		done:      make(chan struct{}),
+	}
+	v.wg.Add(2)
+	go func() {
+		defer v.wg.Done()
+		defer close(unindexed)
+		refs := v.enumerate(bs)
+		p := Parallel{Workers: workers}
+		p.Go(func() {
+			for ref := range refs {
+				ok, err := d.Has(ref)
+				switch {
+				case err != nil:
+					v.fail(err)
+				case ok:
+					v.Stats.Add("indexed")
+				default:
+					v.Stats.Add("unindexed")
+					unindexed <- ref
+				}
+			}
+		})
+		p.Wait()
+	}()
+	go func() {
+		defer v.wg.Done()
+		defer close(absent)
+		refs := d.RangeFound("", "")
+		p := Parallel{Workers: workers}
+		p.Go(func() {
+			for batch := nextBatch(refs); len(batch) > 0; batch = nextBatch(refs) {
+				v.stat(bs, batch, absent)
+			}
+		})
+		p.Wait()
+	}()
+	go func() {
+		v.wg.Wait()
+		close(v.done)
+	}()
+	return v
+}
+
+// Wait waits for Verify to finish, returning the first error, if any,
+// enumerating or statting the blob server or reading the index.
+func (v *Verification) Wait() error {
+	<-v.done
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+func (v *Verification) fail(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err == nil {
+		v.err = err
+	}
+}
+
+// enumerate streams every ref in bs, in order.
+func (v *Verification) enumerate(bs blobserver.BlobEnumerator) <-chan string {
+	refs := make(chan string)
+	go func() {
+		defer close(refs)
+		ctx := context.New()
+		defer ctx.Cancel()
+		for after := ""; ; {
+			ch := make(chan blob.SizedRef)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- bs.EnumerateBlobs(ctx, ch, after, verifyBatch)
+			}()
+			n := 0
+			for sr := range ch {
+				after = sr.Ref.String()
+				refs <- after
+				n++
+			}
+			if err := <-errc; err != nil {
+				v.fail(err)
+				return
+			}
+			if n < verifyBatch {
+				return
+			}
+		}
+	}()
+	return refs
+}
+
+// stat streams those of refs that bs doesn't have to absent.
+func (v *Verification) stat(bs blobserver.BlobStatter, refs []string, absent chan<- string) {
+	brs := make([]blob.Ref, 0, len(refs))
+	for _, ref := range refs {
+		br, ok := blob.Parse(ref)
+		if !ok {
+			// an unparseable ref can't be in the blob server
+			v.Stats.Add("absent")
+			absent <- ref
+			continue
+		}
+		brs = append(brs, br)
+	}
+	present := make(map[string]bool)
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bs.StatBlobs(ch, brs)
+		close(ch)
+	}()
+	for sr := range ch {
+		present[sr.Ref.String()] = true
+	}
+	if err := <-errc; err != nil {
+		v.fail(err)
+		return
+	}
+	for _, br := range brs {
+		if ref := br.String(); present[ref] {
+			v.Stats.Add("present")
+		} else {
+			v.Stats.Add("absent")
+			absent <- ref
+		}
+	}
+}
+
+// nextBatch returns up to verifyBatch refs from refs, or none once it
+// is closed.
+func nextBatch(refs <-chan string) []string {
+	var batch []string
+	for ref := range refs {
+		batch = append(batch, ref)
+		if len(batch) == verifyBatch {
+			break
+		}
+	}
+	return batch
+}
@@ -0,0 +1,119 @@
+package fsck
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/context"
+
+	"github.com/dichro/cameloff/db"
+)
+
+// fakeStorage is a blobserver.Storage holding the set of refs it was
+// made with, and no contents.
+type fakeStorage struct {
+	refs []string // sorted
+}
+
+func newFakeStorage(refs ...string) *fakeStorage {
+	sort.Strings(refs)
+	return &fakeStorage{refs: refs}
+}
+
+func (s *fakeStorage) has(ref string) bool {
+	i := sort.SearchStrings(s.refs, ref)
+	return i < len(s.refs) && s.refs[i] == ref
+}
+
+func (s *fakeStorage) EnumerateBlobs(ctx *context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	for i := sort.SearchStrings(s.refs, after); i < len(s.refs) && limit > 0; i++ {
+		if s.refs[i] == after {
+			continue
+		}
+		dest <- blob.SizedRef{Ref: blob.MustParse(s.refs[i])}
+		limit--
+	}
+	return nil
+}
+
+func (s *fakeStorage) StatBlobs(dest chan<- blob.SizedRef, blobs []blob.Ref) error {
+	for _, br := range blobs {
+		if s.has(br.String()) {
+			dest <- blob.SizedRef{Ref: br}
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) Fetch(blob.Ref) (io.ReadCloser, uint32, error) {
+	return nil, 0, errors.New("fakeStorage: no contents")
+}
+
+func (s *fakeStorage) ReceiveBlob(blob.Ref, io.Reader) (blob.SizedRef, error) {
+	return blob.SizedRef{}, errors.New("fakeStorage: read-only")
+}
+
+func (s *fakeStorage) RemoveBlobs([]blob.Ref) error {
+	return errors.New("fakeStorage: read-only")
+}
+
+func collectSorted(ch <-chan string) []string {
+	var refs []string
+	for ref := range ch {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+func TestVerify(t *testing.T) {
+	d, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// more than a batch, so that enumerating and statting both page
+	const n = verifyBatch + 10
+	var stored []string
+	for i := 0; i < n; i++ {
+		ref := fmt.Sprintf("sha1-%04d", i)
+		if err := d.Place(ref, "pack", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if i != 7 {
+			stored = append(stored, ref)
+		}
+	}
+	bs := newFakeStorage(append(stored, "sha1-extra")...)
+
+	for _, workers := range []int{0, 1, 4} {
+		v := Verify(d, bs, workers)
+		var unindexed, absent []string
+		done := make(chan bool)
+		go func() {
+			absent = collectSorted(v.Absent)
+			done <- true
+		}()
+		unindexed = collectSorted(v.Unindexed)
+		<-done
+		if err := v.Wait(); err != nil {
+			t.Errorf("%d workers: Wait = %v", workers, err)
+		}
+		if want := []string{"sha1-extra"}; !reflect.DeepEqual(unindexed, want) {
+			t.Errorf("%d workers: Unindexed = %q, want %q", workers, unindexed, want)
+		}
+		if want := []string{"sha1-0007"}; !reflect.DeepEqual(absent, want) {
+			t.Errorf("%d workers: Absent = %q, want %q", workers, absent, want)
+		}
+		want := map[string]int{"indexed": n - 1, "unindexed": 1, "present": n - 1, "absent": 1}
+		if got := v.Stats.counts(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: Stats = %v, want %v", workers, got, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// index populates an fsck index from any Camlistore blobserver that
+// can enumerate its blobs, reading schema blobs for their camliType
+// and dependencies.
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/blobserver/dir"
+	"camlistore.org/pkg/context"
+
+	"github.com/dichro/cameloff/db"
+	"github.com/dichro/cameloff/fsck"
+)
+
+// enumerateBatch is the number of refs requested from the blobserver
+// at once.
+const enumerateBatch = 1000
+
+// placeBatch is the number of entries written to the index at once.
+const placeBatch = 1000
+
+func main() {
+	dbDir := flag.String("db_dir", "", "FSCK state database directory")
+	blobDir := flag.String("blob_dir", "", "Camlistore blob directory")
+	restart := flag.Bool("restart", false, "Restart indexing from start, ignoring prior progress")
+	numWorkers := flag.Int("workers", 8, "parallel worker goroutines")
+	limit := flag.Int("limit", 0, "Index at most this many blobs; 0 for no limit")
+	source := flag.String("source", "", "Name to record as the source of every blob indexed")
+	syncWrites := flag.Bool("sync", false, "Sync every write to disk, so that an OS crash can't lose indexed blobs")
+	flag.Parse()
+
+	fdb, err := db.New(*dbDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fdb.Close()
+	fdb.SetSync(*syncWrites)
+	bs, err := dir.New(*blobDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stats := fsck.NewStats()
+	defer stats.LogEvery(10 * time.Second).Stop()
+	defer log.Print(stats)
+
+	const checkpoint = "index"
+	resume := ""
+	if !*restart {
+		if resume, err = fdb.Checkpoint(checkpoint); err != nil {
+			log.Fatal(err)
+		}
+		if resume != "" {
+			log.Print("resuming index after ", resume)
+		}
+	}
+	bt := fdb.NewBatcher(placeBatch, 0)
+	progress := fsck.NewProgress()
+	saveProgress := func() {
+		if last := progress.Last(); last != "" {
+			// the checkpoint mustn't get ahead of the index
+			if err := bt.Flush(); err != nil {
+				log.Print(err)
+				return
+			}
+			if err := fdb.SetCheckpoint(checkpoint, last); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	defer saveProgress()
+	go func() {
+		for _ = range time.Tick(10 * time.Second) {
+			saveProgress()
+		}
+	}()
+
+	refs := make(chan string)
+	go func() {
+		defer close(refs)
+		ctx := context.New()
+		defer ctx.Cancel()
+		for after := resume; ; {
+			ch := make(chan blob.SizedRef)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- bs.EnumerateBlobs(ctx, ch, after, enumerateBatch)
+			}()
+			n := 0
+			for sr := range ch {
+				after = sr.Ref.String()
+				refs <- after
+				n++
+			}
+			if err := <-errc; err != nil {
+				log.Fatal(err)
+			}
+			if n < enumerateBatch {
+				return
+			}
+		}
+	}()
+
+	index := func(ref string) {
+		br := blob.MustParse(ref)
+		body, size, err := bs.Fetch(br)
+		if err != nil {
+			log.Printf("%s: %s", ref, err)
+			stats.Add("unreadable")
+			return
+		}
+		s, ok := fsck.ParseSchema(br, body)
+		body.Close()
+		// a blobserver doesn't say where within it a blob is stored,
+		// so the location is left to fsck scan, as is last.
+		e := db.PlaceEntry{
+			Ref:      ref,
+			Size:     int64(size),
+			SkipLast: true,
+			Source:   *source,
+		}
+		if ok {
+			e.Type = s.Type()
+			e.Dependencies = fsck.Dependencies(s)
+			stats.Add(e.Type)
+		} else {
+			stats.Add("data")
+		}
+		if err := bt.Add(e); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tracked := fsck.Limit(progress.Track(refs, resume), *limit)
+	workers := fsck.Parallel{Workers: *numWorkers}
+	workers.Go(func() {
+		for ref := range tracked {
+			index(ref)
+			progress.Done(ref)
+		}
+	})
+	workers.Wait()
+	if err := bt.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
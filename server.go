@@ -0,0 +1,321 @@
+// server answers queries against an fsck index over HTTP.
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dichro/cameloff/db"
+	"github.com/dichro/cameloff/db/metrics"
+)
+
+// flushEvery is the number of lines streamed between flushes.
+const flushEvery = 100
+
+// pageSize is the number of refs listed on each page of the UI.
+const pageSize = 100
+
+//go:embed ui
+var uiFS embed.FS
+
+var templates = template.Must(template.ParseFS(uiFS, "ui/*.html"))
+
+type server struct {
+	db *db.DB
+	// timeout bounds each query.
+	timeout time.Duration
+}
+
+func main() {
+	dbDir := flag.String("db_dir", "", "FSCK state database directory")
+	listen := flag.String("listen", ":8080", "HTTP listen address")
+	timeout := flag.Duration("timeout", 30*time.Second, "maximum duration of each query")
+	warm := flag.Bool("warm", true, "read the type and MIME type indexes in the background at startup")
+	metricsEvery := flag.Duration("metrics_interval", time.Minute, "minimum interval between the index scans serving /metrics")
+	admin := flag.Bool("admin", false, "serve POST /admin/reopen, which switches to the index directory given by its db_dir parameter")
+	blockCacheMB := flag.Int("block_cache_mb", 0, "index block cache size in MB, or 0 for leveldb's default of 8")
+	bloomBits := flag.Int("bloom_bits", 0, "bits per key of the bloom filters the index was built with, or 0 for none")
+	flag.Parse()
+
+	fdb, err := db.NewROWithOptions(*dbDir, db.Options{
+		BlockCache: *blockCacheMB << 20,
+		BloomBits:  *bloomBits,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fdb.Close()
+	if *warm {
+		go func() {
+			if err := fdb.Warm(); err != nil {
+				log.Printf("warming cache: %s", err)
+			}
+		}()
+	}
+
+	s := &server{fdb, *timeout}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/closure/", s.closure)
+	mux.HandleFunc("/blob/", s.blob)
+	mux.HandleFunc("/ui/", s.uiIndex)
+	mux.HandleFunc("/ui/list", s.uiList)
+	mux.HandleFunc("/ui/blob", s.uiBlob)
+	mux.HandleFunc("/ui/missing", s.uiMissing)
+	mux.HandleFunc("/ui/stats", s.uiStats)
+	mux.Handle("/metrics", metrics.Handler(fdb, *metricsEvery))
+	if *admin {
+		mux.HandleFunc("/admin/reopen", s.reopen)
+	}
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Ping(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// reopen switches the server to another index directory, such as one
+// freshly rebuilt alongside the live one, without dropping queries.
+func (s *server) reopen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := r.FormValue("db_dir")
+	if dir == "" {
+		http.Error(w, "missing db_dir", http.StatusBadRequest)
+		return
+	}
+	if err := s.db.Reopen(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("reopened index at %s", dir)
+	w.Write([]byte("ok\n"))
+}
+
+// blob describes a single blob as JSON.
+func (s *server) blob(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/blob/")
+	rec, err := s.db.Describe(ref)
+	switch {
+	case err == db.ErrNotFound:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// closureEntry is a line of the /closure/ response.
+type closureEntry struct {
+	Ref      string `json:"ref"`
+	Location string `json:"location,omitempty"`
+}
+
+// closure streams the transitive dependencies of a blob as
+// newline-delimited JSON, with their locations if the query has
+// locations=true.
+func (s *server) closure(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/closure/")
+	if ref == "" {
+		http.Error(w, "missing ref", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+	refs, err := s.db.ClosureContext(ctx, ref)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	// Once streaming has begun, the status can't be changed, so an
+	// expired ctx just truncates the response.
+	write := func(i int, e closureEntry) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if err := enc.Encode(e); err != nil {
+			return false
+		}
+		if flusher != nil && i%flushEvery == flushEvery-1 {
+			flusher.Flush()
+		}
+		return true
+	}
+	if r.URL.Query().Get("locations") != "true" {
+		for i, ref := range refs {
+			if !write(i, closureEntry{Ref: ref}) {
+				return
+			}
+		}
+		return
+	}
+	ch := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for _, ref := range refs {
+			select {
+			case ch <- ref:
+			case <-done:
+				return
+			}
+		}
+	}()
+	// Info streams in order, but skips refs that aren't found, which
+	// are then sent without a location.
+	infos := s.db.Info(ch)
+	info, more := <-infos
+	for i, ref := range refs {
+		e := closureEntry{Ref: ref}
+		if more && info.Ref == ref {
+			e.Location = info.Location
+			info, more = <-infos
+		}
+		if !write(i, e) {
+			break
+		}
+	}
+	close(done)
+	for range infos {
+	}
+}
+
+// queryError reports a failed query: as a timeout if its deadline
+// passed; not at all if the client went away; and otherwise as an
+// internal error.
+func queryError(w http.ResponseWriter, err error) {
+	switch err {
+	case context.DeadlineExceeded:
+		http.Error(w, "query timed out", http.StatusServiceUnavailable)
+	case context.Canceled:
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// render executes the named UI template with data.
+func render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("%s: %s", name, err)
+	}
+}
+
+// uiIndex lists the known camliTypes and MIME types.
+func (s *server) uiIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	render(w, "index.html", struct {
+		Title                 string
+		CamliTypes, MIMETypes []string
+	}{"types", s.db.CamliTypes(), s.db.MIMETypes()})
+}
+
+// listPage is a page of refs from one of the indexes.
+type listPage struct {
+	Title, Kind, Filter string
+	Refs                []string
+	Next                string
+}
+
+// uiList lists a page of the blobs with a camliType, MIME type or
+// extension.
+func (s *server) uiList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := listPage{Kind: q.Get("kind"), Filter: q.Get("filter")}
+	switch p.Kind {
+	case "type", "mime", "ext":
+	default:
+		http.Error(w, "kind must be type, mime or ext", http.StatusBadRequest)
+		return
+	}
+	if p.Filter == "" {
+		http.Error(w, "missing filter", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if p.Refs, p.Next, err = s.db.RefsPage(p.Kind, p.Filter, q.Get("cursor"), pageSize); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Title = p.Kind + " " + p.Filter
+	render(w, "list.html", p)
+}
+
+// uiMissing lists a page of the blobs that are referenced but not
+// found.
+func (s *server) uiMissing(w http.ResponseWriter, r *http.Request) {
+	p := listPage{Title: "missing", Kind: "missing"}
+	var err error
+	if p.Refs, p.Next, err = s.db.RefsPage("missing", "", r.URL.Query().Get("cursor"), pageSize); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, "list.html", p)
+}
+
+// uiBlob describes a blob, with a page of its parents and all of its
+// children.
+func (s *server) uiBlob(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := struct {
+		Title, Ref        string
+		Blob              *db.BlobRecord
+		Parents, Children []string
+		NextParents       string
+	}{Ref: strings.TrimSpace(q.Get("ref"))}
+	if p.Ref == "" {
+		http.Error(w, "missing ref", http.StatusBadRequest)
+		return
+	}
+	p.Title = p.Ref
+	rec, err := s.db.Describe(p.Ref)
+	switch {
+	case err == nil:
+		p.Blob = &rec
+	case err != db.ErrNotFound:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Parents, p.NextParents, err = s.db.ParentsPage(p.Ref, q.Get("cursor"), pageSize); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Children, err = s.db.Children(p.Ref); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, "blob.html", p)
+}
+
+// uiStats summarizes the index. It scans the entire index, so is slow
+// for large ones.
+func (s *server) uiStats(w http.ResponseWriter, r *http.Request) {
+	render(w, "stats.html", struct {
+		Title string
+		Stats db.Stats
+	}{"stats", s.db.Stats()})
+}